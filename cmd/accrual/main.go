@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/DenisKhanov/Gophermart/internal/accrual/config"
+	"github.com/DenisKhanov/Gophermart/internal/accrual/handlers"
+	"github.com/DenisKhanov/Gophermart/internal/accrual/repositories"
+	"github.com/DenisKhanov/Gophermart/internal/accrual/services"
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func init() {
+	// Установка флага для сериализации decimal в JSON без кавычек
+	decimal.MarshalJSONWithoutQuotes = true
+}
+
+func main() {
+	cfg := config.NewConfig()
+
+	logLevel, err := logrus.ParseLevel(cfg.EnvLogLevel)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	logrus.SetLevel(logLevel)
+	logrus.Infof("Accrual started:\nServer addres %s\nRate limit %d\nWorkers %d\nLog level %s\n", cfg.EnvServAdr, cfg.EnvRateLimit, cfg.EnvWorkersCount, cfg.EnvLogLevel)
+
+	accrualRepository := repositories.NewInMemoryRepo()
+	accrualService := services.NewAccrualServices(accrualRepository)
+	accrualHandler := handlers.NewHandlers(accrualService)
+
+	router := gin.Default()
+
+	apiRoutes := router.Group("/api")
+	apiRoutes.GET("/orders/:number", accrualHandler.MiddlewareRateLimit(cfg.EnvRateLimit), accrualHandler.GetOrder)
+	apiRoutes.POST("/orders", accrualHandler.RegisterOrder)
+	apiRoutes.POST("/goods", accrualHandler.RegisterReward)
+
+	server := &http.Server{Addr: cfg.EnvServAdr, Handler: router}
+
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	workersDone := make(chan struct{})
+	go func() {
+		defer close(workersDone)
+		accrualService.RunWorkers(workersCtx, cfg.EnvWorkersCount)
+	}()
+
+	go func() {
+		if err = server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			logrus.Error(err)
+		}
+	}()
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+
+	<-signalChan
+
+	logrus.Info("Shutting down accrual...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err = server.Shutdown(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "HTTP server Shutdown: %v\n", err)
+	}
+	stopWorkers()
+	<-workersDone
+
+	logrus.Info("Accrual exited")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/DenisKhanov/Gophermart/internal/app/migrations"
+	"github.com/DenisKhanov/Gophermart/internal/app/models"
+	"github.com/DenisKhanov/Gophermart/internal/app/services"
+	"github.com/google/uuid"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `usage:
+  gophermart [flags]                        start server (pending migrations are applied automatically)
+  gophermart [flags] migrate up             apply all pending migrations
+  gophermart [flags] migrate down [N]       revert N last applied migrations (default 1)
+  gophermart [flags] migrate status         show migrations status
+  gophermart [flags] sessions revoke LOGIN  revoke all sessions of the user
+  gophermart [flags] users set-role LOGIN ROLE
+                                            set user role (user, support or admin) and revoke the user's sessions`
+
+// runCommand выполняет подкоманду, переданную в аргументах командной строки после флагов.
+// Для файлового хранилища migrator равен nil
+func runCommand(ctx context.Context, migrator *migrations.Migrator, repository services.Repository, args []string) error {
+	switch args[0] {
+	case "migrate":
+		return runMigrate(ctx, migrator, args[1:])
+	case "sessions", "users":
+		if migrator != nil {
+			if err := migrator.Up(ctx); err != nil {
+				return err
+			}
+		}
+		if args[0] == "users" {
+			return runUsers(ctx, repository, args[1:])
+		}
+		return runSessions(ctx, repository, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+}
+
+// runMigrate выполняет подкоманду migrate
+func runMigrate(ctx context.Context, migrator *migrations.Migrator, args []string) error {
+	if migrator == nil {
+		return fmt.Errorf("migrate: command requires DATABASE_URI")
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("migrate: subcommand is required\n%s", usage)
+	}
+	switch args[0] {
+	case "up":
+		return migrator.Up(ctx)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("migrate down: invalid number of steps %q", args[1])
+			}
+			steps = n
+		}
+		return migrator.Down(ctx, steps)
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, status.Name, appliedAt)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("migrate: unknown subcommand %q\n%s", args[0], usage)
+	}
+}
+
+// runSessions выполняет подкоманду sessions
+func runSessions(ctx context.Context, repository services.Repository, args []string) error {
+	if len(args) != 2 || args[0] != "revoke" {
+		return fmt.Errorf("sessions: expected revoke LOGIN\n%s", usage)
+	}
+	userID, err := repository.GetUUIDFromUsers(ctx, args[1])
+	if err != nil {
+		return err
+	}
+	if err = repository.RevokeUserSessions(ctx, userID, uuid.Nil); err != nil {
+		return err
+	}
+	fmt.Printf("all sessions of user %s revoked\n", args[1])
+	return nil
+}
+
+// runUsers выполняет подкоманду users
+func runUsers(ctx context.Context, repository services.Repository, args []string) error {
+	if len(args) != 3 || args[0] != "set-role" {
+		return fmt.Errorf("users: expected set-role LOGIN ROLE\n%s", usage)
+	}
+	login, role := args[1], args[2]
+	if !models.ValidRole(role) {
+		return fmt.Errorf("users: unknown role %q", role)
+	}
+	userID, err := repository.GetUUIDFromUsers(ctx, login)
+	if err != nil {
+		return err
+	}
+	// роль записана в выпущенных токенах доступа, поэтому сессии пользователя отзываются,
+	// и новая роль действует со следующего входа
+	err = repository.WithTx(ctx, func(ctx context.Context) error {
+		if err := repository.SetUserRole(ctx, userID, role); err != nil {
+			return err
+		}
+		return repository.RevokeUserSessions(ctx, userID, uuid.Nil)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("user %s now has role %s, all sessions revoked\n", login, role)
+	return nil
+}
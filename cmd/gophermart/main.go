@@ -3,10 +3,19 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
+	"github.com/DenisKhanov/Gophermart/internal/app/accrualclient"
+	"github.com/DenisKhanov/Gophermart/internal/app/auth"
 	"github.com/DenisKhanov/Gophermart/internal/app/config"
+	"github.com/DenisKhanov/Gophermart/internal/app/events"
 	"github.com/DenisKhanov/Gophermart/internal/app/handlers"
 	"github.com/DenisKhanov/Gophermart/internal/app/logcfg"
+	"github.com/DenisKhanov/Gophermart/internal/app/loginguard"
+	"github.com/DenisKhanov/Gophermart/internal/app/migrations"
+	"github.com/DenisKhanov/Gophermart/internal/app/models"
+	"github.com/DenisKhanov/Gophermart/internal/app/notify"
+	"github.com/DenisKhanov/Gophermart/internal/app/policy"
 	"github.com/DenisKhanov/Gophermart/internal/app/repositories"
 	"github.com/DenisKhanov/Gophermart/internal/app/services"
 	"github.com/gin-gonic/gin"
@@ -30,31 +39,169 @@ func main() {
 		err                  error
 		cfg                  *config.ENVConfig
 		GophermartRepository services.Repository
+		closeStorage         func() error
 	)
 
 	cfg = config.NewConfig()
-	confPool, err := pgxpool.ParseConfig(cfg.EnvDataBase)
+	logcfg.RunLoggerConfig(cfg.EnvLogLevel)
+
+	storage, err := cfg.Storage()
 	if err != nil {
-		logrus.Errorf("error parsing config: %v", err)
+		logrus.Error(err)
+		os.Exit(1)
 	}
-	confPool.MaxConns = 50
-	confPool.MinConns = 10
-	dbPool, err = pgxpool.NewWithConfig(context.Background(), confPool)
-	if err != nil {
-		logrus.Error("Don't connect to dbPool: ", err)
+	if args := flag.Args(); len(args) > 0 && storage == config.StorageMemory {
+		logrus.Errorf("command %q requires postgres or file storage", args[0])
 		os.Exit(1)
 	}
+	switch storage {
+	case config.StorageFile:
+		fileRepo, err := repositories.NewInFileRepo(cfg.EnvFileStoragePath)
+		if err != nil {
+			logrus.Error("Don't open file storage: ", err)
+			os.Exit(1)
+		}
+		// с файловым хранилищем подкоманды выполняются при остановленном сервере, иначе их изменения будут потеряны
+		if args := flag.Args(); len(args) > 0 {
+			err = runCommand(context.Background(), nil, fileRepo, args)
+			if closeErr := fileRepo.Close(); closeErr != nil {
+				logrus.Error("Don't close storage: ", closeErr)
+			}
+			if err != nil {
+				logrus.Error(err)
+				os.Exit(1)
+			}
+			return
+		}
+		logrus.Infof("data is stored in file %s", cfg.EnvFileStoragePath)
+		GophermartRepository = fileRepo
+		closeStorage = fileRepo.Close
+	case config.StorageMemory:
+		logrus.Warn("all data is stored in memory and will be lost on restart")
+		GophermartRepository = repositories.NewInMemoryRepo()
+	default:
+		confPool, err := pgxpool.ParseConfig(cfg.EnvDataBase)
+		if err != nil {
+			logrus.Error("error parsing config: ", err)
+			os.Exit(1)
+		}
+		confPool.MaxConns = 50
+		confPool.MinConns = 10
+		dbPool, err = pgxpool.NewWithConfig(context.Background(), confPool)
+		if err != nil {
+			logrus.Error("Don't connect to dbPool: ", err)
+			os.Exit(1)
+		}
 
-	defer dbPool.Close()
-	GophermartRepository = repositories.NewURLInDBRepo(dbPool)
+		defer dbPool.Close()
 
-	logcfg.RunLoggerConfig(cfg.EnvLogLevel)
+		migrator, err := migrations.NewMigrator(dbPool)
+		if err != nil {
+			logrus.Error(err)
+			os.Exit(1)
+		}
+		// подкоманды (например, gophermart migrate status) выполняются вместо запуска сервера
+		if args := flag.Args(); len(args) > 0 {
+			if err = runCommand(context.Background(), migrator, repositories.NewURLInDBRepo(dbPool), args); err != nil {
+				logrus.Error(err)
+				os.Exit(1)
+			}
+			return
+		}
+		if err = migrator.Up(context.Background()); err != nil {
+			logrus.Error("Don't migrate database: ", err)
+			os.Exit(1)
+		}
+		GophermartRepository = repositories.NewURLInDBRepo(dbPool)
+	}
 	logrus.Infof("Server started:\nServer addres %s\nBase URL %s\nLog level %s\n", cfg.EnvServAdr, cfg.EnvAccrualSystemAddress, cfg.EnvLogLevel)
 
-	GophermartService := services.NewGmartServices(GophermartRepository, cfg.EnvAccrualSystemAddress, dbPool)
-	GophermartHandler := handlers.NewHandlers(GophermartService, dbPool)
+	accrualClient, err := accrualclient.NewHTTPClient(cfg.EnvAccrualSystemAddress)
+	if err != nil {
+		logrus.Error(err)
+		os.Exit(1)
+	}
+	jwtManager, err := auth.NewJWTManagerFromConfig(cfg.EnvJWTKeyFile, cfg.EnvJWTSecret, cfg.EnvJWTTokenExp)
+	if err != nil {
+		logrus.Error("Don't configure JWT keys: ", err)
+		os.Exit(1)
+	}
+	registrationPolicy, err := policy.NewRegistrationPolicy(policy.Config{
+		Enabled:         cfg.EnvPolicyEnabled,
+		LoginMinLen:     cfg.EnvLoginMinLen,
+		LoginMaxLen:     cfg.EnvLoginMaxLen,
+		PasswordMinLen:  cfg.EnvPasswordMinLen,
+		PasswordClasses: cfg.EnvPasswordClasses,
+		DenyListPath:    cfg.EnvPasswordDenyList,
+	})
+	if err != nil {
+		logrus.Error("Don't configure registration policy: ", err)
+		os.Exit(1)
+	}
+	if cfg.EnvLoginLockout <= 0 {
+		logrus.Error("Login lockout duration must be positive")
+		os.Exit(1)
+	}
+	loginGuard := loginguard.NewGuard(loginguard.Config{
+		MaxLoginFailures: cfg.EnvLoginMaxFailures,
+		MaxIPFailures:    cfg.EnvLoginIPMaxFailures,
+		Lockout:          cfg.EnvLoginLockout,
+	})
+	if cfg.EnvResetTokenExp <= 0 {
+		logrus.Error("Password reset token lifetime must be positive")
+		os.Exit(1)
+	}
+	var notifier services.Notifier
+	switch cfg.EnvNotifier {
+	case "log":
+		notifier = notify.NewLogNotifier()
+	case "file":
+		notifier, err = notify.NewFileNotifier(cfg.EnvNotifierFile)
+		if err != nil {
+			logrus.Error("Don't configure notifier: ", err)
+			os.Exit(1)
+		}
+	default:
+		logrus.Errorf("Unknown notifier %q", cfg.EnvNotifier)
+		os.Exit(1)
+	}
+	var totpWithdrawalThreshold *decimal.Decimal
+	if cfg.EnvTOTPWithdrawalThreshold != "" {
+		threshold, err := decimal.NewFromString(cfg.EnvTOTPWithdrawalThreshold)
+		if err != nil || threshold.IsNegative() {
+			logrus.Errorf("Invalid TOTP withdrawal threshold %q", cfg.EnvTOTPWithdrawalThreshold)
+			os.Exit(1)
+		}
+		totpWithdrawalThreshold = &threshold
+	}
+	// с базой данных события передаются через LISTEN/NOTIFY, чтобы их получали клиенты, подключенные к любому экземпляру
+	eventBroker := events.NewBroker()
+	var eventBus services.EventBus = eventBroker
+	eventsCtx, stopEvents := context.WithCancel(context.Background())
+	defer stopEvents()
+	if dbPool != nil {
+		pgBus := events.NewPGBus(dbPool, eventBroker)
+		go pgBus.Run(eventsCtx)
+		eventBus = pgBus
+	}
+	GophermartService := services.NewGmartServices(GophermartRepository, accrualClient, eventBus, services.AuthConfig{
+		JWTManager:              jwtManager,
+		RefreshTokenExp:         cfg.EnvRefreshTokenExp,
+		ResetTokenExp:           cfg.EnvResetTokenExp,
+		RegistrationPolicy:      registrationPolicy,
+		LoginGuard:              loginGuard,
+		Notifier:                notifier,
+		TOTPIssuer:              cfg.EnvTOTPIssuer,
+		TOTPWithdrawalThreshold: totpWithdrawalThreshold,
+	})
+	GophermartHandler := handlers.NewHandlers(GophermartService)
 
 	router := gin.Default()
+	// без явно заданных доверенных прокси IP-адрес клиента берется из соединения, а не из подделываемого X-Forwarded-For
+	if err = router.SetTrustedProxies(cfg.EnvTrustedProxies); err != nil {
+		logrus.Error("Don't set trusted proxies: ", err)
+		os.Exit(1)
+	}
 
 	//Public middleware routers group
 	publicRoutes := router.Group("/api/user")
@@ -63,6 +210,10 @@ func main() {
 
 	publicRoutes.POST("/register", GophermartHandler.CreateUser)
 	publicRoutes.POST("/login", GophermartHandler.LogIn)
+	publicRoutes.POST("/login/2fa", GophermartHandler.LogInTwoFactor)
+	publicRoutes.POST("/token/refresh", GophermartHandler.RefreshTokens)
+	publicRoutes.POST("/password/reset", GophermartHandler.RequestPasswordReset)
+	publicRoutes.POST("/password/reset/confirm", GophermartHandler.ConfirmPasswordReset)
 
 	//Private middleware routers group
 	privateRoutes := router.Group("/api/user")
@@ -70,22 +221,60 @@ func main() {
 	privateRoutes.Use(GophermartHandler.MiddlewareLogging())
 	privateRoutes.Use(GophermartHandler.MiddlewareCompress())
 
+	privateRoutes.POST("/logout", GophermartHandler.LogOut)
+	privateRoutes.POST("/password", GophermartHandler.ChangePassword)
+	privateRoutes.POST("/2fa/enroll", GophermartHandler.EnrollTOTP)
+	privateRoutes.POST("/2fa/verify", GophermartHandler.VerifyTOTP)
+	privateRoutes.POST("/2fa/disable", GophermartHandler.DisableTOTP)
 	privateRoutes.POST("/orders", GophermartHandler.InputUserOrder)
+	privateRoutes.POST("/orders/batch", GophermartHandler.InputUserOrders)
 	privateRoutes.GET("/orders", GophermartHandler.GetUserOrdersInfo)
+	privateRoutes.GET("/orders/:number", GophermartHandler.GetUserOrderInfo)
 	privateRoutes.GET("/balance", GophermartHandler.GetUserBalance)
 	privateRoutes.POST("/balance/withdraw", GophermartHandler.WithdrawalBonusForNewOrder)
 	privateRoutes.GET("/withdrawals", GophermartHandler.GetUserWithdrawalsInfo)
+	privateRoutes.GET("/ledger", GophermartHandler.GetUserLedgerInfo)
+
+	//Event stream routers group, responses are streamed and must not be buffered by gzip
+	eventRoutes := router.Group("/api/user")
+	eventRoutes.Use(GophermartHandler.MiddlewareAuthPrivate())
+	eventRoutes.Use(GophermartHandler.MiddlewareLogging())
+
+	eventRoutes.GET("/orders/events", GophermartHandler.OrderEvents)
+
+	//Admin middleware routers group, available to support staff and administrators
+	adminRoutes := router.Group("/api/admin")
+	adminRoutes.Use(GophermartHandler.MiddlewareAuthPrivate())
+	adminRoutes.Use(GophermartHandler.MiddlewareRequireRole(models.RoleSupport, models.RoleAdmin))
+	adminRoutes.Use(GophermartHandler.MiddlewareLogging())
+
+	adminRoutes.GET("/users/:login", GophermartHandler.GetUserInfo)
+	adminRoutes.POST("/users/:login/unlock", GophermartHandler.UnlockLogin)
+	adminRoutes.GET("/users/:login/withdrawals", GophermartHandler.GetUserWithdrawalsByLogin)
+	adminRoutes.POST("/users/:login/balance/adjustments", GophermartHandler.MiddlewareRequireRole(models.RoleAdmin),
+		GophermartHandler.AdjustUserBalance)
+	adminRoutes.GET("/orders", GophermartHandler.FindOrders)
+	adminRoutes.POST("/orders/:number/recheck", GophermartHandler.RecheckOrder)
 
 	server := &http.Server{Addr: cfg.EnvServAdr, Handler: router}
+	// открытые потоки событий не завершаются сами и задержали бы остановку сервера
+	server.RegisterOnShutdown(eventBroker.Close)
 
 	logrus.Info("Starting server on: ", cfg.EnvServAdr)
 
+	pollerCtx, stopPoller := context.WithCancel(context.Background())
+	pollerDone := make(chan struct{})
 	go func() {
-		//TODO определить подходящий контекст
-		ctx := context.Background()
+		defer close(pollerDone)
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
 		for {
-			_ = GophermartService.RunUpdateOrdersStatusJob(ctx)
-			time.Sleep(1 * time.Second)
+			_ = GophermartService.RunUpdateOrdersStatusJob(pollerCtx)
+			select {
+			case <-pollerCtx.Done():
+				return
+			case <-ticker.C:
+			}
 		}
 	}()
 
@@ -107,6 +296,14 @@ func main() {
 	if err = server.Shutdown(ctx); err != nil {
 		fmt.Fprintf(os.Stderr, "HTTP server Shutdown: %v\n", err)
 	}
+	stopPoller()
+	<-pollerDone
+	stopEvents()
+	if closeStorage != nil {
+		if err = closeStorage(); err != nil {
+			logrus.Error("Don't close storage: ", err)
+		}
+	}
 
 	// TODO подумать над добавлением функционала при получении сигнала
 
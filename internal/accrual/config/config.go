@@ -0,0 +1,36 @@
+package config
+
+import (
+	"flag"
+	"github.com/caarlos0/env"
+	"github.com/sirupsen/logrus"
+)
+
+// ENVConfig holds configuration settings of the accrual system extracted from flags and environment variables.
+type ENVConfig struct {
+	EnvServAdr      string `env:"RUN_ADDRESS"`
+	EnvLogLevel     string `env:"LOG_LEVEL"`
+	EnvRateLimit    int    `env:"RATE_LIMIT"`
+	EnvWorkersCount int    `env:"WORKERS_COUNT"`
+}
+
+func NewConfig() *ENVConfig {
+	var cfg ENVConfig
+
+	flag.StringVar(&cfg.EnvServAdr, "a", "localhost:8080", "HTTP server address")
+
+	flag.StringVar(&cfg.EnvLogLevel, "l", "info", "Set logg level")
+
+	flag.IntVar(&cfg.EnvRateLimit, "q", 0, "Set max requests per minute to GET /api/orders/{number}, 0 - unlimited")
+
+	flag.IntVar(&cfg.EnvWorkersCount, "w", 5, "Set count of accrual calculation workers")
+
+	flag.Parse()
+
+	err := env.Parse(&cfg)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	return &cfg
+}
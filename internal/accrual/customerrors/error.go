@@ -0,0 +1,9 @@
+package customerrors
+
+import "errors"
+
+var ErrInvalidRequest = errors.New("invalid request format")
+var ErrOrderNumber = errors.New("invalid order number format")
+var ErrOrderAlreadyRegistered = errors.New("the order has already been registered")
+var ErrOrderNotRegistered = errors.New("the order is not registered")
+var ErrRewardAlreadyRegistered = errors.New("the reward match has already been registered")
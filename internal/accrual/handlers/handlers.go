@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/DenisKhanov/Gophermart/internal/accrual/customerrors"
+	"github.com/DenisKhanov/Gophermart/internal/accrual/models"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Service interface {
+	RegisterReward(ctx context.Context, reward models.Reward) error
+	RegisterOrder(ctx context.Context, receipt models.OrderReceipt) error
+	GetOrder(ctx context.Context, orderNumber string) (models.Order, error)
+}
+
+type Handlers struct {
+	service Service
+}
+
+func NewHandlers(service Service) *Handlers {
+	return &Handlers{
+		service: service,
+	}
+}
+
+// GetOrder получение информации о расчете начислений баллов лояльности за совершенный заказ
+func (h Handlers) GetOrder(c *gin.Context) {
+	ctx := c.Request.Context()
+	order, err := h.service.GetOrder(ctx, c.Param("number"))
+	if err != nil {
+		if errors.Is(err, customerrors.ErrOrderNotRegistered) {
+			c.Status(http.StatusNoContent)
+			return
+		}
+		logrus.Error(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, order)
+}
+
+// RegisterOrder регистрация нового совершенного заказа
+func (h Handlers) RegisterOrder(c *gin.Context) {
+	ctx := c.Request.Context()
+	var receipt models.OrderReceipt
+	if err := c.ShouldBindJSON(&receipt); err != nil {
+		logrus.Error(err)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	if err := h.service.RegisterOrder(ctx, receipt); err != nil {
+		switch {
+		case errors.Is(err, customerrors.ErrOrderNumber), errors.Is(err, customerrors.ErrInvalidRequest):
+			c.Status(http.StatusBadRequest)
+		case errors.Is(err, customerrors.ErrOrderAlreadyRegistered):
+			c.Status(http.StatusConflict)
+		default:
+			logrus.Error(err)
+			c.Status(http.StatusInternalServerError)
+		}
+		return
+	}
+	c.Status(http.StatusAccepted)
+}
+
+// RegisterReward регистрация информации о новой механике вознаграждения за товар
+func (h Handlers) RegisterReward(c *gin.Context) {
+	ctx := c.Request.Context()
+	var reward models.Reward
+	if err := c.ShouldBindJSON(&reward); err != nil {
+		logrus.Error(err)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	if err := h.service.RegisterReward(ctx, reward); err != nil {
+		switch {
+		case errors.Is(err, customerrors.ErrInvalidRequest):
+			c.Status(http.StatusBadRequest)
+		case errors.Is(err, customerrors.ErrRewardAlreadyRegistered):
+			c.Status(http.StatusConflict)
+		default:
+			logrus.Error(err)
+			c.Status(http.StatusInternalServerError)
+		}
+		return
+	}
+	c.Status(http.StatusAccepted)
+}
+
+// MiddlewareRateLimit ограничивает количество запросов в минуту (фиксированное окно),
+// при превышении отвечает 429 с заголовком Retry-After. При limit <= 0 ограничение отключено
+func (h Handlers) MiddlewareRateLimit(limit int) gin.HandlerFunc {
+	var (
+		mu          sync.Mutex
+		windowStart time.Time
+		count       int
+	)
+	return func(c *gin.Context) {
+		if limit <= 0 {
+			c.Next()
+			return
+		}
+		mu.Lock()
+		now := time.Now()
+		if now.Sub(windowStart) >= time.Minute {
+			windowStart = now
+			count = 0
+		}
+		count++
+		exceeded := count > limit
+		retryAfter := windowStart.Add(time.Minute).Sub(now)
+		mu.Unlock()
+
+		if exceeded {
+			seconds := int(retryAfter.Seconds())
+			if retryAfter > time.Duration(seconds)*time.Second {
+				seconds++
+			}
+			c.Header("Retry-After", strconv.Itoa(seconds))
+			c.String(http.StatusTooManyRequests, fmt.Sprintf("No more than %d requests per minute allowed", limit))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
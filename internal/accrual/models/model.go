@@ -0,0 +1,46 @@
+package models
+
+import (
+	"github.com/shopspring/decimal"
+)
+
+// Статусы расчета начислений по заказу
+const (
+	StatusRegistered = "REGISTERED"
+	StatusInvalid    = "INVALID"
+	StatusProcessing = "PROCESSING"
+	StatusProcessed  = "PROCESSED"
+)
+
+// Типы вознаграждения за товар
+const (
+	RewardTypePercent = "%"
+	RewardTypePoints  = "pt"
+)
+
+// Reward механика вознаграждения за товар
+type Reward struct {
+	Match      string          `json:"match"`
+	Reward     decimal.Decimal `json:"reward"`
+	RewardType string          `json:"reward_type"`
+}
+
+// Good товар из состава чека
+type Good struct {
+	Description string          `json:"description"`
+	Price       decimal.Decimal `json:"price"`
+}
+
+// OrderReceipt запрос на регистрацию нового совершенного заказа
+type OrderReceipt struct {
+	Order string `json:"order"`
+	Goods []Good `json:"goods"`
+}
+
+// Order заказ и состояние расчета начисления по нему
+type Order struct {
+	Number  string           `json:"order"`
+	Status  string           `json:"status"`
+	Accrual *decimal.Decimal `json:"accrual,omitempty"`
+	Goods   []Good           `json:"-"`
+}
@@ -0,0 +1,116 @@
+package repositories
+
+import (
+	"context"
+	"github.com/DenisKhanov/Gophermart/internal/accrual/customerrors"
+	"github.com/DenisKhanov/Gophermart/internal/accrual/models"
+	"github.com/shopspring/decimal"
+	"sync"
+)
+
+// InMemoryRepo потокобезопасное хранилище механик вознаграждения и заказов в памяти
+type InMemoryRepo struct {
+	mu         sync.RWMutex
+	rewards    []models.Reward          // механики в порядке регистрации
+	matches    map[string]struct{}      // зарегистрированные ключи поиска
+	orders     map[string]*models.Order // заказы по номеру
+	registered []string                 // очередь номеров заказов, ожидающих расчета
+}
+
+func NewInMemoryRepo() *InMemoryRepo {
+	return &InMemoryRepo{
+		matches: make(map[string]struct{}),
+		orders:  make(map[string]*models.Order),
+	}
+}
+
+// StoreReward сохраняет новую механику вознаграждения или возвращает ошибку, если ключ поиска уже занят
+func (r *InMemoryRepo) StoreReward(_ context.Context, reward models.Reward) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.matches[reward.Match]; ok {
+		return customerrors.ErrRewardAlreadyRegistered
+	}
+	r.matches[reward.Match] = struct{}{}
+	r.rewards = append(r.rewards, reward)
+	return nil
+}
+
+// GetRewards возвращает копию списка всех зарегистрированных механик вознаграждения
+func (r *InMemoryRepo) GetRewards(_ context.Context) ([]models.Reward, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	rewards := make([]models.Reward, len(r.rewards))
+	copy(rewards, r.rewards)
+	return rewards, nil
+}
+
+// StoreOrder сохраняет новый заказ со статусом REGISTERED или возвращает ошибку, если заказ уже зарегистрирован
+func (r *InMemoryRepo) StoreOrder(_ context.Context, receipt models.OrderReceipt) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.orders[receipt.Order]; ok {
+		return customerrors.ErrOrderAlreadyRegistered
+	}
+	r.orders[receipt.Order] = &models.Order{
+		Number: receipt.Order,
+		Status: models.StatusRegistered,
+		Goods:  receipt.Goods,
+	}
+	r.registered = append(r.registered, receipt.Order)
+	return nil
+}
+
+// GetOrder возвращает заказ по номеру или ошибку, если заказ не зарегистрирован
+func (r *InMemoryRepo) GetOrder(_ context.Context, orderNumber string) (models.Order, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	order, ok := r.orders[orderNumber]
+	if !ok {
+		return models.Order{}, customerrors.ErrOrderNotRegistered
+	}
+	return *order, nil
+}
+
+// ClaimRegisteredOrders переводит до limit заказов из очереди в статус PROCESSING и возвращает их для расчета
+func (r *InMemoryRepo) ClaimRegisteredOrders(_ context.Context, limit int) ([]models.Order, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if limit > len(r.registered) {
+		limit = len(r.registered)
+	}
+	claimed := make([]models.Order, 0, limit)
+	for _, number := range r.registered[:limit] {
+		order := r.orders[number]
+		order.Status = models.StatusProcessing
+		claimed = append(claimed, *order)
+	}
+	r.registered = r.registered[limit:]
+	return claimed, nil
+}
+
+// ReleaseOrder возвращает заказ, расчет по которому не удался, в статус REGISTERED и в конец очереди
+func (r *InMemoryRepo) ReleaseOrder(_ context.Context, orderNumber string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	order, ok := r.orders[orderNumber]
+	if !ok {
+		return customerrors.ErrOrderNotRegistered
+	}
+	order.Status = models.StatusRegistered
+	r.registered = append(r.registered, orderNumber)
+	return nil
+}
+
+// UpdateOrder сохраняет результат расчета начисления по заказу
+func (r *InMemoryRepo) UpdateOrder(_ context.Context, orderNumber, status string, accrual *decimal.Decimal) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	order, ok := r.orders[orderNumber]
+	if !ok {
+		return customerrors.ErrOrderNotRegistered
+	}
+	order.Status = status
+	order.Accrual = accrual
+	return nil
+}
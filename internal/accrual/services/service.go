@@ -0,0 +1,201 @@
+package services
+
+import (
+	"context"
+	"github.com/DenisKhanov/Gophermart/internal/accrual/customerrors"
+	"github.com/DenisKhanov/Gophermart/internal/accrual/models"
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// claimBatchSize количество заказов, которое воркер забирает на расчет за один раз
+const claimBatchSize = 10
+
+// pollInterval период проверки очереди заказов, если не пришло уведомление о новом заказе
+const pollInterval = time.Second
+
+// Repository defines the interface for interacting with the accrual storage backend.
+type Repository interface {
+	StoreReward(ctx context.Context, reward models.Reward) error
+	GetRewards(ctx context.Context) ([]models.Reward, error)
+	StoreOrder(ctx context.Context, receipt models.OrderReceipt) error
+	GetOrder(ctx context.Context, orderNumber string) (models.Order, error)
+	ClaimRegisteredOrders(ctx context.Context, limit int) ([]models.Order, error)
+	ReleaseOrder(ctx context.Context, orderNumber string) error
+	UpdateOrder(ctx context.Context, orderNumber, status string, accrual *decimal.Decimal) error
+}
+
+type AccrualServices struct {
+	repository Repository
+	notify     chan struct{} // сигнал воркерам о появлении новых заказов
+}
+
+func NewAccrualServices(repository Repository) *AccrualServices {
+	return &AccrualServices{
+		repository: repository,
+		notify:     make(chan struct{}, 1),
+	}
+}
+
+// isValidLuhn проверяет, действителен ли номер согласно алгоритму Луна.
+func isValidLuhn(number string) bool {
+	if number == "" {
+		return false
+	}
+	var sum int
+	nDigits := len(number)
+	parity := nDigits % 2
+
+	for i, r := range number {
+		digit, err := strconv.Atoi(string(r))
+		if err != nil {
+			return false
+		}
+		if i%2 == parity {
+			digit = digit * 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+	}
+	return sum%10 == 0
+}
+
+// RegisterReward проверяет и сохраняет новую механику вознаграждения за товар
+func (s *AccrualServices) RegisterReward(ctx context.Context, reward models.Reward) error {
+	if strings.TrimSpace(reward.Match) == "" || reward.Reward.IsNegative() {
+		return customerrors.ErrInvalidRequest
+	}
+	if reward.RewardType != models.RewardTypePercent && reward.RewardType != models.RewardTypePoints {
+		return customerrors.ErrInvalidRequest
+	}
+	return s.repository.StoreReward(ctx, reward)
+}
+
+// RegisterOrder проверяет и сохраняет состав нового совершенного заказа, расчет начисления выполняется асинхронно
+func (s *AccrualServices) RegisterOrder(ctx context.Context, receipt models.OrderReceipt) error {
+	if !isValidLuhn(receipt.Order) {
+		return customerrors.ErrOrderNumber
+	}
+	for _, good := range receipt.Goods {
+		if good.Price.IsNegative() {
+			return customerrors.ErrInvalidRequest
+		}
+	}
+	if err := s.repository.StoreOrder(ctx, receipt); err != nil {
+		return err
+	}
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// GetOrder возвращает информацию о расчете начисления по заказу
+func (s *AccrualServices) GetOrder(ctx context.Context, orderNumber string) (models.Order, error) {
+	return s.repository.GetOrder(ctx, orderNumber)
+}
+
+// RunWorkers запускает numOfWorkers воркеров расчета начислений и блокируется до отмены контекста
+func (s *AccrualServices) RunWorkers(ctx context.Context, numOfWorkers int) {
+	var wg sync.WaitGroup
+	for i := 0; i < numOfWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.worker(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+// worker забирает зарегистрированные заказы из очереди и рассчитывает по ним начисления
+func (s *AccrualServices) worker(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		orders, err := s.repository.ClaimRegisteredOrders(ctx, claimBatchSize)
+		if err != nil {
+			logrus.Error(err)
+		}
+		var released bool
+		for _, order := range orders {
+			status, accrual, err := s.calculateAccrual(ctx, order)
+			if err == nil {
+				err = s.repository.UpdateOrder(ctx, order.Number, status, accrual)
+			}
+			if err != nil {
+				logrus.Error(err)
+				s.releaseOrder(ctx, order.Number)
+				released = true
+				continue
+			}
+			logrus.Infof("order %s %s, accrual %v", order.Number, status, accrual)
+		}
+		// возвращенные в очередь заказы повторно рассчитываются не раньше следующего тика
+		if len(orders) == claimBatchSize && !released {
+			if ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.notify:
+		case <-ticker.C:
+		}
+	}
+}
+
+// releaseOrder возвращает заказ в очередь, чтобы он не остался в статусе PROCESSING навсегда. Если вернуть
+// заказ не удалось, заказ получает статус INVALID
+func (s *AccrualServices) releaseOrder(ctx context.Context, orderNumber string) {
+	err := s.repository.ReleaseOrder(ctx, orderNumber)
+	if err == nil {
+		return
+	}
+	logrus.Error(err)
+	if err = s.repository.UpdateOrder(ctx, orderNumber, models.StatusInvalid, nil); err != nil {
+		logrus.Error(err)
+	}
+}
+
+// calculateAccrual суммирует вознаграждения по всем совпадениям товаров заказа с механиками,
+// если ни один товар не совпал ни с одной механикой, то заказ получает статус INVALID
+func (s *AccrualServices) calculateAccrual(ctx context.Context, order models.Order) (string, *decimal.Decimal, error) {
+	rewards, err := s.repository.GetRewards(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	var (
+		accrual decimal.Decimal
+		matched bool
+	)
+	hundred := decimal.NewFromInt(100)
+	for _, good := range order.Goods {
+		for _, reward := range rewards {
+			if !strings.Contains(good.Description, reward.Match) {
+				continue
+			}
+			matched = true
+			switch reward.RewardType {
+			case models.RewardTypePercent:
+				accrual = accrual.Add(good.Price.Mul(reward.Reward).Div(hundred))
+			case models.RewardTypePoints:
+				accrual = accrual.Add(reward.Reward)
+			}
+		}
+	}
+	if !matched {
+		return models.StatusInvalid, nil, nil
+	}
+	accrual = accrual.Round(2)
+	return models.StatusProcessed, &accrual, nil
+}
@@ -0,0 +1,106 @@
+package accrualclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/DenisKhanov/Gophermart/internal/app/customerrors"
+	"github.com/DenisKhanov/Gophermart/internal/app/models"
+	"github.com/DenisKhanov/Gophermart/internal/app/ratelimit"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// maxBodySize ограничение размера читаемого ответа accrual системы
+const maxBodySize = 1 << 20
+
+// HTTPClient реализация клиента accrual системы поверх HTTP API
+type HTTPClient struct {
+	baseURL *url.URL
+	client  *http.Client
+}
+
+// NewHTTPClient создает клиента с общим для всех запросов настроенным транспортом
+func NewHTTPClient(address string) (*HTTPClient, error) {
+	baseURL, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid accrual system address %q: %w", address, err)
+	}
+	if baseURL.Scheme == "" || baseURL.Host == "" {
+		return nil, fmt.Errorf("invalid accrual system address %q: scheme and host are required", address)
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   20,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return &HTTPClient{
+		baseURL: baseURL,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   10 * time.Second,
+		},
+	}, nil
+}
+
+// GetOrderAccrual запрашивает у accrual системы информацию о расчете начислений по номеру заказа.
+// Ответы 204, 429 и 500 возвращаются в виде ошибок из пакета customerrors
+func (c *HTTPClient) GetOrderAccrual(ctx context.Context, orderNumber string) (models.AccrualResponseData, error) {
+	orderURL := c.baseURL.JoinPath("api", "orders", orderNumber).String()
+	logrus.Debug(orderURL)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, orderURL, nil)
+	if err != nil {
+		logrus.Error("failed to create request to accrual system: ", err)
+		return models.AccrualResponseData{}, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		logrus.Error("failed to send request to accrual system: ", err)
+		return models.AccrualResponseData{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		logrus.Error("failed to read response body: ", err)
+		return models.AccrualResponseData{}, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		return models.AccrualResponseData{}, customerrors.ErrAccrualOrderNotRegistered
+	case http.StatusTooManyRequests:
+		return models.AccrualResponseData{}, &customerrors.AccrualRateLimitError{
+			RetryAfter:        ratelimit.ParseRetryAfter(resp.Header.Get("Retry-After")),
+			RequestsPerMinute: ratelimit.ParseRequestsPerMinute(body),
+		}
+	case http.StatusInternalServerError:
+		return models.AccrualResponseData{}, fmt.Errorf("%w: %s", customerrors.ErrAccrualInternal, resp.Status)
+	default:
+		return models.AccrualResponseData{}, fmt.Errorf("unexpected accrual system response status: %s", resp.Status)
+	}
+
+	var accrualResponse models.AccrualResponseData
+	if err = json.Unmarshal(body, &accrualResponse); err != nil {
+		logrus.Error("failed to unmarshal response body: ", err)
+		return models.AccrualResponseData{}, err
+	}
+	if accrualResponse.Order != orderNumber {
+		return models.AccrualResponseData{}, fmt.Errorf("%w: requested %s, got %s", customerrors.ErrAccrualOrderMismatch, orderNumber, accrualResponse.Order)
+	}
+	return accrualResponse, nil
+}
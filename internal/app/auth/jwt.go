@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"os"
+	"time"
+)
+
+// MinKeyLen минимальная длина ключа подписи HS256 в байтах
+const MinKeyLen = 32
+
+// PurposeTwoFactor назначение токена, выдаваемого после проверки пароля пользователю с двухфакторной
+// аутентификацией и подтверждающего только первый фактор
+const PurposeTwoFactor = "2fa"
+
+// Claims — claims structure that includes standard claims, UserID, SessionID and the user's Role.
+// Purpose is empty for access tokens and set for tokens that grant nothing but the next login step.
+type Claims struct {
+	jwt.RegisteredClaims
+	UserID    uuid.UUID
+	SessionID uuid.UUID
+	Role      string `json:",omitempty"`
+	Purpose   string `json:",omitempty"`
+}
+
+// JWTManager выпускает и проверяет токены. Токены подписываются активным ключом, идентификатор которого
+// записывается в заголовок kid, а проверяются любым из известных ключей, что позволяет менять ключ подписи,
+// не инвалидируя ранее выпущенные токены
+type JWTManager struct {
+	keys      map[string][]byte // ключи проверки по kid
+	activeKID string            // kid ключа подписи новых токенов
+	tokenExp  time.Duration     // время жизни токена
+}
+
+func NewJWTManager(keys map[string][]byte, activeKID string, tokenExp time.Duration) (*JWTManager, error) {
+	if _, ok := keys[activeKID]; !ok {
+		return nil, fmt.Errorf("active signing key %q not found", activeKID)
+	}
+	for kid, key := range keys {
+		if len(key) < MinKeyLen {
+			return nil, fmt.Errorf("signing key %q is shorter than %d bytes", kid, MinKeyLen)
+		}
+	}
+	if tokenExp <= 0 {
+		return nil, fmt.Errorf("token lifetime must be positive, got %s", tokenExp)
+	}
+	return &JWTManager{keys: keys, activeKID: activeKID, tokenExp: tokenExp}, nil
+}
+
+// keyFile формат файла ключей: {"active": "2024-02", "keys": {"2024-01": "<secret>", "2024-02": "<secret>"}}
+type keyFile struct {
+	Active string            `json:"active"`
+	Keys   map[string]string `json:"keys"`
+}
+
+// NewJWTManagerFromConfig создает JWTManager из файла ключей keyFilePath или, если он не задан, из секрета secret,
+// kid которого вычисляется из самого секрета. Если не задано ни то, ни другое, генерирует случайный ключ,
+// токены которого перестают действовать после перезапуска
+func NewJWTManagerFromConfig(keyFilePath, secret string, tokenExp time.Duration) (*JWTManager, error) {
+	switch {
+	case keyFilePath != "":
+		data, err := os.ReadFile(keyFilePath)
+		if err != nil {
+			return nil, err
+		}
+		var file keyFile
+		if err = json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("parse key file %s: %w", keyFilePath, err)
+		}
+		keys := make(map[string][]byte, len(file.Keys))
+		for kid, key := range file.Keys {
+			keys[kid] = []byte(key)
+		}
+		return NewJWTManager(keys, file.Active, tokenExp)
+	case secret != "":
+		kid := keyID([]byte(secret))
+		return NewJWTManager(map[string][]byte{kid: []byte(secret)}, kid, tokenExp)
+	default:
+		logrus.Warn("JWT signing key is not configured, a random key is used and tokens will not survive restart")
+		key := make([]byte, MinKeyLen)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		kid := keyID(key)
+		return NewJWTManager(map[string][]byte{kid: key}, kid, tokenExp)
+	}
+}
+
+// keyID вычисляет идентификатор ключа, не раскрывающий сам ключ
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// BuildJWTString creates a token with the HS256 signature algorithm and Claims statements and returns it as a string.
+func (m *JWTManager) BuildJWTString(userID, sessionID uuid.UUID, role string) (string, error) {
+	return m.build(Claims{UserID: userID, SessionID: sessionID, Role: role}, m.tokenExp)
+}
+
+// BuildChallengeToken выпускает токен второго шага входа пользователя с временем жизни exp
+func (m *JWTManager) BuildChallengeToken(userID uuid.UUID, exp time.Duration) (string, error) {
+	return m.build(Claims{UserID: userID, Purpose: PurposeTwoFactor}, exp)
+}
+
+func (m *JWTManager) build(claims Claims, exp time.Duration) (string, error) {
+	now := time.Now()
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(exp)),
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = m.activeKID
+	// create token string
+	tokenString, err := token.SignedString(m.keys[m.activeKID])
+	if err != nil {
+		logrus.Error(err)
+		return "", err
+	}
+	return tokenString, nil
+}
+
+// TokenExp возвращает время жизни выпускаемых токенов
+func (m *JWTManager) TokenExp() time.Duration {
+	return m.tokenExp
+}
+
+// ParseToken проверяет подпись и срок действия токена доступа ключом из его заголовка kid и возвращает claims токена
+func (m *JWTManager) ParseToken(tokenString string) (*Claims, error) {
+	return m.parse(tokenString, "")
+}
+
+// ParseChallengeToken проверяет токен второго шага входа и возвращает claims токена
+func (m *JWTManager) ParseChallengeToken(tokenString string) (*Claims, error) {
+	return m.parse(tokenString, PurposeTwoFactor)
+}
+
+// parse проверяет токен и то, что он выпущен для purpose, чтобы токен одного назначения нельзя было предъявить вместо другого
+func (m *JWTManager) parse(tokenString, purpose string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, ok := m.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return key, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("token is not valid")
+	}
+	if claims.Purpose != purpose {
+		return nil, fmt.Errorf("token purpose %q is not %q", claims.Purpose, purpose)
+	}
+	return claims, nil
+}
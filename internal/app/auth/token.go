@@ -0,0 +1,28 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// tokenLen длина случайного токена в байтах
+const tokenLen = 32
+
+// GenerateToken генерирует случайный непрозрачный токен (токен обновления сессии, токен сброса пароля)
+// и возвращает его вместе с хешем для хранения
+func GenerateToken() (token string, hash []byte, err error) {
+	raw := make([]byte, tokenLen)
+	if _, err = rand.Read(raw); err != nil {
+		return "", nil, err
+	}
+	token = base64.RawURLEncoding.EncodeToString(raw)
+	return token, HashToken(token), nil
+}
+
+// HashToken возвращает хеш токена, по которому он ищется в репозитории. Сам токен не хранится,
+// поэтому утечка репозитория не позволяет воспользоваться чужим токеном
+func HashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
@@ -2,17 +2,75 @@ package config
 
 import (
 	"flag"
+	"fmt"
 	"github.com/caarlos0/env"
 	"github.com/sirupsen/logrus"
+	"strings"
+	"time"
 )
 
 // ENVConfig holds configuration settings extracted from environment variables.
 // This struct is used to configure various aspects of the application.
 type ENVConfig struct {
-	EnvServAdr              string `env:"RUN_ADDRESS"`
-	EnvAccrualSystemAddress string `env:"ACCRUAL_SYSTEM_ADDRESS"`
-	EnvDataBase             string `env:"DATABASE_URI"`
-	EnvLogLevel             string `env:"LOG_LEVEL"`
+	EnvServAdr                 string        `env:"RUN_ADDRESS"`
+	EnvAccrualSystemAddress    string        `env:"ACCRUAL_SYSTEM_ADDRESS"`
+	EnvDataBase                string        `env:"DATABASE_URI"`
+	EnvLogLevel                string        `env:"LOG_LEVEL"`
+	EnvFileStoragePath         string        `env:"FILE_STORAGE_PATH"`
+	EnvStorage                 string        `env:"STORAGE"`
+	EnvJWTSecret               string        `env:"JWT_SECRET"`
+	EnvJWTKeyFile              string        `env:"JWT_KEY_FILE"`
+	EnvJWTTokenExp             time.Duration `env:"JWT_TOKEN_EXP"`
+	EnvRefreshTokenExp         time.Duration `env:"REFRESH_TOKEN_EXP"`
+	EnvPolicyEnabled           bool          `env:"REGISTRATION_POLICY"`
+	EnvLoginMinLen             int           `env:"LOGIN_MIN_LEN"`
+	EnvLoginMaxLen             int           `env:"LOGIN_MAX_LEN"`
+	EnvPasswordMinLen          int           `env:"PASSWORD_MIN_LEN"`
+	EnvPasswordClasses         []string      `env:"PASSWORD_CLASSES" envSeparator:","`
+	EnvPasswordDenyList        string        `env:"PASSWORD_DENY_LIST"`
+	EnvLoginMaxFailures        int           `env:"LOGIN_MAX_FAILURES"`
+	EnvLoginIPMaxFailures      int           `env:"LOGIN_IP_MAX_FAILURES"`
+	EnvLoginLockout            time.Duration `env:"LOGIN_LOCKOUT"`
+	EnvTrustedProxies          []string      `env:"TRUSTED_PROXIES" envSeparator:","`
+	EnvResetTokenExp           time.Duration `env:"RESET_TOKEN_EXP"`
+	EnvNotifier                string        `env:"NOTIFIER"`
+	EnvNotifierFile            string        `env:"NOTIFIER_FILE"`
+	EnvTOTPIssuer              string        `env:"TOTP_ISSUER"`
+	EnvTOTPWithdrawalThreshold string        `env:"TOTP_WITHDRAWAL_THRESHOLD"`
+}
+
+// Хранилища данных сервиса
+const (
+	StorageAuto     = "auto" // postgres, если задан DATABASE_URI, иначе file, если задан FILE_STORAGE_PATH, иначе memory
+	StoragePostgres = "postgres"
+	StorageFile     = "file"
+	StorageMemory   = "memory"
+)
+
+// Storage возвращает выбранное хранилище, для StorageAuto определяя его по заданным адресу базы данных и пути к файлу
+func (cfg *ENVConfig) Storage() (string, error) {
+	switch cfg.EnvStorage {
+	case StorageAuto:
+		if cfg.EnvDataBase != "" {
+			return StoragePostgres, nil
+		}
+		if cfg.EnvFileStoragePath != "" {
+			return StorageFile, nil
+		}
+		return StorageMemory, nil
+	case StoragePostgres:
+		if cfg.EnvDataBase == "" {
+			return "", fmt.Errorf("storage %q requires DATABASE_URI", cfg.EnvStorage)
+		}
+	case StorageFile:
+		if cfg.EnvFileStoragePath == "" {
+			return "", fmt.Errorf("storage %q requires FILE_STORAGE_PATH", cfg.EnvStorage)
+		}
+	case StorageMemory:
+	default:
+		return "", fmt.Errorf("unknown storage %q", cfg.EnvStorage)
+	}
+	return cfg.EnvStorage, nil
 }
 
 func NewConfig() *ENVConfig {
@@ -24,10 +82,57 @@ func NewConfig() *ENVConfig {
 
 	flag.StringVar(&cfg.EnvLogLevel, "l", "info", "Set logg level")
 
-	flag.StringVar(&cfg.EnvDataBase, "d", "user=postgres password=12121212 dbname=gophermart port=5433 sslmode=disable", "Set connect dbPool config")
+	flag.StringVar(&cfg.EnvDataBase, "d", "", "Set connect dbPool config, if empty file or memory storage is used")
+
+	flag.StringVar(&cfg.EnvFileStoragePath, "f", "", "Set file storage path, used if database is not set, if empty memory storage is used")
+
+	flag.StringVar(&cfg.EnvStorage, "storage", StorageAuto, "Set storage: auto, postgres, file or memory")
+
+	flag.StringVar(&cfg.EnvJWTSecret, "s", "", "Set JWT signing secret (at least 32 bytes)")
+
+	flag.StringVar(&cfg.EnvJWTKeyFile, "k", "", "Set path to JWT signing keys file, takes precedence over the secret")
+
+	flag.DurationVar(&cfg.EnvJWTTokenExp, "t", 3*time.Hour, "Set JWT token lifetime")
+
+	flag.DurationVar(&cfg.EnvRefreshTokenExp, "e", 30*24*time.Hour, "Set session lifetime without token refresh")
+
+	flag.BoolVar(&cfg.EnvPolicyEnabled, "registration-policy", false, "Enable login and password policy on registration")
+
+	flag.IntVar(&cfg.EnvLoginMinLen, "login-min-len", 5, "Set min login length for registration policy")
+
+	flag.IntVar(&cfg.EnvLoginMaxLen, "login-max-len", 20, "Set max login length for registration policy, 0 is unlimited")
+
+	flag.IntVar(&cfg.EnvPasswordMinLen, "password-min-len", 8, "Set min password length for registration policy")
+
+	passwordClasses := flag.String("password-classes", "upper,lower,digit,special", "Set comma separated character classes required in password")
+
+	flag.StringVar(&cfg.EnvPasswordDenyList, "password-deny-list", "", "Set path to file with denied passwords, one per line")
+
+	flag.IntVar(&cfg.EnvLoginMaxFailures, "login-max-failures", 5, "Set failed login attempts before the login is locked, 0 disables lockout")
+
+	flag.IntVar(&cfg.EnvLoginIPMaxFailures, "login-ip-max-failures", 50, "Set failed login attempts before the client IP is locked, 0 disables lockout")
+
+	flag.DurationVar(&cfg.EnvLoginLockout, "login-lockout", 15*time.Minute, "Set login lockout duration")
+
+	trustedProxies := flag.String("trusted-proxies", "", "Set comma separated trusted proxies whose X-Forwarded-For header is used to get client IP")
+
+	flag.DurationVar(&cfg.EnvResetTokenExp, "reset-token-exp", 30*time.Minute, "Set password reset token lifetime")
+
+	flag.StringVar(&cfg.EnvNotifier, "notifier", "log", "Set notifier used to deliver password reset tokens: log or file")
+
+	flag.StringVar(&cfg.EnvNotifierFile, "notifier-file", "/tmp/gopher-mart-notifications.jsonl", "Set file for the file notifier")
+
+	flag.StringVar(&cfg.EnvTOTPIssuer, "totp-issuer", "Gophermart", "Set service name shown in authenticator apps")
+
+	flag.StringVar(&cfg.EnvTOTPWithdrawalThreshold, "totp-withdrawal-threshold", "1000", "Set withdrawal sum above which a TOTP code is required, if empty TOTP code is never required")
 
 	flag.Parse()
 
+	cfg.EnvPasswordClasses = strings.Split(*passwordClasses, ",")
+	if *trustedProxies != "" {
+		cfg.EnvTrustedProxies = strings.Split(*trustedProxies, ",")
+	}
+
 	err := env.Parse(&cfg)
 	if err != nil {
 		logrus.Fatal(err)
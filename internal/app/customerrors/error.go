@@ -1,15 +1,96 @@
 package customerrors
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
 
 var ErrUserAlreadyTaken = errors.New("username already taken")
 var ErrSaveNewUser = errors.New("it is not possible to save the user to the database")
 var ErrUnauthorizedUser = errors.New("login or password uncorrected")
 var ErrTokenIsNotValid = errors.New("token is not valid")
+var ErrWrongPassword = errors.New("the current password is wrong")
+var ErrWrongTwoFactorCode = errors.New("the two-factor authentication code is wrong")
+var ErrTwoFactorCodeRequired = errors.New("a two-factor authentication code is required for this operation")
+var ErrTwoFactorEnabled = errors.New("two-factor authentication is already enabled")
+var ErrTwoFactorNotEnrolled = errors.New("two-factor authentication is not enrolled")
 var ErrOrderNumber = errors.New("invalid order number format")
 var ErrUserOrderExists = errors.New("the order number has already been uploaded by this user")
 var ErrAnotherUserOrderExists = errors.New("the order number has already been uploaded by another user")
+var ErrOrderBatchSize = errors.New("the order batch is empty or contains too many order numbers")
+var ErrNotFound = errors.New("record not found")
+var ErrUserNotFound = errors.New("user not found")
+var ErrOrderNotFound = errors.New("order not found")
+var ErrOrderIsFinal = errors.New("the order already has a final status")
+var ErrAdjustment = errors.New("the adjustment amount must be non-zero and the reason must be set")
 var ErrAccessingDB = errors.New("error accessing the database")
 var ErrUserHasNoOrders = errors.New("this user does not have any orders")
 var ErrUserHasNoWithdrawals = errors.New("this user does not have any withdrawals")
+var ErrUserHasNoLedgerEntries = errors.New("this user does not have any ledger entries")
 var ErrNotEnoughFunds = errors.New("there are not enough funds in the bonus account to be debited")
+var ErrWithdrawalSum = errors.New("the withdrawal sum must be positive")
+var ErrWithdrawalExists = errors.New("a withdrawal for this order number has already been made by this user")
+var ErrIdempotencyKeyReused = errors.New("the idempotency key has already been used for another withdrawal request")
+var ErrIdempotencyKey = errors.New("invalid idempotency key")
+var ErrAccrualTooManyRequests = errors.New("too many requests to the accrual system")
+var ErrAccrualOrderNotRegistered = errors.New("the order is not registered in the accrual system")
+var ErrAccrualInternal = errors.New("internal error of the accrual system")
+var ErrAccrualOrderMismatch = errors.New("the accrual system returned data for another order")
+
+// AccrualRateLimitError ошибка ответа 429 от accrual системы с параметрами ограничения из ответа
+type AccrualRateLimitError struct {
+	RetryAfter        time.Duration
+	RequestsPerMinute int
+}
+
+func (e *AccrualRateLimitError) Error() string {
+	return fmt.Sprintf("%s: retry after %s, no more than %d requests per minute", ErrAccrualTooManyRequests, e.RetryAfter, e.RequestsPerMinute)
+}
+
+func (e *AccrualRateLimitError) Unwrap() error {
+	return ErrAccrualTooManyRequests
+}
+
+var ErrValidation = errors.New("the data does not satisfy the validation rules")
+
+// Violation нарушенное правило проверки значения поля
+type Violation struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// ValidationError ошибка проверки данных, содержащая все нарушенные правила
+type ValidationError struct {
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Violations))
+	for _, violation := range e.Violations {
+		messages = append(messages, violation.Message)
+	}
+	return fmt.Sprintf("%s: %s", ErrValidation, strings.Join(messages, "; "))
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrValidation
+}
+
+var ErrTooManyLoginAttempts = errors.New("too many failed login attempts")
+
+// LoginThrottledError ошибка отклоненной попытки входа: после предыдущих неудачных попыток новая попытка
+// разрешена только через RetryAfter
+type LoginThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginThrottledError) Error() string {
+	return fmt.Sprintf("%s: retry after %s", ErrTooManyLoginAttempts, e.RetryAfter)
+}
+
+func (e *LoginThrottledError) Unwrap() error {
+	return ErrTooManyLoginAttempts
+}
@@ -0,0 +1,84 @@
+package events
+
+import (
+	"context"
+	"github.com/DenisKhanov/Gophermart/internal/app/models"
+	"github.com/google/uuid"
+	"sync"
+)
+
+// subscriberBuffer количество событий, которые подписчик может не успеть прочитать до отключения
+const subscriberBuffer = 16
+
+// Broker доставляет события пользователей подписчикам внутри одного экземпляра сервиса
+type Broker struct {
+	mu          sync.Mutex
+	subscribers map[uuid.UUID]map[chan models.UserEvent]struct{}
+	closed      bool
+}
+
+func NewBroker() *Broker {
+	return &Broker{subscribers: make(map[uuid.UUID]map[chan models.UserEvent]struct{})}
+}
+
+// Subscribe подписывает на события пользователя userID и возвращает канал событий и функцию отмены подписки.
+// Канал закрывается отменой подписки, закрытием брокера или если подписчик не успевает читать события:
+// в последнем случае клиенту следует переподключиться и заново запросить актуальное состояние
+func (b *Broker) Subscribe(userID uuid.UUID) (<-chan models.UserEvent, func()) {
+	ch := make(chan models.UserEvent, subscriberBuffer)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if b.subscribers[userID] == nil {
+		b.subscribers[userID] = make(map[chan models.UserEvent]struct{})
+	}
+	b.subscribers[userID][ch] = struct{}{}
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.unsubscribe(userID, ch)
+	}
+}
+
+// Publish доставляет событие всем подписчикам пользователя в этом экземпляре сервиса
+func (b *Broker) Publish(_ context.Context, event models.UserEvent) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers[event.UserID] {
+		select {
+		case ch <- event:
+		default:
+			// медленный подписчик отключается, чтобы не задерживать доставку остальным
+			b.unsubscribe(event.UserID, ch)
+		}
+	}
+	return nil
+}
+
+// Close закрывает все подписки и отклоняет новые, чтобы открытые потоки событий завершились при остановке сервера
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for userID, subscribers := range b.subscribers {
+		for ch := range subscribers {
+			b.unsubscribe(userID, ch)
+		}
+	}
+}
+
+// unsubscribe удаляет подписку и закрывает ее канал, если она еще не удалена. Вызывается под блокировкой
+func (b *Broker) unsubscribe(userID uuid.UUID, ch chan models.UserEvent) {
+	subscribers := b.subscribers[userID]
+	if _, ok := subscribers[ch]; !ok {
+		return
+	}
+	delete(subscribers, ch)
+	close(ch)
+	if len(subscribers) == 0 {
+		delete(b.subscribers, userID)
+	}
+}
@@ -0,0 +1,85 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/DenisKhanov/Gophermart/internal/app/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+const (
+	channel        = "gophermart_user_events" // канал LISTEN/NOTIFY, общий для всех экземпляров сервиса
+	reconnectDelay = 5 * time.Second          // пауза перед повторным подключением слушателя после ошибки
+)
+
+// PGBus доставляет события пользователей подписчикам всех экземпляров сервиса, работающих с одной базой данных.
+// События публикуются через NOTIFY и приходят слушателю каждого экземпляра, включая отправивший их,
+// который передает их своему Broker. События, отправленные пока слушатель переподключается, теряются
+type PGBus struct {
+	pool   *pgxpool.Pool
+	broker *Broker
+}
+
+func NewPGBus(pool *pgxpool.Pool, broker *Broker) *PGBus {
+	return &PGBus{pool: pool, broker: broker}
+}
+
+// Publish отправляет событие всем экземплярам сервиса
+func (b *PGBus) Publish(ctx context.Context, event models.UserEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = b.pool.Exec(ctx, `SELECT pg_notify($1, $2)`, channel, string(payload))
+	return err
+}
+
+// Subscribe подписывает на события пользователя userID, см. Broker.Subscribe
+func (b *PGBus) Subscribe(userID uuid.UUID) (<-chan models.UserEvent, func()) {
+	return b.broker.Subscribe(userID)
+}
+
+// Run слушает канал событий и передает полученные события подписчикам этого экземпляра до отмены ctx,
+// при потере соединения переподключается
+func (b *PGBus) Run(ctx context.Context) {
+	for {
+		err := b.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		logrus.Error("event listener error: ", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+func (b *PGBus) listen(ctx context.Context) error {
+	poolConn, err := b.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// соединение с LISTEN не возвращается в пул, чтобы подписка не досталась другим запросам
+	conn := poolConn.Hijack()
+	defer conn.Close(context.Background())
+	if _, err = conn.Exec(ctx, "LISTEN "+channel); err != nil {
+		return err
+	}
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		var event models.UserEvent
+		if err = json.Unmarshal([]byte(notification.Payload), &event); err != nil {
+			logrus.Error("invalid event notification: ", err)
+			continue
+		}
+		_ = b.broker.Publish(ctx, event)
+	}
+}
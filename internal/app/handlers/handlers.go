@@ -1,39 +1,89 @@
 package handlers
 
 import (
+	"bytes"
 	"compress/gzip"
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/DenisKhanov/Gophermart/internal/app/auth"
 	"github.com/DenisKhanov/Gophermart/internal/app/customerrors"
 	"github.com/DenisKhanov/Gophermart/internal/app/models"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
-	"github.com/jackc/pgx/v5/pgxpool"
-	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/shopspring/decimal"
 	"github.com/sirupsen/logrus"
 	"io"
+	"math"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 )
 
 //go:generate mockgen -source=handlers.go -destination=mocks/handlers_mock.go -package=mocks
 type Service interface {
-	CreateUser(ctx context.Context, login, password string) (token string, err error)
-	LogIn(ctx context.Context, login, password string) (token string, err error)
+	CreateUser(ctx context.Context, login, password string) (tokens models.AuthTokens, err error)
+	LogIn(ctx context.Context, login, password, ip string) (tokens models.AuthTokens, challenge *models.TwoFactorChallenge, err error)
+	LogInTwoFactor(ctx context.Context, challengeToken, code, ip string) (models.AuthTokens, error)
+	EnrollTOTP(ctx context.Context, userID uuid.UUID) (models.TOTPEnrollment, error)
+	VerifyTOTP(ctx context.Context, userID uuid.UUID, code string) ([]string, error)
+	DisableTOTP(ctx context.Context, userID uuid.UUID, code string) error
+	UnlockLogin(ctx context.Context, login string) error
+	GetUserInfo(ctx context.Context, login string) (models.AdminUserInfo, error)
+	FindOrders(ctx context.Context, login string, filter models.OrderFilter) ([]models.AdminOrder, error)
+	RecheckOrder(ctx context.Context, orderNumber string) error
+	GetUserWithdrawalsByLogin(ctx context.Context, login string) ([]models.UserWithdrawal, error)
+	AdjustUserBalance(ctx context.Context, actorID uuid.UUID, login string, amount decimal.Decimal, reason string) (models.LedgerEntry, error)
+	RefreshTokens(ctx context.Context, refreshToken string) (models.AuthTokens, error)
+	LogOut(ctx context.Context, sessionID uuid.UUID) error
+	ChangePassword(ctx context.Context, userID, sessionID uuid.UUID, currentPassword, newPassword string) error
+	RequestPasswordReset(ctx context.Context, login string) error
+	ConfirmPasswordReset(ctx context.Context, token, newPassword string) error
+	ValidateToken(ctx context.Context, tokenString string) (*auth.Claims, error)
 	InputUserOrder(ctx context.Context, userID uuid.UUID, orderNumber string) error
-	GetUserOrdersInfo(ctx context.Context, userID uuid.UUID) ([]models.UserOrder, error)
+	InputUserOrders(ctx context.Context, userID uuid.UUID, orderNumbers []string) ([]models.OrderUploadResult, error)
+	SubscribeEvents(userID uuid.UUID) (<-chan models.UserEvent, func())
+	GetUserOrderInfo(ctx context.Context, userID uuid.UUID, orderNumber string) (models.UserOrderDetails, error)
+	GetUserOrdersInfo(ctx context.Context, userID uuid.UUID, filter models.OrderFilter) (userOrders []models.UserOrder, hasMore bool, err error)
 	GetUserBalance(ctx context.Context, userID uuid.UUID) (userBalance models.BalanceResponseData, err error)
-	WithdrawalBonusForNewOrder(ctx context.Context, userID uuid.UUID, orderNumber string, sum decimal.Decimal) error
-	GetUserWithdrawalsInfo(ctx context.Context, userID uuid.UUID) ([]models.UserWithdrawal, error)
+	WithdrawalBonusForNewOrder(ctx context.Context, userID uuid.UUID, idempotencyKey, orderNumber string, sum decimal.Decimal, totpCode string) (replayed bool, err error)
+	GetUserWithdrawalsInfo(ctx context.Context, userID uuid.UUID, filter models.WithdrawalFilter) (userWithdrawals []models.UserWithdrawal, hasMore bool, err error)
+	GetUserLedgerInfo(ctx context.Context, userID uuid.UUID) ([]models.LedgerEntry, error)
 	RunUpdateOrdersStatusJob(ctx context.Context) error
 }
 
+// maxIdempotencyKeyLen максимальная длина заголовка Idempotency-Key
+const maxIdempotencyKeyLen = 255
+
+// maxOrdersBatchBody максимальный размер тела запроса пакетной загрузки заказов
+const maxOrdersBatchBody = 1 << 20
+
+// eventsKeepAlive интервал отправки комментария в поток событий, чтобы прокси не закрывали простаивающее соединение
+const eventsKeepAlive = 15 * time.Second
+
+const (
+	defaultAdminOrdersLimit = 100  // количество заказов в ответе поиска заказов администратором
+	maxPageLimit            = 1000 // максимальное количество записей на одной странице списка
+)
+
+// orderStatuses статусы заказов, по которым можно искать заказы
+var orderStatuses = []string{"NEW", "REGISTERED", "PROCESSING", "INVALID", "PROCESSED"}
+
+const (
+	accessTokenCookie  = "user_token"
+	refreshTokenCookie = "refresh_token"
+	refreshTokenPath   = "/api/user/token" // токен обновления отправляется браузером только на эндпоинты токенов
+	bearerPrefix       = "Bearer "
+	totpCodeHeader     = "X-TOTP-Code" // код TOTP, подтверждающий списание
+	nextCursorHeader   = "X-Next-Cursor"
+)
+
 type Handlers struct {
 	service Service
-	DB      *pgxpool.Pool
 }
 type responseData struct {
 	status int
@@ -44,10 +94,9 @@ type loggingResponseWriter struct {
 	responseData *responseData
 }
 
-func NewHandlers(service Service, DB *pgxpool.Pool) *Handlers {
+func NewHandlers(service Service) *Handlers {
 	return &Handlers{
 		service: service,
-		DB:      DB,
 	}
 }
 
@@ -60,8 +109,13 @@ func (h Handlers) CreateUser(c *gin.Context) {
 		c.Status(http.StatusBadRequest)
 		return
 	}
-	tokenString, err := h.service.CreateUser(ctx, dataUser.Login, dataUser.Password)
+	tokens, err := h.service.CreateUser(ctx, dataUser.Login, dataUser.Password)
 	if err != nil {
+		var validationErr *customerrors.ValidationError
+		if errors.As(err, &validationErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": customerrors.ErrValidation.Error(), "violations": validationErr.Violations})
+			return
+		}
 		if errors.Is(err, customerrors.ErrUserAlreadyTaken) {
 			logrus.Error(err)
 			c.Status(http.StatusConflict)
@@ -76,8 +130,7 @@ func (h Handlers) CreateUser(c *gin.Context) {
 		c.Status(http.StatusBadRequest)
 		return
 	}
-	c.Status(http.StatusOK)
-	c.SetCookie("user_token", tokenString, 0, "/", "", false, true)
+	writeAuthTokens(c, tokens)
 }
 
 // LogIn аутентификация пользователя
@@ -89,18 +142,483 @@ func (h Handlers) LogIn(c *gin.Context) {
 		c.Status(http.StatusBadRequest)
 		return
 	}
-	tokenString, err := h.service.LogIn(ctx, dataUser.Login, dataUser.Password)
+	tokens, challenge, err := h.service.LogIn(ctx, dataUser.Login, dataUser.Password, c.ClientIP())
 	if err != nil {
-		if errors.Is(err, customerrors.ErrAccessingDB) {
-			logrus.Error(err)
-			c.Status(http.StatusInternalServerError)
+		writeLogInError(c, err)
+		return
+	}
+	if challenge != nil {
+		c.JSON(http.StatusAccepted, challenge)
+		return
+	}
+	writeAuthTokens(c, tokens)
+}
+
+// LogInTwoFactor второй шаг аутентификации пользователя с двухфакторной аутентификацией
+func (h Handlers) LogInTwoFactor(c *gin.Context) {
+	var request models.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&request); err != nil || request.ChallengeToken == "" || request.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Challenge token and code are required"})
+		return
+	}
+	tokens, err := h.service.LogInTwoFactor(c.Request.Context(), request.ChallengeToken, request.Code, c.ClientIP())
+	if err != nil {
+		writeLogInError(c, err)
+		return
+	}
+	writeAuthTokens(c, tokens)
+}
+
+// writeLogInError отправляет ответ на неудачную попытку входа
+func writeLogInError(c *gin.Context, err error) {
+	var throttledErr *customerrors.LoginThrottledError
+	if errors.As(err, &throttledErr) {
+		writeThrottled(c, throttledErr)
+		return
+	}
+	if errors.Is(err, customerrors.ErrAccessingDB) {
+		logrus.Error(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	logrus.Info(err)
+	c.Status(http.StatusUnauthorized)
+}
+
+// writeThrottled отправляет ответ 429 на попытку, отклоненную после предыдущих неудачных попыток
+func writeThrottled(c *gin.Context, throttledErr *customerrors.LoginThrottledError) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(throttledErr.RetryAfter.Seconds()))))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed login attempts, try again later"})
+}
+
+// RefreshTokens обмен токена обновления из cookie refresh_token или тела запроса на новую пару токенов
+func (h Handlers) RefreshTokens(c *gin.Context) {
+	ctx := c.Request.Context()
+	refreshToken, err := c.Cookie(refreshTokenCookie)
+	if err != nil {
+		var request struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err = c.ShouldBindJSON(&request); err != nil || request.RefreshToken == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token is required"})
+			return
+		}
+		refreshToken = request.RefreshToken
+	}
+	tokens, err := h.service.RefreshTokens(ctx, refreshToken)
+	if err != nil {
+		statusCode, message := errorCodeToStatus(err)
+		logrus.Error(err)
+		c.JSON(statusCode, gin.H{"error": message})
+		return
+	}
+	writeAuthTokens(c, tokens)
+}
+
+// LogOut завершение текущей сессии пользователя
+func (h Handlers) LogOut(c *gin.Context) {
+	ctx := c.Request.Context()
+	sessionID, ok := ctx.Value(models.SessionIDKey).(uuid.UUID)
+	if !ok {
+		logrus.Errorf("context value is not sessionID: %v", sessionID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Session ID not found in context"})
+		return
+	}
+	if err := h.service.LogOut(ctx, sessionID); err != nil {
+		statusCode, message := errorCodeToStatus(err)
+		logrus.Error(err)
+		c.JSON(statusCode, gin.H{"error": message})
+		return
+	}
+	c.SetCookie(accessTokenCookie, "", -1, "/", "", false, true)
+	c.SetCookie(refreshTokenCookie, "", -1, refreshTokenPath, "", false, true)
+	c.Status(http.StatusOK)
+}
+
+// ChangePassword смена пароля пользователя, остальные его сессии завершаются
+func (h Handlers) ChangePassword(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID, ok := ctx.Value(models.UserIDKey).(uuid.UUID)
+	if !ok {
+		logrus.Errorf("context value is not userID: %v", userID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
+		return
+	}
+	sessionID, ok := ctx.Value(models.SessionIDKey).(uuid.UUID)
+	if !ok {
+		logrus.Errorf("context value is not sessionID: %v", sessionID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Session ID not found in context"})
+		return
+	}
+	var request models.PasswordChangeRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		logrus.Error(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.service.ChangePassword(ctx, userID, sessionID, request.CurrentPassword, request.NewPassword); err != nil {
+		var validationErr *customerrors.ValidationError
+		if errors.As(err, &validationErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": customerrors.ErrValidation.Error(), "violations": validationErr.Violations})
+			return
+		}
+		statusCode, message := errorCodeToStatus(err)
+		logrus.Error(err)
+		c.JSON(statusCode, gin.H{"error": message})
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// RequestPasswordReset запрос токена сброса пароля, ответ не зависит от того, существует ли логин
+func (h Handlers) RequestPasswordReset(c *gin.Context) {
+	var request struct {
+		Login string `json:"login"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil || request.Login == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Login is required"})
+		return
+	}
+	if err := h.service.RequestPasswordReset(c.Request.Context(), request.Login); err != nil {
+		statusCode, message := errorCodeToStatus(err)
+		logrus.Error(err)
+		c.JSON(statusCode, gin.H{"error": message})
+		return
+	}
+	c.Status(http.StatusAccepted)
+}
+
+// ConfirmPasswordReset установка нового пароля по токену сброса
+func (h Handlers) ConfirmPasswordReset(c *gin.Context) {
+	var request models.PasswordResetConfirmRequest
+	if err := c.ShouldBindJSON(&request); err != nil || request.Token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Reset token is required"})
+		return
+	}
+	if err := h.service.ConfirmPasswordReset(c.Request.Context(), request.Token, request.NewPassword); err != nil {
+		var validationErr *customerrors.ValidationError
+		if errors.As(err, &validationErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": customerrors.ErrValidation.Error(), "violations": validationErr.Violations})
+			return
 		}
-		logrus.Info(err)
-		c.Status(http.StatusUnauthorized)
+		statusCode, message := errorCodeToStatus(err)
+		logrus.Error(err)
+		c.JSON(statusCode, gin.H{"error": message})
 		return
 	}
 	c.Status(http.StatusOK)
-	c.SetCookie("user_token", tokenString, 0, "/", "", false, true)
+}
+
+// EnrollTOTP начало подключения двухфакторной аутентификации: выдача нового секрета TOTP
+func (h Handlers) EnrollTOTP(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID, ok := ctx.Value(models.UserIDKey).(uuid.UUID)
+	if !ok {
+		logrus.Errorf("context value is not userID: %v", userID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
+		return
+	}
+	enrollment, err := h.service.EnrollTOTP(ctx, userID)
+	if err != nil {
+		statusCode, message := errorCodeToStatus(err)
+		logrus.Error(err)
+		c.JSON(statusCode, gin.H{"error": message})
+		return
+	}
+	c.JSON(http.StatusOK, enrollment)
+}
+
+// VerifyTOTP подтверждение секрета TOTP первым кодом и включение двухфакторной аутентификации
+func (h Handlers) VerifyTOTP(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID, ok := ctx.Value(models.UserIDKey).(uuid.UUID)
+	if !ok {
+		logrus.Errorf("context value is not userID: %v", userID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
+		return
+	}
+	var request models.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&request); err != nil || request.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Code is required"})
+		return
+	}
+	recoveryCodes, err := h.service.VerifyTOTP(ctx, userID, request.Code)
+	if err != nil {
+		writeTwoFactorError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": recoveryCodes})
+}
+
+// DisableTOTP отключение двухфакторной аутентификации
+func (h Handlers) DisableTOTP(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID, ok := ctx.Value(models.UserIDKey).(uuid.UUID)
+	if !ok {
+		logrus.Errorf("context value is not userID: %v", userID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
+		return
+	}
+	var request models.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&request); err != nil || request.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Code is required"})
+		return
+	}
+	if err := h.service.DisableTOTP(ctx, userID, request.Code); err != nil {
+		writeTwoFactorError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// writeTwoFactorError отправляет ответ на ошибку проверки кода второго фактора
+func writeTwoFactorError(c *gin.Context, err error) {
+	var throttledErr *customerrors.LoginThrottledError
+	if errors.As(err, &throttledErr) {
+		writeThrottled(c, throttledErr)
+		return
+	}
+	statusCode, message := errorCodeToStatus(err)
+	logrus.Error(err)
+	c.JSON(statusCode, gin.H{"error": message})
+}
+
+// writeAuthTokens отправляет выданные токены клиенту: в cookie для браузеров, а также в заголовке
+// Authorization и теле ответа для клиентов, не использующих cookie
+func writeAuthTokens(c *gin.Context, tokens models.AuthTokens) {
+	c.SetCookie(accessTokenCookie, tokens.AccessToken, 0, "/", "", false, true)
+	c.SetCookie(refreshTokenCookie, tokens.RefreshToken, 0, refreshTokenPath, "", false, true)
+	c.Header("Authorization", bearerPrefix+tokens.AccessToken)
+	c.JSON(http.StatusOK, tokens)
+}
+
+// UnlockLogin снятие администратором блокировки входа по логину
+func (h Handlers) UnlockLogin(c *gin.Context) {
+	login := c.Param("login")
+	if err := h.service.UnlockLogin(c.Request.Context(), login); err != nil {
+		statusCode, message := errorCodeToStatus(err)
+		logrus.Error(err)
+		c.JSON(statusCode, gin.H{"error": message})
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// GetUserInfo просмотр сотрудником поддержки сведений о пользователе и его балансе
+func (h Handlers) GetUserInfo(c *gin.Context) {
+	info, err := h.service.GetUserInfo(c.Request.Context(), c.Param("login"))
+	if err != nil {
+		statusCode, message := errorCodeToStatus(err)
+		logrus.Error(err)
+		c.JSON(statusCode, gin.H{"error": message})
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// GetUserWithdrawalsByLogin просмотр сотрудником поддержки списаний пользователя
+func (h Handlers) GetUserWithdrawalsByLogin(c *gin.Context) {
+	withdrawals, err := h.service.GetUserWithdrawalsByLogin(c.Request.Context(), c.Param("login"))
+	if err != nil {
+		statusCode, message := errorCodeToStatus(err)
+		logrus.Error(err)
+		c.JSON(statusCode, gin.H{"error": message})
+		return
+	}
+	if withdrawals == nil {
+		withdrawals = []models.UserWithdrawal{}
+	}
+	c.JSON(http.StatusOK, withdrawals)
+}
+
+// FindOrders поиск заказов всех пользователей по логину, статусам и времени загрузки
+func (h Handlers) FindOrders(c *gin.Context) {
+	filter, err := parseOrderFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	orders, err := h.service.FindOrders(c.Request.Context(), c.Query("login"), filter)
+	if err != nil {
+		statusCode, message := errorCodeToStatus(err)
+		logrus.Error(err)
+		c.JSON(statusCode, gin.H{"error": message})
+		return
+	}
+	if orders == nil {
+		orders = []models.AdminOrder{}
+	}
+	c.JSON(http.StatusOK, orders)
+}
+
+// parseOrderFilter разбирает параметры запроса поиска заказов администратором: status, from, to и limit,
+// заказы возвращаются начиная с последних загруженных
+func parseOrderFilter(c *gin.Context) (filter models.OrderFilter, err error) {
+	if filter.Statuses, err = parseOrderStatuses(c); err != nil {
+		return filter, err
+	}
+	if filter.From, filter.To, err = parseTimeRange(c); err != nil {
+		return filter, err
+	}
+	filter.Descending = true
+	filter.Limit, err = parseLimit(c, defaultAdminOrdersLimit)
+	return filter, err
+}
+
+// parseUserOrderFilter разбирает параметры запроса списка заказов пользователя: status, from, to и параметры страницы
+func parseUserOrderFilter(c *gin.Context) (filter models.OrderFilter, err error) {
+	if filter.Statuses, err = parseOrderStatuses(c); err != nil {
+		return filter, err
+	}
+	if filter.From, filter.To, err = parseTimeRange(c); err != nil {
+		return filter, err
+	}
+	filter.Page, err = parsePage(c)
+	return filter, err
+}
+
+// parseWithdrawalFilter разбирает параметры запроса списка списаний пользователя: from, to и параметры страницы
+func parseWithdrawalFilter(c *gin.Context) (filter models.WithdrawalFilter, err error) {
+	if filter.From, filter.To, err = parseTimeRange(c); err != nil {
+		return filter, err
+	}
+	filter.Page, err = parsePage(c)
+	return filter, err
+}
+
+// parseOrderStatuses разбирает параметр status - список статусов заказов через запятую
+func parseOrderStatuses(c *gin.Context) ([]string, error) {
+	param := c.Query("status")
+	if param == "" {
+		return nil, nil
+	}
+	var statuses []string
+	for _, status := range strings.Split(param, ",") {
+		status = strings.ToUpper(strings.TrimSpace(status))
+		if !slices.Contains(orderStatuses, status) {
+			return nil, fmt.Errorf("unknown order status %q", status)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// parseTimeRange разбирает параметры from и to - границы интервала времени в формате RFC 3339
+func parseTimeRange(c *gin.Context) (from, to time.Time, err error) {
+	if param := c.Query("from"); param != "" {
+		if from, err = time.Parse(time.RFC3339, param); err != nil {
+			return from, to, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+	if param := c.Query("to"); param != "" {
+		if to, err = time.Parse(time.RFC3339, param); err != nil {
+			return from, to, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+	return from, to, nil
+}
+
+// parseLimit разбирает параметр limit - максимальное количество записей в ответе
+func parseLimit(c *gin.Context, defaultLimit int) (int, error) {
+	param := c.Query("limit")
+	if param == "" {
+		return defaultLimit, nil
+	}
+	limit, err := strconv.Atoi(param)
+	if err != nil || limit < 1 || limit > maxPageLimit {
+		return 0, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+	}
+	return limit, nil
+}
+
+// parsePage разбирает параметры постраничной выборки: limit, after - курсор, полученный с предыдущей страницей,
+// и sort - направление сортировки по времени asc или desc. Без limit возвращаются все записи
+func parsePage(c *gin.Context) (page models.Page, err error) {
+	if page.Limit, err = parseLimit(c, 0); err != nil {
+		return page, err
+	}
+	if cursor := c.Query("after"); cursor != "" {
+		if page.AfterID, err = decodeCursor(cursor); err != nil {
+			return page, err
+		}
+	}
+	switch c.Query("sort") {
+	case "", "asc":
+	case "desc":
+		page.Descending = true
+	default:
+		return page, fmt.Errorf("sort must be asc or desc")
+	}
+	return page, nil
+}
+
+// encodeCursor возвращает непрозрачный для клиента курсор, указывающий на запись с идентификатором id
+func encodeCursor(id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(id, 10)))
+}
+
+func decodeCursor(cursor string) (int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cursor")
+	}
+	id, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil || id < 1 {
+		return 0, fmt.Errorf("invalid cursor")
+	}
+	return id, nil
+}
+
+// writeNextPage добавляет в ответ курсор следующей страницы, начинающейся после записи lastID, в заголовке
+// X-Next-Cursor и ссылку на нее с теми же параметрами запроса в заголовке Link
+func writeNextPage(c *gin.Context, lastID int64) {
+	cursor := encodeCursor(lastID)
+	next := *c.Request.URL
+	query := next.Query()
+	query.Set("after", cursor)
+	next.RawQuery = query.Encode()
+	c.Header(nextCursorHeader, cursor)
+	c.Header("Link", fmt.Sprintf(`<%s>; rel="next"`, next.RequestURI()))
+}
+
+// RecheckOrder принудительная повторная проверка заказа в accrual
+func (h Handlers) RecheckOrder(c *gin.Context) {
+	if err := h.service.RecheckOrder(c.Request.Context(), c.Param("number")); err != nil {
+		statusCode, message := errorCodeToStatus(err)
+		logrus.Error(err)
+		c.JSON(statusCode, gin.H{"error": message})
+		return
+	}
+	c.Status(http.StatusAccepted)
+}
+
+// AdjustUserBalance ручная корректировка баланса пользователя администратором с указанием причины
+func (h Handlers) AdjustUserBalance(c *gin.Context) {
+	ctx := c.Request.Context()
+	actorID, ok := ctx.Value(models.UserIDKey).(uuid.UUID)
+	if !ok {
+		logrus.Errorf("context value is not userID: %v", actorID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
+		return
+	}
+	var request models.BalanceAdjustmentRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		logrus.Error(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.Amount == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": customerrors.ErrAdjustment.Error()})
+		return
+	}
+	entry, err := h.service.AdjustUserBalance(ctx, actorID, c.Param("login"), *request.Amount, request.Reason)
+	if err != nil {
+		statusCode, message := errorCodeToStatus(err)
+		logrus.Error(err)
+		c.JSON(statusCode, gin.H{"error": message})
+		return
+	}
+	c.JSON(http.StatusCreated, entry)
 }
 
 // InputUserOrder загрузка пользователем нового заказа
@@ -127,6 +645,76 @@ func (h Handlers) InputUserOrder(c *gin.Context) {
 	c.Status(http.StatusAccepted)
 }
 
+// InputUserOrders пакетная загрузка пользователем номеров заказов: JSON-массив номеров или список номеров
+// по одному в строке. Для каждого номера возвращается результат его загрузки
+func (h Handlers) InputUserOrders(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID, ok := ctx.Value(models.UserIDKey).(uuid.UUID)
+	if !ok {
+		logrus.Errorf("context value is not userID: %v", userID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxOrdersBatchBody))
+	if err != nil {
+		logrus.Error(err)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body is too large"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Error reading request body"})
+		return
+	}
+	orderNumbers, err := parseOrderNumbers(body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	results, err := h.service.InputUserOrders(ctx, userID, orderNumbers)
+	if err != nil {
+		statusCode, message := errorCodeToStatus(err)
+		logrus.Error(err)
+		c.JSON(statusCode, gin.H{"error": message})
+		return
+	}
+	c.JSON(http.StatusOK, results)
+}
+
+// parseOrderNumbers разбирает номера заказов из JSON-массива строк или чисел либо из списка по одному номеру в строке,
+// пустые строки списка пропускаются
+func parseOrderNumbers(body []byte) ([]string, error) {
+	body = bytes.TrimSpace(body)
+	if !bytes.HasPrefix(body, []byte("[")) {
+		var orderNumbers []string
+		for _, line := range strings.Split(string(body), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				orderNumbers = append(orderNumbers, line)
+			}
+		}
+		return orderNumbers, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	// номера-числа читаются как есть, без потери точности и ведущих нулей
+	decoder.UseNumber()
+	var items []any
+	if err := decoder.Decode(&items); err != nil {
+		return nil, fmt.Errorf("invalid JSON array of order numbers: %w", err)
+	}
+	orderNumbers := make([]string, 0, len(items))
+	for _, item := range items {
+		switch number := item.(type) {
+		case string:
+			orderNumbers = append(orderNumbers, number)
+		case json.Number:
+			orderNumbers = append(orderNumbers, number.String())
+		default:
+			return nil, fmt.Errorf("order numbers must be strings or numbers")
+		}
+	}
+	return orderNumbers, nil
+}
+
 // errorCodeToStatus вспомогательный метод проверки ошибок и установки статусов
 func errorCodeToStatus(err error) (int, string) {
 	switch {
@@ -134,6 +722,28 @@ func errorCodeToStatus(err error) (int, string) {
 		return http.StatusUnprocessableEntity, "Invalid order number"
 	case errors.Is(err, customerrors.ErrTokenIsNotValid):
 		return http.StatusUnauthorized, "Token is not valid"
+	case errors.Is(err, customerrors.ErrWrongPassword):
+		return http.StatusForbidden, "Current password is wrong"
+	case errors.Is(err, customerrors.ErrWrongTwoFactorCode):
+		return http.StatusForbidden, "Two-factor authentication code is wrong"
+	case errors.Is(err, customerrors.ErrTwoFactorCodeRequired):
+		return http.StatusForbidden, "Two-factor authentication code is required"
+	case errors.Is(err, customerrors.ErrTwoFactorEnabled):
+		return http.StatusConflict, "Two-factor authentication is already enabled"
+	case errors.Is(err, customerrors.ErrTwoFactorNotEnrolled):
+		return http.StatusConflict, "Two-factor authentication is not enrolled"
+	case errors.Is(err, customerrors.ErrOrderBatchSize):
+		return http.StatusBadRequest, "Order batch must contain from 1 to 1000 order numbers"
+	case errors.Is(err, customerrors.ErrUserNotFound):
+		return http.StatusNotFound, "User not found"
+	case errors.Is(err, customerrors.ErrOrderNotFound):
+		return http.StatusNotFound, "Order not found"
+	case errors.Is(err, customerrors.ErrOrderIsFinal):
+		return http.StatusConflict, "Order already has a final status"
+	case errors.Is(err, customerrors.ErrAdjustment):
+		return http.StatusBadRequest, "Adjustment amount must be non-zero and reason must be set"
+	case errors.Is(err, customerrors.ErrNotEnoughFunds):
+		return http.StatusPaymentRequired, "Not enough funds"
 	case errors.Is(err, customerrors.ErrUserOrderExists):
 		return http.StatusOK, "User order already exists"
 	case errors.Is(err, customerrors.ErrAnotherUserOrderExists):
@@ -145,7 +755,8 @@ func errorCodeToStatus(err error) (int, string) {
 	}
 }
 
-// GetUserOrdersInfo получение списка загруженных пользователем номеров заказов от старых к новым
+// GetUserOrdersInfo получение списка загруженных пользователем номеров заказов, по умолчанию от старых к новым.
+// Поддерживает фильтры status, from и to и постраничную выборку, см. parsePage
 func (h Handlers) GetUserOrdersInfo(c *gin.Context) {
 	ctx := c.Request.Context()
 	userID, ok := ctx.Value(models.UserIDKey).(uuid.UUID)
@@ -154,7 +765,12 @@ func (h Handlers) GetUserOrdersInfo(c *gin.Context) {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
 		return
 	}
-	userOrders, err := h.service.GetUserOrdersInfo(ctx, userID)
+	filter, err := parseUserOrderFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userOrders, hasMore, err := h.service.GetUserOrdersInfo(ctx, userID, filter)
 	if err != nil {
 		if errors.Is(err, customerrors.ErrUserHasNoOrders) {
 			logrus.Error(err)
@@ -165,9 +781,77 @@ func (h Handlers) GetUserOrdersInfo(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if hasMore {
+		writeNextPage(c, userOrders[len(userOrders)-1].ID)
+	}
 	c.JSON(http.StatusOK, userOrders)
 }
 
+// GetUserOrderInfo получение заказа пользователя с историей изменения его статуса
+func (h Handlers) GetUserOrderInfo(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID, ok := ctx.Value(models.UserIDKey).(uuid.UUID)
+	if !ok {
+		logrus.Errorf("context value is not userID: %v", userID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
+		return
+	}
+	order, err := h.service.GetUserOrderInfo(ctx, userID, c.Param("number"))
+	if err != nil {
+		statusCode, message := errorCodeToStatus(err)
+		logrus.Error(err)
+		c.JSON(statusCode, gin.H{"error": message})
+		return
+	}
+	c.JSON(http.StatusOK, order)
+}
+
+// OrderEvents поток Server-Sent Events об изменении статусов заказов и баланса пользователя. Событие order
+// содержит заказ в формате списка заказов, событие balance - баланс в формате GET /api/user/balance.
+// Поток закрывается, если клиент не успевает читать события, после переподключения клиенту следует
+// заново запросить заказы и баланс
+func (h Handlers) OrderEvents(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID, ok := ctx.Value(models.UserIDKey).(uuid.UUID)
+	if !ok {
+		logrus.Errorf("context value is not userID: %v", userID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
+		return
+	}
+	events, cancel := h.service.SubscribeEvents(userID)
+	defer cancel()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.WriteHeaderNow()
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-keepAlive.C:
+			if _, err := io.WriteString(c.Writer, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			var data any = event.Order
+			if event.Type == models.EventBalance {
+				data = event.Balance
+			}
+			c.SSEvent(event.Type, data)
+		}
+		c.Writer.Flush()
+	}
+}
+
 // GetUserBalance получение бонусного баланса пользователя
 func (h Handlers) GetUserBalance(c *gin.Context) {
 	ctx := c.Request.Context()
@@ -202,22 +886,58 @@ func (h Handlers) WithdrawalBonusForNewOrder(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := h.service.WithdrawalBonusForNewOrder(ctx, userID, withdrawalRequest.Order, *withdrawalRequest.Sum); err != nil {
+	if withdrawalRequest.Sum == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": customerrors.ErrWithdrawalSum.Error()})
+		return
+	}
+	idempotencyKey := c.GetHeader("Idempotency-Key")
+	if len(idempotencyKey) > maxIdempotencyKeyLen {
+		c.JSON(http.StatusBadRequest, gin.H{"error": customerrors.ErrIdempotencyKey.Error()})
+		return
+	}
+	replayed, err := h.service.WithdrawalBonusForNewOrder(ctx, userID, idempotencyKey, withdrawalRequest.Order, *withdrawalRequest.Sum,
+		c.GetHeader(totpCodeHeader))
+	if err != nil {
+		var throttledErr *customerrors.LoginThrottledError
+		if errors.As(err, &throttledErr) {
+			writeThrottled(c, throttledErr)
+			return
+		}
+		if errors.Is(err, customerrors.ErrTwoFactorCodeRequired) || errors.Is(err, customerrors.ErrWrongTwoFactorCode) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
 		if errors.Is(err, customerrors.ErrOrderNumber) {
 			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
 			return
 		}
+		if errors.Is(err, customerrors.ErrWithdrawalSum) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		if errors.Is(err, customerrors.ErrNotEnoughFunds) {
 			c.JSON(http.StatusPaymentRequired, gin.H{"error": err.Error()})
 			return
 		}
+		if errors.Is(err, customerrors.ErrWithdrawalExists) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, customerrors.ErrIdempotencyKeyReused) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if replayed {
+		c.Header("Idempotent-Replayed", "true")
+	}
 	c.Status(http.StatusOK)
 }
 
-// GetUserWithdrawalsInfo возврат информации о всех списаниях пользователя
+// GetUserWithdrawalsInfo возврат информации о списаниях пользователя, по умолчанию от старых к новым.
+// Поддерживает фильтры from и to и постраничную выборку, см. parsePage
 func (h Handlers) GetUserWithdrawalsInfo(c *gin.Context) {
 	ctx := c.Request.Context()
 	userID, ok := ctx.Value(models.UserIDKey).(uuid.UUID)
@@ -226,7 +946,12 @@ func (h Handlers) GetUserWithdrawalsInfo(c *gin.Context) {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
 		return
 	}
-	userWithdrawals, err := h.service.GetUserWithdrawalsInfo(ctx, userID)
+	filter, err := parseWithdrawalFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userWithdrawals, hasMore, err := h.service.GetUserWithdrawalsInfo(ctx, userID, filter)
 	if err != nil {
 		if errors.Is(err, customerrors.ErrUserHasNoWithdrawals) {
 			logrus.Error(err)
@@ -237,9 +962,35 @@ func (h Handlers) GetUserWithdrawalsInfo(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if hasMore {
+		writeNextPage(c, userWithdrawals[len(userWithdrawals)-1].ID)
+	}
 	c.JSON(http.StatusOK, userWithdrawals)
 }
 
+// GetUserLedgerInfo возврат журнала всех начислений, списаний и корректировок баланса пользователя
+func (h Handlers) GetUserLedgerInfo(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID, ok := ctx.Value(models.UserIDKey).(uuid.UUID)
+	if !ok {
+		logrus.Errorf("context value is not userID: %v", userID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
+		return
+	}
+	entries, err := h.service.GetUserLedgerInfo(ctx, userID)
+	if err != nil {
+		if errors.Is(err, customerrors.ErrUserHasNoLedgerEntries) {
+			logrus.Error(err)
+			c.JSON(http.StatusNoContent, gin.H{"error": err.Error()})
+			return
+		}
+		logrus.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, entries)
+}
+
 func (r *loggingResponseWriter) Write(b []byte) (int, error) {
 	size, err := r.ResponseWriter.Write(b)
 	r.responseData.size += size
@@ -320,20 +1071,62 @@ func (h Handlers) MiddlewareCompress() gin.HandlerFunc {
 }
 
 // MiddlewareAuthPrivate provides authentication middleware for private routes.
-// It checks the user token and only allows access if the token is valid.
+// It takes the user token from the 'Authorization: Bearer' header or, if the header is absent, from the user_token cookie
+// and only allows access if the token is valid and its session is not revoked.
 // This middleware ensures that only authenticated users can access certain routes.
 func (h Handlers) MiddlewareAuthPrivate() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		tokenString, err := c.Cookie("user_token")
+		tokenString, err := accessToken(c)
 		if err != nil {
-			c.AbortWithStatus(http.StatusUnauthorized)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
 		}
-		userID, err := auth.GetUserID(tokenString)
+		claims, err := h.service.ValidateToken(c.Request.Context(), tokenString)
 		if err != nil {
-			c.AbortWithStatus(http.StatusUnauthorized)
+			statusCode, message := errorCodeToStatus(err)
+			c.AbortWithStatusJSON(statusCode, gin.H{"error": message})
+			return
+		}
+		role := claims.Role
+		// токены, выпущенные до появления ролей, не содержат роли
+		if role == "" {
+			role = models.RoleUser
 		}
-		ctx := context.WithValue(c.Request.Context(), models.UserIDKey, userID)
+		ctx := context.WithValue(c.Request.Context(), models.UserIDKey, claims.UserID)
+		ctx = context.WithValue(ctx, models.SessionIDKey, claims.SessionID)
+		ctx = context.WithValue(ctx, models.RoleKey, role)
 		c.Request = c.Request.WithContext(ctx)
 		c.Next()
 	}
 }
+
+// MiddlewareRequireRole provides authorization middleware for routes available only to some roles.
+// It must follow MiddlewareAuthPrivate, which puts the role from the access token into the request context,
+// and only allows access if the user's role is one of roles.
+func (h Handlers) MiddlewareRequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role, _ := c.Request.Context().Value(models.RoleKey).(string)
+		for _, allowed := range roles {
+			if role == allowed {
+				c.Next()
+				return
+			}
+		}
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+	}
+}
+
+// accessToken возвращает токен доступа из заголовка Authorization или cookie user_token
+func accessToken(c *gin.Context) (string, error) {
+	if header := c.GetHeader("Authorization"); header != "" {
+		if len(header) <= len(bearerPrefix) || !strings.EqualFold(header[:len(bearerPrefix)], bearerPrefix) {
+			return "", errors.New("authorization header must use the Bearer scheme")
+		}
+		return strings.TrimSpace(header[len(bearerPrefix):]), nil
+	}
+	tokenString, err := c.Cookie(accessTokenCookie)
+	if err != nil || tokenString == "" {
+		return "", errors.New("authorization token is required")
+	}
+	return tokenString, nil
+}
@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/DenisKhanov/Gophermart/internal/app/events"
+	"github.com/DenisKhanov/Gophermart/internal/app/models"
+	"github.com/DenisKhanov/Gophermart/internal/app/repositories"
+	"github.com/DenisKhanov/Gophermart/internal/app/services"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+const ordersPath = "/api/user/orders"
+
+// ordersFixture обработчики поверх сервиса на хранилище в памяти и пользователь с загруженными заказами
+type ordersFixture struct {
+	handlers *Handlers
+	userID   uuid.UUID
+}
+
+func newOrdersFixture(t *testing.T, ordersCount int) ordersFixture {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	repo := repositories.NewInMemoryRepo()
+	userID := uuid.New()
+	if err := repo.StoreNewUser(ctx, userID, "alice", []byte("hash")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= ordersCount; i++ {
+		if err := repo.StoreUserOrder(ctx, fmt.Sprint(i), "NEW", userID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	service := services.NewGmartServices(repo, nil, events.NewBroker(), services.AuthConfig{})
+	return ordersFixture{handlers: NewHandlers(service), userID: userID}
+}
+
+// getOrders выполняет запрос списка заказов пользователя с параметрами query
+func (f ordersFixture) getOrders(t *testing.T, query string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	req := httptest.NewRequest(http.MethodGet, ordersPath+"?"+query, nil)
+	c.Request = req.WithContext(context.WithValue(req.Context(), models.UserIDKey, f.userID))
+	f.handlers.GetUserOrdersInfo(c)
+	return w
+}
+
+// orderNumbers возвращает номера заказов из ответа
+func orderNumbers(t *testing.T, w *httptest.ResponseRecorder) []string {
+	t.Helper()
+	var orders []models.UserOrder
+	if err := json.Unmarshal(w.Body.Bytes(), &orders); err != nil {
+		t.Fatalf("decode response %q: %v", w.Body.String(), err)
+	}
+	numbers := make([]string, 0, len(orders))
+	for _, order := range orders {
+		numbers = append(numbers, order.Number)
+	}
+	return numbers
+}
+
+func TestGetUserOrdersInfoInvalidPage(t *testing.T) {
+	f := newOrdersFixture(t, 3)
+	cursor := func(raw string) string { return base64.RawURLEncoding.EncodeToString([]byte(raw)) }
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{name: "cursor is not base64", query: "after=" + url.QueryEscape("!!!")},
+		{name: "cursor is not a number", query: "after=" + cursor("1 OR 1=1")},
+		{name: "zero cursor", query: "after=" + cursor("0")},
+		{name: "negative cursor", query: "after=" + cursor("-1")},
+		{name: "cursor with padding", query: "after=" + base64.URLEncoding.EncodeToString([]byte("1"))},
+		{name: "limit over maximum", query: fmt.Sprintf("limit=%d", maxPageLimit+1)},
+		{name: "zero limit", query: "limit=0"},
+		{name: "limit is not a number", query: "limit=ten"},
+		{name: "unknown sort", query: "sort=sideways"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := f.getOrders(t, tt.query); w.Code != http.StatusBadRequest {
+				t.Errorf("status %d, want %d", w.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestGetUserOrdersInfoMaxLimit(t *testing.T) {
+	f := newOrdersFixture(t, 3)
+	w := f.getOrders(t, fmt.Sprintf("limit=%d", maxPageLimit))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := orderNumbers(t, w); len(got) != 3 {
+		t.Errorf("got orders %v, want all 3", got)
+	}
+}
+
+func TestGetUserOrdersInfoPageBoundary(t *testing.T) {
+	f := newOrdersFixture(t, 4)
+	tests := []struct {
+		limit    int
+		want     int
+		nextPage bool
+	}{
+		{limit: 3, want: 3, nextPage: true},
+		{limit: 4, want: 4, nextPage: false},
+		{limit: 5, want: 4, nextPage: false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("limit %d", tt.limit), func(t *testing.T) {
+			w := f.getOrders(t, fmt.Sprintf("limit=%d", tt.limit))
+			if got := orderNumbers(t, w); len(got) != tt.want {
+				t.Errorf("got orders %v, want %d", got, tt.want)
+			}
+			cursor, link := w.Header().Get(nextCursorHeader), w.Header().Get("Link")
+			if tt.nextPage != (cursor != "") || tt.nextPage != (link != "") {
+				t.Errorf("%s %q, Link %q, want next page %v", nextCursorHeader, cursor, link, tt.nextPage)
+			}
+		})
+	}
+}
+
+func TestGetUserOrdersInfoPages(t *testing.T) {
+	tests := []struct {
+		sort  string
+		pages [][]string
+	}{
+		{sort: "asc", pages: [][]string{{"1", "2"}, {"3", "4"}, {"5"}}},
+		{sort: "desc", pages: [][]string{{"5", "4"}, {"3", "2"}, {"1"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sort, func(t *testing.T) {
+			f := newOrdersFixture(t, 5)
+			query := "limit=2&sort=" + tt.sort
+			for i, want := range tt.pages {
+				w := f.getOrders(t, query)
+				if w.Code != http.StatusOK {
+					t.Fatalf("page %d: status %d, want %d", i, w.Code, http.StatusOK)
+				}
+				if got := orderNumbers(t, w); fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Fatalf("page %d: got orders %v, want %v", i, got, want)
+				}
+				cursor := w.Header().Get(nextCursorHeader)
+				if i == len(tt.pages)-1 {
+					if cursor != "" || w.Header().Get("Link") != "" {
+						t.Errorf("last page has next page headers")
+					}
+					return
+				}
+				// ссылка на следующую страницу сохраняет параметры запроса и добавляет курсор
+				next := url.Values{"after": {cursor}, "limit": {"2"}, "sort": {tt.sort}}
+				wantLink := fmt.Sprintf(`<%s?%s>; rel="next"`, ordersPath, next.Encode())
+				if link := w.Header().Get("Link"); link != wantLink {
+					t.Fatalf("page %d: Link %q, want %q", i, link, wantLink)
+				}
+				query = next.Encode()
+			}
+		})
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	for _, id := range []int64{1, 42, 1 << 40} {
+		got, err := decodeCursor(encodeCursor(id))
+		if err != nil || got != id {
+			t.Errorf("decodeCursor(encodeCursor(%d)) = %d, %v", id, got, err)
+		}
+	}
+}
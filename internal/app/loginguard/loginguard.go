@@ -0,0 +1,124 @@
+package loginguard
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	baseDelay = time.Second // пауза после первой неудачной попытки, удваивается с каждой следующей
+	maxDelay  = time.Minute // максимальная пауза между попытками до блокировки
+)
+
+// Config параметры защиты от подбора пароля
+type Config struct {
+	MaxLoginFailures int           // количество неудачных попыток для одного логина до блокировки, 0 - без блокировки
+	MaxIPFailures    int           // количество неудачных попыток с одного IP-адреса до блокировки, 0 - без блокировки
+	Lockout          time.Duration // время блокировки, а также время, через которое забываются неудачные попытки
+}
+
+// attempts неудачные попытки входа по одному логину или с одного IP-адреса
+type attempts struct {
+	failures    int
+	lastFailure time.Time
+	nextAttempt time.Time // до этого момента новые попытки отклоняются
+}
+
+// Guard учитывает неудачные попытки входа отдельно по логину и по IP-адресу. После каждой неудачи следующая
+// попытка входа под тем же логином разрешается только через нарастающую паузу, а после заданного числа неудач
+// логин или IP-адрес блокируется на время Lockout. Состояние хранится в памяти процесса, поэтому при нескольких
+// экземплярах сервиса лимиты действуют для каждого экземпляра отдельно
+type Guard struct {
+	mu        sync.Mutex
+	cfg       Config
+	logins    map[string]*attempts
+	ips       map[string]*attempts
+	lastSweep time.Time
+}
+
+func NewGuard(cfg Config) *Guard {
+	return &Guard{
+		cfg:    cfg,
+		logins: make(map[string]*attempts),
+		ips:    make(map[string]*attempts),
+	}
+}
+
+// Allow проверяет, разрешена ли сейчас попытка входа, и если нет, возвращает время до следующей разрешенной попытки
+func (g *Guard) Allow(login, ip string) (retryAfter time.Duration, ok bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	for _, a := range []*attempts{g.logins[loginKey(login)], g.ips[ip]} {
+		if a != nil && a.nextAttempt.After(now) && a.nextAttempt.Sub(now) > retryAfter {
+			retryAfter = a.nextAttempt.Sub(now)
+		}
+	}
+	return retryAfter, retryAfter == 0
+}
+
+// Fail учитывает неудачную попытку входа
+func (g *Guard) Fail(login, ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	g.sweep(now)
+	g.fail(g.logins, loginKey(login), g.cfg.MaxLoginFailures, true, now)
+	// за одним IP-адресом может находиться много пользователей, поэтому для него паузы между попытками
+	// не вводятся, а адрес только блокируется при превышении порога. Пустой ip не учитывается
+	if ip != "" {
+		g.fail(g.ips, ip, g.cfg.MaxIPFailures, false, now)
+	}
+}
+
+func (g *Guard) fail(entries map[string]*attempts, key string, maxFailures int, progressive bool, now time.Time) {
+	a, ok := entries[key]
+	if !ok || now.Sub(a.lastFailure) > g.cfg.Lockout {
+		a = &attempts{}
+		entries[key] = a
+	}
+	a.failures++
+	a.lastFailure = now
+	if maxFailures > 0 && a.failures >= maxFailures {
+		a.nextAttempt = now.Add(g.cfg.Lockout)
+		return
+	}
+	if !progressive {
+		return
+	}
+	delay := maxDelay
+	if shift := a.failures - 1; shift < 16 {
+		delay = min(baseDelay<<shift, maxDelay)
+	}
+	a.nextAttempt = now.Add(delay)
+}
+
+// Reset сбрасывает неудачные попытки и блокировку по логину: после успешного входа или при разблокировке
+// администратором. Попытки с IP-адреса не сбрасываются, чтобы успешный вход в свою учетную запись
+// не снимал ограничение с перебора чужих
+func (g *Guard) Reset(login string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.logins, loginKey(login))
+}
+
+// sweep удаляет забытые попытки не чаще одного раза за время блокировки
+func (g *Guard) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < g.cfg.Lockout {
+		return
+	}
+	g.lastSweep = now
+	for _, entries := range []map[string]*attempts{g.logins, g.ips} {
+		for key, a := range entries {
+			if now.Sub(a.lastFailure) > g.cfg.Lockout && !a.nextAttempt.After(now) {
+				delete(entries, key)
+			}
+		}
+	}
+}
+
+// loginKey приводит логин к виду, в котором попытки с разным регистром учитываются вместе
+func loginKey(login string) string {
+	return strings.ToLower(login)
+}
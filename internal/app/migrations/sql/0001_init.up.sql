@@ -0,0 +1,30 @@
+CREATE TABLE IF NOT EXISTS users (
+    uuid UUID PRIMARY KEY,
+    login VARCHAR(255) UNIQUE NOT NULL,
+    hashed_password BYTEA NOT NULL,
+    date TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS orders (
+    id SERIAL PRIMARY KEY,
+    order_number VARCHAR(255) NOT NULL UNIQUE,
+    uuid UUID NOT NULL,
+    accrual DECIMAL(9, 2),
+    status VARCHAR(255) NOT NULL,
+    date TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (uuid) REFERENCES users(uuid)
+);
+CREATE TABLE IF NOT EXISTS withdrawals (
+    id SERIAL PRIMARY KEY,
+    order_number VARCHAR(255) NOT NULL,
+    uuid UUID NOT NULL,
+    sum DECIMAL(9, 2),
+    date TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (uuid) REFERENCES users(uuid)
+);
+CREATE TABLE IF NOT EXISTS balance (
+    id SERIAL PRIMARY KEY,
+    uuid UUID NOT NULL,
+    user_balance DECIMAL(9, 2) DEFAULT 0.00,
+    date TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (uuid) REFERENCES users(uuid)
+);
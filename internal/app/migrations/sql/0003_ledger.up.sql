@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS ledger (
+    id BIGSERIAL PRIMARY KEY,
+    uuid UUID NOT NULL,
+    entry_type VARCHAR(32) NOT NULL,
+    amount DECIMAL(9, 2) NOT NULL,
+    balance_after DECIMAL(9, 2) NOT NULL,
+    contra_account VARCHAR(64) NOT NULL,
+    order_number VARCHAR(255),
+    reason TEXT,
+    date TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (uuid) REFERENCES users(uuid)
+);
+CREATE INDEX IF NOT EXISTS ledger_uuid_id_idx ON ledger (uuid, id);
+-- начальные остатки для балансов, накопленных до появления журнала
+INSERT INTO ledger (uuid, entry_type, amount, balance_after, contra_account, reason)
+SELECT b.uuid, 'ADJUSTMENT', b.user_balance, b.user_balance, 'system:adjustments', 'opening balance'
+FROM balance b
+WHERE b.user_balance <> 0 AND NOT EXISTS (SELECT 1 FROM ledger l WHERE l.uuid = b.uuid);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS withdrawals_uuid_idempotency_key_key;
+DROP INDEX IF EXISTS withdrawals_uuid_order_number_key;
+ALTER TABLE withdrawals DROP COLUMN IF EXISTS idempotency_key;
@@ -0,0 +1,24 @@
+ALTER TABLE withdrawals ADD COLUMN IF NOT EXISTS idempotency_key VARCHAR(255);
+-- до появления уникального индекса одновременные запросы могли провести списание в счет одного заказа несколько раз:
+-- из каждой группы повторов остается самое раннее списание, остальные удаляются, а их сумма возвращается
+-- на баланс пользователя записью REVERSAL в журнале. Откат миграции удаленные списания не восстанавливает
+CREATE TEMPORARY TABLE duplicate_withdrawals ON COMMIT DROP AS
+SELECT w.id, w.uuid, w.order_number, COALESCE(w.sum, 0) AS sum
+FROM withdrawals w
+WHERE EXISTS (SELECT 1 FROM withdrawals kept
+    WHERE kept.uuid = w.uuid AND kept.order_number = w.order_number AND kept.id < w.id);
+WITH refunds AS (
+    SELECT uuid, order_number, SUM(sum) AS amount FROM duplicate_withdrawals GROUP BY uuid, order_number
+)
+INSERT INTO ledger (uuid, entry_type, amount, balance_after, contra_account, order_number, reason)
+SELECT r.uuid, 'REVERSAL', r.amount, b.user_balance + SUM(r.amount) OVER (PARTITION BY r.uuid ORDER BY r.order_number),
+    'system:withdrawals', r.order_number, 'duplicate withdrawal refund'
+FROM refunds r JOIN balance b ON b.uuid = r.uuid
+ORDER BY r.uuid, r.order_number;
+UPDATE balance b SET user_balance = b.user_balance + r.amount
+FROM (SELECT uuid, SUM(sum) AS amount FROM duplicate_withdrawals GROUP BY uuid) r
+WHERE b.uuid = r.uuid;
+DELETE FROM withdrawals w USING duplicate_withdrawals d WHERE w.id = d.id;
+CREATE UNIQUE INDEX IF NOT EXISTS withdrawals_uuid_order_number_key ON withdrawals (uuid, order_number);
+CREATE UNIQUE INDEX IF NOT EXISTS withdrawals_uuid_idempotency_key_key ON withdrawals (uuid, idempotency_key)
+    WHERE idempotency_key IS NOT NULL;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS withdrawals_uuid_idx;
+DROP INDEX IF EXISTS orders_status_idx;
+DROP INDEX IF EXISTS orders_uuid_idx;
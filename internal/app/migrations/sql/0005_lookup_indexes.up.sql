@@ -0,0 +1,3 @@
+CREATE INDEX IF NOT EXISTS orders_uuid_idx ON orders (uuid);
+CREATE INDEX IF NOT EXISTS orders_status_idx ON orders (status);
+CREATE INDEX IF NOT EXISTS withdrawals_uuid_idx ON withdrawals (uuid);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS sessions (
+    id UUID PRIMARY KEY,
+    uuid UUID NOT NULL,
+    refresh_token_hash BYTEA NOT NULL UNIQUE,
+    date TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    revoked_at TIMESTAMP WITH TIME ZONE,
+    FOREIGN KEY (uuid) REFERENCES users(uuid)
+);
+CREATE INDEX IF NOT EXISTS sessions_uuid_idx ON sessions (uuid);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS password_reset_tokens (
+    token_hash BYTEA PRIMARY KEY,
+    uuid UUID NOT NULL,
+    date TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    FOREIGN KEY (uuid) REFERENCES users(uuid)
+);
+CREATE INDEX IF NOT EXISTS password_reset_tokens_uuid_idx ON password_reset_tokens (uuid);
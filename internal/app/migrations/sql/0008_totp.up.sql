@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS user_totp (
+    uuid UUID PRIMARY KEY,
+    secret TEXT NOT NULL,
+    date TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    enabled_at TIMESTAMP WITH TIME ZONE,
+    last_used_step BIGINT NOT NULL DEFAULT 0,
+    FOREIGN KEY (uuid) REFERENCES users(uuid)
+);
+CREATE TABLE IF NOT EXISTS totp_recovery_codes (
+    uuid UUID NOT NULL,
+    code_hash BYTEA NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    PRIMARY KEY (uuid, code_hash),
+    FOREIGN KEY (uuid) REFERENCES users(uuid)
+);
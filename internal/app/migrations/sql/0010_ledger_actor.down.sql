@@ -0,0 +1 @@
+ALTER TABLE ledger DROP COLUMN IF EXISTS actor;
@@ -0,0 +1 @@
+ALTER TABLE ledger ADD COLUMN IF NOT EXISTS actor VARCHAR(255);
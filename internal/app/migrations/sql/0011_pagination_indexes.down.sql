@@ -0,0 +1,4 @@
+CREATE INDEX IF NOT EXISTS orders_uuid_idx ON orders (uuid);
+CREATE INDEX IF NOT EXISTS withdrawals_uuid_idx ON withdrawals (uuid);
+DROP INDEX IF EXISTS orders_uuid_id_idx;
+DROP INDEX IF EXISTS withdrawals_uuid_id_idx;
@@ -0,0 +1,5 @@
+-- постраничная выборка заказов и списаний пользователя упорядочена по id
+CREATE INDEX IF NOT EXISTS orders_uuid_id_idx ON orders (uuid, id);
+CREATE INDEX IF NOT EXISTS withdrawals_uuid_id_idx ON withdrawals (uuid, id);
+DROP INDEX IF EXISTS orders_uuid_idx;
+DROP INDEX IF EXISTS withdrawals_uuid_idx;
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS order_status_history (
+    id BIGSERIAL PRIMARY KEY,
+    order_number VARCHAR(255) NOT NULL,
+    status VARCHAR(255) NOT NULL,
+    accrual DECIMAL(9, 2),
+    date TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (order_number) REFERENCES orders(order_number)
+);
+CREATE INDEX IF NOT EXISTS order_status_history_order_id_idx ON order_status_history (order_number, id);
+-- история для заказов, загруженных до появления таблицы: время промежуточных переходов неизвестно,
+-- поэтому сохраняются загрузка заказа и его текущий статус на момент миграции
+INSERT INTO order_status_history (order_number, status, date)
+SELECT o.order_number, 'NEW', o.date
+FROM orders o
+WHERE NOT EXISTS (SELECT 1 FROM order_status_history h WHERE h.order_number = o.order_number);
+INSERT INTO order_status_history (order_number, status, accrual)
+SELECT o.order_number, o.status, o.accrual
+FROM orders o
+WHERE o.status <> 'NEW'
+  AND NOT EXISTS (SELECT 1 FROM order_status_history h WHERE h.order_number = o.order_number AND h.status = o.status);
@@ -8,26 +8,188 @@ import (
 
 type CTXKey string
 
-const UserIDKey CTXKey = "userID"
+const (
+	UserIDKey    CTXKey = "userID"
+	SessionIDKey CTXKey = "sessionID"
+	RoleKey      CTXKey = "role"
+)
+
+// Роли пользователей: обычный пользователь, сотрудник поддержки и администратор
+const (
+	RoleUser    = "user"
+	RoleSupport = "support"
+	RoleAdmin   = "admin"
+)
+
+// ValidRole проверяет, что role - одна из известных ролей
+func ValidRole(role string) bool {
+	switch role {
+	case RoleUser, RoleSupport, RoleAdmin:
+		return true
+	default:
+		return false
+	}
+}
 
 type UserRegistered struct {
 	Login    string `json:"login"`
 	Password string `json:"password"`
 }
 
+// PasswordChangeRequest запрос смены пароля
+type PasswordChangeRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// PasswordResetConfirmRequest запрос установки нового пароля по токену сброса
+type PasswordResetConfirmRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+// User учетная запись пользователя
+type User struct {
+	ID             uuid.UUID
+	Login          string
+	HashedPassword []byte
+	Role           string
+	CreatedAt      time.Time
+}
+
+// PasswordResetToken одноразовый токен сброса пароля. Хранится только хеш токена
+type PasswordResetToken struct {
+	TokenHash []byte
+	UserID    uuid.UUID
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// UserTOTP настройки двухфакторной аутентификации пользователя. До подтверждения первым кодом EnabledAt пуст
+// и второй фактор не запрашивается
+type UserTOTP struct {
+	UserID       uuid.UUID
+	Secret       string
+	CreatedAt    time.Time
+	EnabledAt    *time.Time
+	LastUsedStep int64 // последний принятый интервал TOTP, коды этого и более ранних интервалов не принимаются повторно
+}
+
+// Enabled проверяет, что двухфакторная аутентификация подтверждена и включена
+func (t UserTOTP) Enabled() bool {
+	return t.EnabledAt != nil
+}
+
+// TOTPEnrollment данные для добавления учетной записи в приложение-аутентификатор
+type TOTPEnrollment struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"otpauth_uri"`
+}
+
+// TwoFactorChallenge ответ на вход по паролю пользователя с включенной двухфакторной аутентификацией:
+// токен, который вместе с кодом второго фактора обменивается на токены сессии
+type TwoFactorChallenge struct {
+	ChallengeToken string `json:"challenge_token"`
+	ExpiresIn      int64  `json:"expires_in"` // время жизни токена в секундах
+}
+
+// TwoFactorCodeRequest запрос с кодом второго фактора: кодом TOTP или одним из резервных кодов
+type TwoFactorCodeRequest struct {
+	ChallengeToken string `json:"challenge_token,omitempty"`
+	Code           string `json:"code"`
+}
+
+// AuthTokens токены, выдаваемые пользователю при входе: короткоживущий токен доступа и токен обновления сессии
+type AuthTokens struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"` // время жизни токена доступа в секундах
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Session сессия пользователя, созданная при входе. Хранит хеш текущего токена обновления
+// и может быть отозвана, после чего ее токены перестают приниматься
+type Session struct {
+	ID               uuid.UUID
+	UserID           uuid.UUID
+	RefreshTokenHash []byte
+	CreatedAt        time.Time
+	ExpiresAt        time.Time
+	RevokedAt        *time.Time
+}
+
+// Active проверяет, что сессия не отозвана и не истекла на момент now
+func (s Session) Active(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
+
 type UserWithdrawal struct {
-	Order       string           `json:"order"`
-	Sum         *decimal.Decimal `json:"sum,omitempty"`
-	ProcessedAt *time.Time       `json:"processed_at,omitempty"`
+	ID             int64            `json:"-"`
+	Order          string           `json:"order"`
+	Sum            *decimal.Decimal `json:"sum,omitempty"`
+	ProcessedAt    *time.Time       `json:"processed_at,omitempty"`
+	IdempotencyKey string           `json:"-"` // ключ идемпотентности запроса, которым было создано списание
 }
 
 type UserOrder struct {
-	UserID     uuid.UUID        `json:"-"`
+	ID            int64            `json:"-"`
+	UserID        uuid.UUID        `json:"-"`
+	Number        string           `json:"number"`
+	Status        string           `json:"status"`
+	Accrual       *decimal.Decimal `json:"accrual,omitempty"`
+	UploadedAt    time.Time        `json:"uploaded_at"`
+	CheckAttempts int              `json:"-"` // количество проверок в accrual без изменения статуса
+	NextCheckAt   time.Time        `json:"-"` // время следующей проверки заказа в accrual
+}
+
+// Результаты загрузки номера заказа в пакете заказов
+const (
+	OrderUploadAccepted           = "accepted"              // заказ принят в обработку
+	OrderUploadDuplicate          = "duplicate"             // номер уже загружен этим пользователем
+	OrderUploadOwnedByAnotherUser = "owned_by_another_user" // номер уже загружен другим пользователем
+	OrderUploadInvalid            = "invalid"               // неверный формат номера
+)
+
+// OrderUploadResult результат загрузки одного номера заказа из пакета
+type OrderUploadResult struct {
+	Number string `json:"number"`
+	Result string `json:"result"`
+}
+
+// UserOrderDetails заказ пользователя вместе с историей изменения его статуса
+type UserOrderDetails struct {
 	Number     string           `json:"number"`
 	Status     string           `json:"status"`
 	Accrual    *decimal.Decimal `json:"accrual,omitempty"`
 	UploadedAt time.Time        `json:"uploaded_at"`
+	// количество проверок в accrual без изменения статуса и время следующей проверки заказа без окончательного статуса
+	CheckAttempts int                 `json:"check_attempts"`
+	NextCheckAt   *time.Time          `json:"next_check_at,omitempty"`
+	History       []OrderStatusChange `json:"history"`
+}
+
+// OrderStatusChange переход заказа в новый статус
+type OrderStatusChange struct {
+	Status    string           `json:"status"`
+	Accrual   *decimal.Decimal `json:"accrual,omitempty"`
+	ChangedAt time.Time        `json:"changed_at"`
 }
+
+// Типы событий, отправляемых пользователю в поток GET /api/user/orders/events
+const (
+	EventOrder   = "order"   // изменился статус заказа
+	EventBalance = "balance" // изменился баланс
+)
+
+// UserEvent событие об изменении заказа или баланса пользователя
+type UserEvent struct {
+	UserID  uuid.UUID            `json:"user_id"`
+	Type    string               `json:"type"`
+	Order   *UserOrder           `json:"order,omitempty"`
+	Balance *BalanceResponseData `json:"balance,omitempty"`
+}
+
 type AccrualResponseData struct {
 	UserID  uuid.UUID        `json:"-"`
 	Order   string           `json:"order"`
@@ -38,3 +200,84 @@ type BalanceResponseData struct {
 	Current   decimal.Decimal `json:"current"`
 	Withdrawn decimal.Decimal `json:"withdrawn"`
 }
+
+// Типы записей журнала движения баллов
+const (
+	LedgerEntryAccrual    = "ACCRUAL"    // начисление баллов за заказ
+	LedgerEntryWithdrawal = "WITHDRAWAL" // списание баллов в счет оплаты заказа
+	LedgerEntryReversal   = "REVERSAL"   // сторнирование ранее проведенной записи
+	LedgerEntryAdjustment = "ADJUSTMENT" // ручная корректировка баланса
+)
+
+// Системные счета, с которыми корреспондирует счет пользователя в записях журнала
+const (
+	AccountAccrual     = "system:accrual"
+	AccountWithdrawals = "system:withdrawals"
+	AccountAdjustments = "system:adjustments"
+)
+
+// LedgerEntry неизменяемая запись журнала движения баллов. Amount записан со стороны счета пользователя
+// (положительный - зачисление, отрицательный - списание), противоположная проводка отражается на ContraAccount
+type LedgerEntry struct {
+	ID            int64           `json:"id"`
+	UserID        uuid.UUID       `json:"-"`
+	Type          string          `json:"type"`
+	Amount        decimal.Decimal `json:"amount"`
+	BalanceAfter  decimal.Decimal `json:"balance_after"`
+	ContraAccount string          `json:"contra_account"`
+	OrderNumber   string          `json:"order,omitempty"`
+	Reason        string          `json:"reason,omitempty"`
+	Actor         string          `json:"actor,omitempty"` // логин сотрудника, проведшего ручную корректировку
+	CreatedAt     time.Time       `json:"created_at"`
+}
+
+// AdminUserInfo сведения о пользователе для сотрудников поддержки
+type AdminUserInfo struct {
+	ID               uuid.UUID           `json:"id"`
+	Login            string              `json:"login"`
+	Role             string              `json:"role"`
+	CreatedAt        time.Time           `json:"created_at"`
+	TwoFactorEnabled bool                `json:"two_factor_enabled"`
+	Balance          BalanceResponseData `json:"balance"`
+}
+
+// AdminOrder заказ любого пользователя вместе со сведениями о его проверке в accrual
+type AdminOrder struct {
+	UserID        uuid.UUID        `json:"user_id"`
+	Login         string           `json:"login"`
+	Number        string           `json:"number"`
+	Status        string           `json:"status"`
+	Accrual       *decimal.Decimal `json:"accrual,omitempty"`
+	UploadedAt    time.Time        `json:"uploaded_at"`
+	CheckAttempts int              `json:"check_attempts"`
+	NextCheckAt   time.Time        `json:"next_check_at"`
+}
+
+// Page параметры постраничной выборки записей, упорядоченных по идентификатору, то есть по времени создания
+type Page struct {
+	AfterID    int64 // выборка начинается после записи с этим идентификатором, 0 - с первой записи
+	Descending bool  // от новых записей к старым
+	Limit      int   // 0 - без ограничения
+}
+
+// OrderFilter условия поиска заказов. Пустые поля не ограничивают выборку
+type OrderFilter struct {
+	UserID   *uuid.UUID
+	Statuses []string
+	From     time.Time // заказы, загруженные не раньше From
+	To       time.Time // заказы, загруженные раньше To
+	Page
+}
+
+// WithdrawalFilter условия выборки списаний пользователя. Пустые поля не ограничивают выборку
+type WithdrawalFilter struct {
+	From time.Time // списания, проведенные не раньше From
+	To   time.Time // списания, проведенные раньше To
+	Page
+}
+
+// BalanceAdjustmentRequest запрос ручной корректировки баланса пользователя
+type BalanceAdjustmentRequest struct {
+	Amount *decimal.Decimal `json:"amount"` // положительная сумма зачисляется, отрицательная списывается
+	Reason string           `json:"reason"`
+}
@@ -0,0 +1,73 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"sync"
+	"time"
+)
+
+// LogNotifier пишет уведомления в лог сервиса. Предназначен для локальной разработки: токены сброса
+// пароля попадают в лог в открытом виде
+type LogNotifier struct{}
+
+func NewLogNotifier() *LogNotifier {
+	return &LogNotifier{}
+}
+
+// NotifyPasswordReset записывает в лог токен сброса пароля пользователя login
+func (n *LogNotifier) NotifyPasswordReset(_ context.Context, login, token string, expiresAt time.Time) error {
+	logrus.Infof("password reset token for %q: %s (expires at %s)", login, token, expiresAt.Format(time.RFC3339))
+	return nil
+}
+
+// passwordResetMessage запись файла уведомлений о сбросе пароля
+type passwordResetMessage struct {
+	Type      string    `json:"type"`
+	Login     string    `json:"login"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// FileNotifier дописывает уведомления в файл, по одной JSON-записи в строке, откуда их может забрать
+// внешняя система рассылки или разработчик при локальной отладке
+type FileNotifier struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileNotifier(path string) (*FileNotifier, error) {
+	if path == "" {
+		return nil, fmt.Errorf("notifier file path is not set")
+	}
+	return &FileNotifier{path: path}, nil
+}
+
+// NotifyPasswordReset дописывает в файл токен сброса пароля пользователя login
+func (n *FileNotifier) NotifyPasswordReset(_ context.Context, login, token string, expiresAt time.Time) error {
+	line, err := json.Marshal(passwordResetMessage{
+		Type:      "password_reset",
+		Login:     login,
+		Token:     token,
+		ExpiresAt: expiresAt,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	file, err := os.OpenFile(n.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,185 @@
+package policy
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/DenisKhanov/Gophermart/internal/app/customerrors"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Классы символов, наличие которых можно потребовать в пароле
+const (
+	ClassUpper   = "upper"
+	ClassLower   = "lower"
+	ClassDigit   = "digit"
+	ClassSpecial = "special"
+)
+
+// Config параметры политики регистрации
+type Config struct {
+	Enabled         bool     // если false, проверяется только, что логин и пароль не пустые
+	LoginMinLen     int      // минимальная длина логина в символах
+	LoginMaxLen     int      // максимальная длина логина в символах
+	PasswordMinLen  int      // минимальная длина пароля в символах
+	PasswordClasses []string // классы символов, каждый из которых должен встречаться в пароле
+	DenyListPath    string   // файл со списком запрещенных (распространенных или скомпрометированных) паролей
+}
+
+// RegistrationPolicy проверяет логин и пароль нового пользователя
+type RegistrationPolicy struct {
+	cfg      Config
+	classes  map[string]struct{}
+	denyList map[string]struct{}
+}
+
+var validLogin = regexp.MustCompile(`^[A-Za-z0-9_\-]+$`).MatchString
+
+func NewRegistrationPolicy(cfg Config) (*RegistrationPolicy, error) {
+	p := &RegistrationPolicy{cfg: cfg, classes: make(map[string]struct{})}
+	if !cfg.Enabled {
+		return p, nil
+	}
+	if cfg.LoginMaxLen > 0 && cfg.LoginMinLen > cfg.LoginMaxLen {
+		return nil, fmt.Errorf("login min length %d is greater than max length %d", cfg.LoginMinLen, cfg.LoginMaxLen)
+	}
+	for _, class := range cfg.PasswordClasses {
+		class = strings.TrimSpace(class)
+		switch class {
+		case ClassUpper, ClassLower, ClassDigit, ClassSpecial:
+			p.classes[class] = struct{}{}
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown password character class %q", class)
+		}
+	}
+	if cfg.DenyListPath != "" {
+		denyList, err := loadDenyList(cfg.DenyListPath)
+		if err != nil {
+			return nil, fmt.Errorf("load password deny list %s: %w", cfg.DenyListPath, err)
+		}
+		p.denyList = denyList
+	}
+	return p, nil
+}
+
+// loadDenyList читает список запрещенных паролей: по одному паролю в строке, пустые строки и строки,
+// начинающиеся с #, пропускаются. Пароли сравниваются без учета регистра
+func loadDenyList(path string) (map[string]struct{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	denyList := make(map[string]struct{})
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		denyList[strings.ToLower(line)] = struct{}{}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return denyList, nil
+}
+
+// Validate проверяет логин и пароль по всем правилам политики и возвращает *customerrors.ValidationError
+// со списком всех нарушенных правил или nil
+func (p *RegistrationPolicy) Validate(login, password string) error {
+	var violations []customerrors.Violation
+	if login == "" {
+		violations = append(violations, violation("login", "required", "login is required"))
+	} else if p.cfg.Enabled {
+		violations = append(violations, p.loginViolations(login)...)
+	}
+	return validationError(append(violations, p.passwordViolations(login, password)...))
+}
+
+// ValidatePassword проверяет только новый пароль пользователя login, например при смене или сбросе пароля
+func (p *RegistrationPolicy) ValidatePassword(login, password string) error {
+	return validationError(p.passwordViolations(login, password))
+}
+
+func (p *RegistrationPolicy) loginViolations(login string) []customerrors.Violation {
+	var violations []customerrors.Violation
+	loginLen := utf8.RuneCountInString(login)
+	if loginLen < p.cfg.LoginMinLen {
+		violations = append(violations, violation("login", "min_length", fmt.Sprintf("login must be at least %d characters long", p.cfg.LoginMinLen)))
+	}
+	if p.cfg.LoginMaxLen > 0 && loginLen > p.cfg.LoginMaxLen {
+		violations = append(violations, violation("login", "max_length", fmt.Sprintf("login must be at most %d characters long", p.cfg.LoginMaxLen)))
+	}
+	if !validLogin(login) {
+		violations = append(violations, violation("login", "charset", `login may contain only latin letters, digits, "-" and "_"`))
+	}
+	return violations
+}
+
+func (p *RegistrationPolicy) passwordViolations(login, password string) []customerrors.Violation {
+	if password == "" {
+		return []customerrors.Violation{violation("password", "required", "password is required")}
+	}
+	if !p.cfg.Enabled {
+		return nil
+	}
+	var violations []customerrors.Violation
+	if utf8.RuneCountInString(password) < p.cfg.PasswordMinLen {
+		violations = append(violations, violation("password", "min_length", fmt.Sprintf("password must be at least %d characters long", p.cfg.PasswordMinLen)))
+	}
+	present := passwordClasses(password)
+	for _, class := range []string{ClassUpper, ClassLower, ClassDigit, ClassSpecial} {
+		if _, required := p.classes[class]; required && !present[class] {
+			violations = append(violations, violation("password", "class_"+class, fmt.Sprintf("password must contain at least one %s character", classNames[class])))
+		}
+	}
+	if strings.EqualFold(password, login) {
+		violations = append(violations, violation("password", "not_login", "password must not be equal to login"))
+	}
+	if _, denied := p.denyList[strings.ToLower(password)]; denied {
+		violations = append(violations, violation("password", "deny_list", "password is too common or known to be compromised"))
+	}
+	return violations
+}
+
+func violation(field, rule, message string) customerrors.Violation {
+	return customerrors.Violation{Field: field, Rule: rule, Message: message}
+}
+
+var classNames = map[string]string{
+	ClassUpper:   "uppercase",
+	ClassLower:   "lowercase",
+	ClassDigit:   "digit",
+	ClassSpecial: "special",
+}
+
+// passwordClasses возвращает классы символов, встречающихся в пароле
+func passwordClasses(password string) map[string]bool {
+	present := make(map[string]bool)
+	for _, char := range password {
+		switch {
+		case unicode.IsUpper(char):
+			present[ClassUpper] = true
+		case unicode.IsLower(char):
+			present[ClassLower] = true
+		case unicode.IsNumber(char):
+			present[ClassDigit] = true
+		case unicode.IsPunct(char) || unicode.IsSymbol(char):
+			present[ClassSpecial] = true
+		}
+	}
+	return present
+}
+
+func validationError(violations []customerrors.Violation) error {
+	if len(violations) == 0 {
+		return nil
+	}
+	return &customerrors.ValidationError{Violations: violations}
+}
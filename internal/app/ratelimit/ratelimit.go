@@ -0,0 +1,109 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRetryAfter пауза по умолчанию, если accrual не прислал корректный заголовок Retry-After
+const DefaultRetryAfter = 60 * time.Second
+
+var requestsPerMinuteRe = regexp.MustCompile(`(?i)no more than (\d+) requests? per minute`)
+
+// Limiter общий для всех воркеров клиентский ограничитель запросов к accrual системе.
+// После получения 429 ставит все запросы на паузу до окончания окна Retry-After,
+// а затем пропускает запросы не чаще объявленного сервисом лимита.
+type Limiter struct {
+	mu           sync.Mutex
+	blockedUntil time.Time     // до этого момента запросы к accrual запрещены
+	interval     time.Duration // минимальный интервал между запросами, 0 - без ограничения
+	next         time.Time     // ближайший момент, когда может быть отправлен следующий запрос
+}
+
+// NewLimiter создает Limiter без ограничений, лимит устанавливается после первого ответа 429
+func NewLimiter() *Limiter {
+	return &Limiter{}
+}
+
+// Wait блокирует вызывающую горутину до момента, когда разрешено отправить запрос, или до отмены контекста
+func (l *Limiter) Wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	start := now
+	if l.blockedUntil.After(start) {
+		start = l.blockedUntil
+	}
+	if l.next.After(start) {
+		start = l.next
+	}
+	if l.interval > 0 {
+		l.next = start.Add(l.interval)
+	}
+	l.mu.Unlock()
+
+	delay := start.Sub(now)
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Block приостанавливает все запросы на retryAfter и, если известен лимит requestsPerMinute,
+// задает скорость отправки запросов после окончания паузы
+func (l *Limiter) Block(retryAfter time.Duration, requestsPerMinute int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	until := time.Now().Add(retryAfter)
+	if until.After(l.blockedUntil) {
+		l.blockedUntil = until
+	}
+	if requestsPerMinute > 0 {
+		l.interval = time.Minute / time.Duration(requestsPerMinute)
+	}
+	l.next = l.blockedUntil
+}
+
+// ParseRetryAfter разбирает значение заголовка Retry-After (секунды или HTTP-дата),
+// при отсутствии или ошибке возвращает DefaultRetryAfter
+func ParseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return DefaultRetryAfter
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if d := time.Until(date); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return DefaultRetryAfter
+}
+
+// ParseRequestsPerMinute извлекает N из тела ответа "No more than N requests per minute allowed",
+// возвращает 0 если лимит не удалось определить
+func ParseRequestsPerMinute(body []byte) int {
+	matches := requestsPerMinuteRe.FindSubmatch(body)
+	if len(matches) < 2 {
+		return 0
+	}
+	n, err := strconv.Atoi(string(matches[1]))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,128 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  time.Duration
+	}{
+		{name: "seconds", value: "120", want: 120 * time.Second},
+		{name: "seconds with spaces", value: " 5 ", want: 5 * time.Second},
+		{name: "zero seconds", value: "0", want: 0},
+		{name: "empty", value: "", want: DefaultRetryAfter},
+		{name: "negative seconds", value: "-5", want: DefaultRetryAfter},
+		{name: "malformed", value: "soon", want: DefaultRetryAfter},
+		{name: "fractional seconds", value: "1.5", want: DefaultRetryAfter},
+		{name: "date in the past", value: "Wed, 21 Oct 2015 07:28:00 GMT", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseRetryAfter(tt.value); got != tt.want {
+				t.Errorf("ParseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfterFutureDate(t *testing.T) {
+	value := time.Now().Add(90 * time.Second).UTC().Format(http.TimeFormat)
+	got := ParseRetryAfter(value)
+	// HTTP-дата задается с точностью до секунды
+	if got < 88*time.Second || got > 90*time.Second {
+		t.Errorf("ParseRetryAfter(%q) = %v, want about 90s", value, got)
+	}
+}
+
+func TestParseRequestsPerMinute(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{name: "accrual body", body: "No more than 10 requests per minute allowed", want: 10},
+		{name: "lower case", body: "no more than 60 requests per minute allowed", want: 60},
+		{name: "single request", body: "No more than 1 request per minute allowed", want: 1},
+		{name: "no number", body: "No more than N requests per minute allowed", want: 0},
+		{name: "other text", body: "Too Many Requests", want: 0},
+		{name: "empty", body: "", want: 0},
+		{name: "overflow", body: "No more than 99999999999999999999 requests per minute allowed", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseRequestsPerMinute([]byte(tt.body)); got != tt.want {
+				t.Errorf("ParseRequestsPerMinute(%q) = %d, want %d", tt.body, got, tt.want)
+			}
+		})
+	}
+}
+
+// waitFor возвращает, сколько Wait продержал вызывающую горутину
+func waitFor(t *testing.T, l *Limiter) time.Duration {
+	t.Helper()
+	start := time.Now()
+	if err := l.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return time.Since(start)
+}
+
+func TestLimiterWaitWithoutBlock(t *testing.T) {
+	l := NewLimiter()
+	for i := 0; i < 3; i++ {
+		if d := waitFor(t, l); d > 20*time.Millisecond {
+			t.Errorf("request %d waited %v without limit", i, d)
+		}
+	}
+}
+
+func TestLimiterBlock(t *testing.T) {
+	l := NewLimiter()
+	l.Block(100*time.Millisecond, 0)
+	if d := waitFor(t, l); d < 90*time.Millisecond {
+		t.Errorf("first request after block waited %v, want at least 100ms", d)
+	}
+	if d := waitFor(t, l); d > 20*time.Millisecond {
+		t.Errorf("request after the pause without rate waited %v", d)
+	}
+}
+
+func TestLimiterBlockDoesNotShortenPause(t *testing.T) {
+	l := NewLimiter()
+	l.Block(150*time.Millisecond, 0)
+	l.Block(0, 0)
+	if d := waitFor(t, l); d < 140*time.Millisecond {
+		t.Errorf("request waited %v, want at least 150ms", d)
+	}
+}
+
+func TestLimiterRate(t *testing.T) {
+	l := NewLimiter()
+	// 600 запросов в минуту - не чаще одного запроса в 100ms
+	l.Block(0, 600)
+	if d := waitFor(t, l); d > 20*time.Millisecond {
+		t.Errorf("first request waited %v", d)
+	}
+	for i := 0; i < 2; i++ {
+		if d := waitFor(t, l); d < 90*time.Millisecond {
+			t.Errorf("request %d waited %v, want at least 100ms", i, d)
+		}
+	}
+}
+
+func TestLimiterWaitCanceled(t *testing.T) {
+	l := NewLimiter()
+	l.Block(time.Minute, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait() = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -7,12 +7,16 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"github.com/DenisKhanov/Gophermart/internal/app/customerrors"
 	"github.com/DenisKhanov/Gophermart/internal/app/models"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/shopspring/decimal"
 	"github.com/sirupsen/logrus"
+	"strings"
+	"time"
 )
 
 type InDBRepo struct {
@@ -20,74 +24,74 @@ type InDBRepo struct {
 }
 
 func NewURLInDBRepo(dbPool *pgxpool.Pool) *InDBRepo {
-	storage := &InDBRepo{
+	return &InDBRepo{
 		dbPool: dbPool,
 	}
-	if err := storage.CreateBDTables(); err != nil {
-		logrus.Error(err)
+}
+
+// txKey ключ контекста, под которым WithTx хранит открытую транзакцию
+type txKey struct{}
+
+// querier общие для пула соединений и транзакции методы выполнения запросов
+type querier interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// conn возвращает транзакцию, открытую WithTx, если она есть в контексте, иначе пул соединений
+func (d *InDBRepo) conn(ctx context.Context) querier {
+	if tx, ok := ctx.Value(txKey{}).(pgx.Tx); ok {
+		return tx
+	}
+	return d.dbPool
+}
+
+// WithTx выполняет fn в транзакции базы данных. Методы репозитория, вызванные с переданным в fn контекстом,
+// работают в этой транзакции. Если транзакция уже открыта, fn выполняется в ней же
+func (d *InDBRepo) WithTx(ctx context.Context, fn func(ctx context.Context) error) (err error) {
+	if _, ok := ctx.Value(txKey{}).(pgx.Tx); ok {
+		return fn(ctx)
 	}
-	return storage
-}
-
-// CreateBDTables создание таблиц users и orders в базе данных
-func (d *InDBRepo) CreateBDTables() error {
-	ctx := context.Background()
-	sqlQuery := `
-CREATE TABLE users (
-    uuid UUID PRIMARY KEY,
-    login VARCHAR(255) UNIQUE NOT NULL,
-    hashed_password BYTEA NOT NULL,
-    date TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
-);
-CREATE TABLE orders (
-    id SERIAL PRIMARY KEY,
-    order_number VARCHAR(255) NOT NULL UNIQUE,
-    uuid UUID NOT NULL,
-    accrual DECIMAL(9, 2),
-    status VARCHAR(255) NOT NULL,
-    date TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-    FOREIGN KEY (uuid) REFERENCES users(uuid)
-);
-CREATE TABLE withdrawals (
-    id SERIAL PRIMARY KEY,
-    order_number VARCHAR(255) NOT NULL,
-    uuid UUID NOT NULL,
-    sum DECIMAL(9, 2),
-    date TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-    FOREIGN KEY (uuid) REFERENCES users(uuid)
-);
-CREATE TABLE balance (
-    id SERIAL PRIMARY KEY,
-    uuid UUID NOT NULL,
-    user_balance DECIMAL(9, 2) DEFAULT 0.00,
-    date TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-    FOREIGN KEY (uuid) REFERENCES users(uuid)
-);`
-	_, err := d.dbPool.Exec(ctx, sqlQuery)
-	if err != nil {
-		logrus.Errorf("don't create tables users and orders: %v", err)
+	tx, err := d.dbPool.Begin(ctx)
+	if err != nil {
+		logrus.Error("transaction don't begin ", err)
 		return err
 	}
-	logrus.Info("Successfully created tables users and orders")
-	return nil
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(ctx); rollbackErr != nil {
+				logrus.Error("transaction don't rollback ", rollbackErr)
+			}
+			return
+		}
+		if err = tx.Commit(ctx); err != nil {
+			logrus.Error("transaction don't commit ", err)
+		}
+	}()
+	return fn(context.WithValue(ctx, txKey{}, tx))
 }
 
 // StoreNewUser сохраняет нового пользователя (заранее сгенерированный UUID, логин и хешированный пароль)
-func (d *InDBRepo) StoreNewUser(ctx context.Context, tx pgx.Tx, userID uuid.UUID, login string, hashedPassword []byte) error {
+// или возвращает customerrors.ErrUserAlreadyTaken, если логин уже занят
+func (d *InDBRepo) StoreNewUser(ctx context.Context, userID uuid.UUID, login string, hashedPassword []byte) error {
 
 	const sqlQuery = `INSERT INTO users (uuid,login, hashed_password) VALUES ($1, $2,$3) ON CONFLICT (login) DO NOTHING`
-	_, err := tx.Exec(ctx, sqlQuery, userID, login, hashedPassword)
+	result, err := d.conn(ctx).Exec(ctx, sqlQuery, userID, login, hashedPassword)
 	if err != nil {
 		logrus.Error("new user don't save in database ", err)
 		return err
 	}
+	if result.RowsAffected() == 0 {
+		return customerrors.ErrUserAlreadyTaken
+	}
 	return nil
 }
 
 // StoreNewUserBalance создает поле с нулевым балансом для пользователя в таблице balance
-func (d *InDBRepo) StoreNewUserBalance(ctx context.Context, tx pgx.Tx, userID uuid.UUID) error {
+func (d *InDBRepo) StoreNewUserBalance(ctx context.Context, userID uuid.UUID) error {
 	const sqlQuery = `INSERT INTO balance (uuid) VALUES ($1)`
-	_, err := tx.Exec(ctx, sqlQuery, userID)
+	_, err := d.conn(ctx).Exec(ctx, sqlQuery, userID)
 	if err != nil {
 		logrus.Error("user balance (0.00) don't save in database ", err)
 		return err
@@ -95,10 +99,13 @@ func (d *InDBRepo) StoreNewUserBalance(ctx context.Context, tx pgx.Tx, userID uu
 	return nil
 }
 
-// StoreUserOrder сохраняет с привязкой к UUID пользователя новый заказ
-func (d *InDBRepo) StoreUserOrder(ctx context.Context, tx pgx.Tx, orderNumber, orderStatus string, userID uuid.UUID, bonus decimal.Decimal) error {
-	const sqlQuery = `INSERT INTO orders (order_number, uuid,accrual,status) VALUES ($1, $2,$3,$4)`
-	_, err := tx.Exec(ctx, sqlQuery, orderNumber, userID, bonus, orderStatus)
+// StoreUserOrder сохраняет с привязкой к UUID пользователя новый заказ без начисления и начинает историю его статусов
+func (d *InDBRepo) StoreUserOrder(ctx context.Context, orderNumber, orderStatus string, userID uuid.UUID) error {
+	const sqlQuery = `WITH inserted AS (
+    INSERT INTO orders (order_number, uuid,status) VALUES ($1, $2,$3) RETURNING order_number, status, date
+)
+INSERT INTO order_status_history (order_number, status, date) SELECT order_number, status, date FROM inserted`
+	_, err := d.conn(ctx).Exec(ctx, sqlQuery, orderNumber, userID, orderStatus)
 	if err != nil {
 		logrus.Error("new order don't save in database ", err)
 		return err
@@ -106,15 +113,33 @@ func (d *InDBRepo) StoreUserOrder(ctx context.Context, tx pgx.Tx, orderNumber, o
 	return nil
 }
 
+// StoreUserOrderIfNew сохраняет новый заказ так же, как StoreUserOrder, но если заказ с таким номером уже есть,
+// ничего не сохраняет и возвращает false, не прерывая транзакцию
+func (d *InDBRepo) StoreUserOrderIfNew(ctx context.Context, orderNumber, orderStatus string, userID uuid.UUID) (bool, error) {
+	const sqlQuery = `WITH inserted AS (
+    INSERT INTO orders (order_number, uuid,status) VALUES ($1, $2,$3) ON CONFLICT (order_number) DO NOTHING
+    RETURNING order_number, status, date
+), history AS (
+    INSERT INTO order_status_history (order_number, status, date) SELECT order_number, status, date FROM inserted
+)
+SELECT count(*) FROM inserted`
+	var inserted int
+	if err := d.conn(ctx).QueryRow(ctx, sqlQuery, orderNumber, userID, orderStatus).Scan(&inserted); err != nil {
+		logrus.Error("new order don't save in database ", err)
+		return false, err
+	}
+	return inserted > 0, nil
+}
+
 // GetUUID возвращает userID на основании его логина или возвращает ошибку если не существует
 func (d *InDBRepo) GetUUIDFromUsers(ctx context.Context, login string) (uuid.UUID, error) {
 	const selectQuery = `SELECT uuid FROM users WHERE login = $1`
 	var savedUserID uuid.UUID
-	err := d.dbPool.QueryRow(ctx, selectQuery, login).Scan(&savedUserID)
+	err := d.conn(ctx).QueryRow(ctx, selectQuery, login).Scan(&savedUserID)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			logrus.Error(err)
-			return uuid.Nil, fmt.Errorf("login not found: %w", err)
+			return uuid.Nil, fmt.Errorf("login not found: %w", customerrors.ErrNotFound)
 		}
 		logrus.Error("error querying for uuid: ", err)
 		return uuid.Nil, fmt.Errorf("error querying for login: %w", err)
@@ -127,11 +152,11 @@ func (d *InDBRepo) GetUserHashPassword(ctx context.Context, login string) ([]byt
 	//TODO может лучше принимать в виде аргумента userID?
 	const selectQuery = `SELECT hashed_password FROM users WHERE login = $1`
 	var savedHashedPassword []byte
-	err := d.dbPool.QueryRow(ctx, selectQuery, login).Scan(&savedHashedPassword)
+	err := d.conn(ctx).QueryRow(ctx, selectQuery, login).Scan(&savedHashedPassword)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			logrus.Error(err)
-			return nil, fmt.Errorf("login not found: %w", err)
+			return nil, fmt.Errorf("login not found: %w", customerrors.ErrNotFound)
 		}
 		logrus.Error("error querying for savedHashedPassword: ", err)
 		return nil, fmt.Errorf("error querying for login: %w", err)
@@ -143,11 +168,11 @@ func (d *InDBRepo) GetUserHashPassword(ctx context.Context, login string) ([]byt
 func (d *InDBRepo) GetUUIDFromOrders(ctx context.Context, orderNumber string) (uuid.UUID, error) {
 	const selectQuery = `SELECT uuid FROM orders WHERE order_number = $1`
 	var savedUserID uuid.UUID
-	err := d.dbPool.QueryRow(ctx, selectQuery, orderNumber).Scan(&savedUserID)
+	err := d.conn(ctx).QueryRow(ctx, selectQuery, orderNumber).Scan(&savedUserID)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			logrus.Errorf("the order number not found: %s", err)
-			return uuid.Nil, fmt.Errorf("the order number not found: %w", err)
+			return uuid.Nil, fmt.Errorf("the order number not found: %w", customerrors.ErrNotFound)
 		}
 		logrus.Errorf("error querying for uuid: %s", err)
 		return uuid.Nil, fmt.Errorf("error querying for order number: %w", err)
@@ -155,48 +180,90 @@ func (d *InDBRepo) GetUUIDFromOrders(ctx context.Context, orderNumber string) (u
 	return savedUserID, nil
 }
 
-// UpdateOrders обновление состояния списка заказов, которые были с незавершенными статусами
-func (d *InDBRepo) UpdateOrders(ctx context.Context, tx pgx.Tx, updatedOrders []models.AccrualResponseData) error {
-	const sqlQuery = `UPDATE orders SET status = $1, accrual=$2 WHERE order_number = $3`
+// UpdateOrders обновление состояния списка заказов, которые были с незавершенными статусами.
+// Заказ обновляется, только если его статус действительно меняется и еще не является окончательным,
+// возвращает список фактически обновленных заказов с UUID их владельцев. Каждое изменение статуса сохраняется
+// в истории статусов заказа
+func (d *InDBRepo) UpdateOrders(ctx context.Context, updatedOrders []models.AccrualResponseData) ([]models.AccrualResponseData, error) {
+	const sqlQuery = `WITH updated AS (
+    UPDATE orders SET status = $1, accrual=$2 WHERE order_number = $3
+    AND status <> $1 AND status NOT IN ('PROCESSED', 'INVALID') RETURNING uuid, order_number, status, accrual
+), history AS (
+    INSERT INTO order_status_history (order_number, status, accrual) SELECT order_number, status, accrual FROM updated
+)
+SELECT uuid FROM updated`
+	var appliedOrders []models.AccrualResponseData
 	for _, order := range updatedOrders {
-		_, err := tx.Exec(ctx, sqlQuery, order.Status, order.Accrual, order.Order)
+		err := d.conn(ctx).QueryRow(ctx, sqlQuery, order.Status, order.Accrual, order.Order).Scan(&order.UserID)
 		if err != nil {
-			return err
+			if errors.Is(err, pgx.ErrNoRows) {
+				logrus.Infof("order %s already has status %s or final status", order.Order, order.Status)
+				continue
+			}
+			return nil, err
 		}
+		appliedOrders = append(appliedOrders, order)
 	}
-	logrus.Infof("orders %v updated", updatedOrders)
-	return nil
+	logrus.Infof("orders %v updated", appliedOrders)
+	return appliedOrders, nil
+}
+
+// GetOrder возвращает заказ по номеру вместе с UUID владельца и расписанием его проверки в accrual
+func (d *InDBRepo) GetOrder(ctx context.Context, orderNumber string) (models.UserOrder, error) {
+	const selectQuery = `SELECT id,uuid,order_number,status,accrual,date,check_attempts,next_check_at FROM orders
+WHERE order_number = $1`
+	var order models.UserOrder
+	err := d.conn(ctx).QueryRow(ctx, selectQuery, orderNumber).Scan(&order.ID, &order.UserID, &order.Number, &order.Status,
+		&order.Accrual, &order.UploadedAt, &order.CheckAttempts, &order.NextCheckAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return models.UserOrder{}, fmt.Errorf("the order number not found: %w", customerrors.ErrNotFound)
+		}
+		logrus.Errorf("error querying for order: %s", err)
+		return models.UserOrder{}, fmt.Errorf("error querying for order: %w", err)
+	}
+	return order, nil
 }
 
-// GetProcessingOrders возвращение списка номеров заказов которые не имеют финального статуса
-func (d *InDBRepo) GetProcessingOrders(ctx context.Context) ([]models.UserOrder, error) {
-	const selectQuery = `SELECT order_number,status,uuid FROM orders WHERE status = $1 OR status = $2 OR status = $3`
-	rows, err := d.dbPool.Query(ctx, selectQuery, "REGISTERED", "PROCESSING", "NEW")
+// GetOrderStatusHistory возвращает все изменения статуса заказа в порядке их сохранения
+func (d *InDBRepo) GetOrderStatusHistory(ctx context.Context, orderNumber string) ([]models.OrderStatusChange, error) {
+	const selectQuery = `SELECT status,accrual,date FROM order_status_history WHERE order_number = $1 ORDER BY id`
+	rows, err := d.conn(ctx).Query(ctx, selectQuery, orderNumber)
 	if err != nil {
 		logrus.Error(err)
 		return nil, err
 	}
 	defer rows.Close()
-	var orders []models.UserOrder
+
+	var history []models.OrderStatusChange
 	for rows.Next() {
-		var order models.UserOrder
-		if err = rows.Scan(&order.Number, &order.Status, &order.UserID); err != nil {
+		var change models.OrderStatusChange
+		if err = rows.Scan(&change.Status, &change.Accrual, &change.ChangedAt); err != nil {
 			logrus.Error(err)
 			return nil, err
 		}
-		orders = append(orders, order)
+		history = append(history, change)
 	}
 	if err = rows.Err(); err != nil {
 		logrus.Error(err)
 		return nil, err
 	}
-	return orders, nil
+	return history, nil
 }
 
-// GetUserProcessingOrders возвращение списка номеров заказов пользователя которые не имеют финального статуса
-func (d *InDBRepo) GetUserProcessingOrders(ctx context.Context, userID uuid.UUID) ([]models.UserOrder, error) {
-	const selectQuery = `SELECT order_number,status FROM orders WHERE uuid=$1 AND (status = $2 OR status = $3)`
-	rows, err := d.dbPool.Query(ctx, selectQuery, userID, "NEW", "PROCESSING")
+// ClaimDueOrders захватывает не более limit заказов без финального статуса, у которых подошло время проверки,
+// начиная с самых давно ожидающих. Захваченным заказам время проверки сдвигается на lease, а строки,
+// заблокированные другими экземплярами сервиса, пропускаются, поэтому каждый заказ проверяет только один экземпляр
+func (d *InDBRepo) ClaimDueOrders(ctx context.Context, limit int, lease time.Duration) ([]models.UserOrder, error) {
+	const sqlQuery = `UPDATE orders SET next_check_at = CURRENT_TIMESTAMP + make_interval(secs => $2)
+WHERE id IN (
+    SELECT id FROM orders
+    WHERE status IN ('NEW', 'REGISTERED', 'PROCESSING') AND next_check_at <= CURRENT_TIMESTAMP
+    ORDER BY next_check_at LIMIT $1
+    FOR UPDATE SKIP LOCKED
+)
+RETURNING order_number,status,uuid,check_attempts`
+	rows, err := d.conn(ctx).Query(ctx, sqlQuery, limit, lease.Seconds())
 	if err != nil {
 		logrus.Error(err)
 		return nil, err
@@ -205,7 +272,7 @@ func (d *InDBRepo) GetUserProcessingOrders(ctx context.Context, userID uuid.UUID
 	var orders []models.UserOrder
 	for rows.Next() {
 		var order models.UserOrder
-		if err = rows.Scan(&order.Number, &order.Status); err != nil {
+		if err = rows.Scan(&order.Number, &order.Status, &order.UserID, &order.CheckAttempts); err != nil {
 			logrus.Error(err)
 			return nil, err
 		}
@@ -215,16 +282,29 @@ func (d *InDBRepo) GetUserProcessingOrders(ctx context.Context, userID uuid.UUID
 		logrus.Error(err)
 		return nil, err
 	}
-	logrus.Infof("return users processing orders %v", orders)
 	return orders, nil
 }
 
+// ScheduleOrdersCheck сохраняет количество попыток и время следующей проверки заказов в accrual
+func (d *InDBRepo) ScheduleOrdersCheck(ctx context.Context, orders []models.UserOrder) error {
+	const sqlQuery = `UPDATE orders SET check_attempts = $1, next_check_at = $2 WHERE order_number = $3`
+	for _, order := range orders {
+		_, err := d.conn(ctx).Exec(ctx, sqlQuery, order.CheckAttempts, order.NextCheckAt, order.Number)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // TODO может условие с accrual nil в базе прописать, обратить внимание на совет Дениса
 
-// GetUserOrders возвращает слайс всех заказов пользователя в формате models.UserOrder
-func (d *InDBRepo) GetUserOrders(ctx context.Context, userID uuid.UUID) ([]models.UserOrder, error) {
-	const selectQuery = `SELECT order_number,status,accrual,date FROM orders WHERE uuid = $1 ORDER BY date`
-	rows, err := d.dbPool.Query(ctx, selectQuery, userID)
+// GetUserOrders возвращает слайс заказов пользователя, подходящих под условия фильтра, в формате models.UserOrder
+func (d *InDBRepo) GetUserOrders(ctx context.Context, userID uuid.UUID, filter models.OrderFilter) ([]models.UserOrder, error) {
+	filter.UserID = &userID
+	where := orderConditions(filter)
+	selectQuery := `SELECT o.id,o.order_number,o.status,o.accrual,o.date FROM orders o` + where.page("o.id", filter.Page)
+	rows, err := d.conn(ctx).Query(ctx, selectQuery, where.args...)
 	if err != nil {
 		logrus.Error(err)
 		return nil, err
@@ -236,7 +316,7 @@ func (d *InDBRepo) GetUserOrders(ctx context.Context, userID uuid.UUID) ([]model
 	for rows.Next() {
 		var order models.UserOrder
 		var accrualNull sql.NullString
-		if err = rows.Scan(&order.Number, &order.Status, &accrualNull, &order.UploadedAt); err != nil {
+		if err = rows.Scan(&order.ID, &order.Number, &order.Status, &accrualNull, &order.UploadedAt); err != nil {
 			logrus.Error(err)
 			return nil, err
 		}
@@ -260,48 +340,209 @@ func (d *InDBRepo) GetUserOrders(ctx context.Context, userID uuid.UUID) ([]model
 	return userOrders, nil
 }
 
-// StoreUserWithdrawal сохраняет в таблицу withdrawals новое списание баллов пользователя
-func (d *InDBRepo) StoreUserWithdrawal(ctx context.Context, tx pgx.Tx, userID uuid.UUID, orderNumber string, sum decimal.Decimal) error {
-	const sqlQuery = `INSERT INTO withdrawals (uuid,order_number,sum) VALUES ($1, $2,$3)`
-	_, err := tx.Exec(ctx, sqlQuery, userID, orderNumber, sum)
+// FindOrders возвращает заказы всех пользователей, подходящие под условия фильтра
+func (d *InDBRepo) FindOrders(ctx context.Context, filter models.OrderFilter) ([]models.AdminOrder, error) {
+	where := orderConditions(filter)
+	selectQuery := `SELECT o.uuid,u.login,o.order_number,o.status,o.accrual,o.date,o.check_attempts,o.next_check_at
+FROM orders o JOIN users u ON u.uuid = o.uuid` + where.page("o.id", filter.Page)
+	rows, err := d.conn(ctx).Query(ctx, selectQuery, where.args...)
+	if err != nil {
+		logrus.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []models.AdminOrder
+	for rows.Next() {
+		var order models.AdminOrder
+		if err = rows.Scan(&order.UserID, &order.Login, &order.Number, &order.Status, &order.Accrual,
+			&order.UploadedAt, &order.CheckAttempts, &order.NextCheckAt); err != nil {
+			logrus.Error(err)
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	if err = rows.Err(); err != nil {
+		logrus.Error(err)
+		return nil, err
+	}
+	return orders, nil
+}
+
+// orderConditions собирает условия выборки заказов таблицы orders с псевдонимом o по фильтру
+func orderConditions(filter models.OrderFilter) *whereBuilder {
+	where := &whereBuilder{}
+	if filter.UserID != nil {
+		where.add("o.uuid = $%d", *filter.UserID)
+	}
+	if len(filter.Statuses) > 0 {
+		where.add("o.status = ANY($%d)", filter.Statuses)
+	}
+	where.timeRange("o.date", filter.From, filter.To)
+	return where
+}
+
+// whereBuilder собирает условие WHERE запроса с нумерованными параметрами
+type whereBuilder struct {
+	conditions []string
+	args       []any
+}
+
+// add добавляет условие, в котором $%d заменяется номером параметра arg
+func (w *whereBuilder) add(condition string, arg any) {
+	w.args = append(w.args, arg)
+	w.conditions = append(w.conditions, fmt.Sprintf(condition, len(w.args)))
+}
+
+// timeRange добавляет условие column не раньше from и раньше to, нулевые границы не ограничивают выборку
+func (w *whereBuilder) timeRange(column string, from, to time.Time) {
+	if !from.IsZero() {
+		w.add(column+" >= $%d", from)
+	}
+	if !to.IsZero() {
+		w.add(column+" < $%d", to)
+	}
+}
+
+// page добавляет условие продолжения выборки после записи page.AfterID и возвращает окончание запроса:
+// WHERE, сортировку по столбцу идентификатора idColumn в направлении page и LIMIT
+func (w *whereBuilder) page(idColumn string, page models.Page) string {
+	order, after := "ASC", " > $%d"
+	if page.Descending {
+		order, after = "DESC", " < $%d"
+	}
+	if page.AfterID != 0 {
+		w.add(idColumn+after, page.AfterID)
+	}
+	var query string
+	if len(w.conditions) > 0 {
+		query = "\nWHERE " + strings.Join(w.conditions, " AND ")
+	}
+	query += "\nORDER BY " + idColumn + " " + order
+	if page.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", page.Limit)
+	}
+	return query
+}
+
+// RescheduleOrderCheck назначает немедленную проверку заказа без финального статуса и сбрасывает счетчик попыток.
+// Возвращает false, если статус заказа уже окончательный
+func (d *InDBRepo) RescheduleOrderCheck(ctx context.Context, orderNumber string) (bool, error) {
+	const sqlQuery = `UPDATE orders SET check_attempts = 0, next_check_at = CURRENT_TIMESTAMP
+WHERE order_number = $1 AND status NOT IN ('PROCESSED', 'INVALID')`
+	tag, err := d.conn(ctx).Exec(ctx, sqlQuery, orderNumber)
+	if err != nil {
+		logrus.Error("order check don't reschedule in database ", err)
+		return false, err
+	}
+	if tag.RowsAffected() > 0 {
+		return true, nil
+	}
+	if _, err = d.GetUUIDFromOrders(ctx, orderNumber); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// StoreUserWithdrawal сохраняет в таблицу withdrawals новое списание баллов пользователя. Если у пользователя
+// уже есть списание с тем же номером заказа или ключом идемпотентности, ничего не сохраняет и возвращает false
+func (d *InDBRepo) StoreUserWithdrawal(ctx context.Context, userID uuid.UUID, orderNumber string, sum decimal.Decimal, idempotencyKey string) (bool, error) {
+	const sqlQuery = `INSERT INTO withdrawals (uuid,order_number,sum,idempotency_key) VALUES ($1, $2,$3,NULLIF($4, ''))
+ON CONFLICT DO NOTHING`
+	tag, err := d.conn(ctx).Exec(ctx, sqlQuery, userID, orderNumber, sum, idempotencyKey)
 	if err != nil {
 		logrus.Error("new withdrawal don't save in database ", err)
-		return err
+		return false, err
 	}
-	return nil
+	return tag.RowsAffected() > 0, nil
 }
 
-// UpdateUserBalance обновляет состояние баланса у конкретного пользователя в таблице balance
-func (d *InDBRepo) UpdateUserBalance(ctx context.Context, tx pgx.Tx, userID uuid.UUID, newBalance decimal.Decimal) error {
-	const sqlQuery = `UPDATE balance SET user_balance = $1 WHERE uuid = $2`
-	_, err := tx.Exec(ctx, sqlQuery, newBalance, userID)
+// GetUserWithdrawal возвращает списание пользователя с указанным ключом идемпотентности или, если такого нет,
+// с указанным номером заказа
+func (d *InDBRepo) GetUserWithdrawal(ctx context.Context, userID uuid.UUID, orderNumber, idempotencyKey string) (models.UserWithdrawal, error) {
+	const selectQuery = `SELECT order_number,sum,date,COALESCE(idempotency_key, '') FROM withdrawals
+WHERE uuid = $1 AND (order_number = $2 OR idempotency_key = NULLIF($3, ''))
+ORDER BY idempotency_key = NULLIF($3, '') DESC NULLS LAST LIMIT 1`
+	var withdrawal models.UserWithdrawal
+	err := d.conn(ctx).QueryRow(ctx, selectQuery, userID, orderNumber, idempotencyKey).Scan(&withdrawal.Order,
+		&withdrawal.Sum, &withdrawal.ProcessedAt, &withdrawal.IdempotencyKey)
 	if err != nil {
-		return err
+		if errors.Is(err, pgx.ErrNoRows) {
+			logrus.Errorf("the withdrawal not found: %s", err)
+			return models.UserWithdrawal{}, fmt.Errorf("the withdrawal not found: %w", customerrors.ErrNotFound)
+		}
+		logrus.Errorf("error querying for withdrawal: %s", err)
+		return models.UserWithdrawal{}, fmt.Errorf("error querying for withdrawal: %w", err)
 	}
-	return nil
+	return withdrawal, nil
 }
 
-// UsersBalanceUpdate обновляет состояние баланса пользователя
-func (d *InDBRepo) UsersBalanceUpdate(ctx context.Context, tx pgx.Tx, usersBalanceToUpdate map[uuid.UUID]decimal.Decimal) error {
-	const sqlQuery = `UPDATE balance SET user_balance = $1 WHERE uuid = $2`
-	for userID, newBalance := range usersBalanceToUpdate {
-		_, err := tx.Exec(ctx, sqlQuery, newBalance, userID)
+// AppendLedgerEntry в рамках транзакции проводит запись журнала: изменяет закешированный в таблице balance баланс
+// пользователя на entry.Amount относительно текущего значения и сохраняет неизменяемую запись в таблицу ledger.
+// Если после проведения баланс стал бы отрицательным, возвращает customerrors.ErrNotEnoughFunds.
+// Заполняет ID, BalanceAfter и CreatedAt сохраненной записи
+func (d *InDBRepo) AppendLedgerEntry(ctx context.Context, entry *models.LedgerEntry) error {
+	const updateQuery = `UPDATE balance SET user_balance = user_balance + $1 WHERE uuid = $2 AND user_balance + $1 >= 0
+RETURNING user_balance`
+	const insertQuery = `INSERT INTO ledger (uuid, entry_type, amount, balance_after, contra_account, order_number, reason, actor)
+VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), NULLIF($8, '')) RETURNING id, date`
+	// изменение баланса и запись журнала проводятся одной транзакцией, даже если вызывающий ее не открыл
+	return d.WithTx(ctx, func(ctx context.Context) error {
+		err := d.conn(ctx).QueryRow(ctx, updateQuery, entry.Amount, entry.UserID).Scan(&entry.BalanceAfter)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return customerrors.ErrNotEnoughFunds
+			}
+			return err
+		}
+		err = d.conn(ctx).QueryRow(ctx, insertQuery, entry.UserID, entry.Type, entry.Amount, entry.BalanceAfter,
+			entry.ContraAccount, entry.OrderNumber, entry.Reason, entry.Actor).Scan(&entry.ID, &entry.CreatedAt)
 		if err != nil {
+			logrus.Error("new ledger entry don't save in database ", err)
 			return err
 		}
+		return nil
+	})
+}
+
+// GetUserLedger возвращает все записи журнала движения баллов пользователя в порядке их проведения
+func (d *InDBRepo) GetUserLedger(ctx context.Context, userID uuid.UUID) ([]models.LedgerEntry, error) {
+	const selectQuery = `SELECT id,entry_type,amount,balance_after,contra_account,COALESCE(order_number, ''),COALESCE(reason, ''),
+COALESCE(actor, ''),date
+FROM ledger WHERE uuid = $1 ORDER BY id`
+	rows, err := d.conn(ctx).Query(ctx, selectQuery, userID)
+	if err != nil {
+		logrus.Error(err)
+		return nil, err
 	}
-	return nil
+	defer rows.Close()
+
+	var entries []models.LedgerEntry
+	for rows.Next() {
+		entry := models.LedgerEntry{UserID: userID}
+		if err = rows.Scan(&entry.ID, &entry.Type, &entry.Amount, &entry.BalanceAfter, &entry.ContraAccount,
+			&entry.OrderNumber, &entry.Reason, &entry.Actor, &entry.CreatedAt); err != nil {
+			logrus.Error(err)
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if err = rows.Err(); err != nil {
+		logrus.Error(err)
+		return nil, err
+	}
+	return entries, nil
 }
 
 // GetUserBalance возвращает имеющийся на данный момент баланс пользователя
 func (d *InDBRepo) GetUserBalance(ctx context.Context, userID uuid.UUID) (decimal.Decimal, error) {
 	const selectQuery = `SELECT user_balance FROM balance WHERE uuid = $1`
 	var userBalance decimal.Decimal
-	err := d.dbPool.QueryRow(ctx, selectQuery, userID).Scan(&userBalance)
+	err := d.conn(ctx).QueryRow(ctx, selectQuery, userID).Scan(&userBalance)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			logrus.Errorf("the userID not found: %s", err)
-			return decimal.Zero, fmt.Errorf("the userID not found: %w", err)
+			return decimal.Zero, fmt.Errorf("the userID not found: %w", customerrors.ErrNotFound)
 		}
 		logrus.Errorf("error querying for user_balance: %s", err)
 		return decimal.Zero, fmt.Errorf("error querying for user_balance: %w", err)
@@ -313,11 +554,11 @@ func (d *InDBRepo) GetUserBalance(ctx context.Context, userID uuid.UUID) (decima
 func (d *InDBRepo) GetUserWithdrawn(ctx context.Context, userID uuid.UUID) (decimal.Decimal, error) {
 	const selectQuery = `SELECT SUM(sum) FROM withdrawals WHERE uuid = $1`
 	var userWithdrawn decimal.Decimal
-	err := d.dbPool.QueryRow(ctx, selectQuery, userID).Scan(&userWithdrawn)
+	err := d.conn(ctx).QueryRow(ctx, selectQuery, userID).Scan(&userWithdrawn)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			logrus.Errorf("the userID not found: %s", err)
-			return decimal.Zero, fmt.Errorf("the uuid not found: %w", err)
+			return decimal.Zero, fmt.Errorf("the uuid not found: %w", customerrors.ErrNotFound)
 		}
 		logrus.Errorf("error querying for sum withdrawn: %s", err)
 		return decimal.Zero, fmt.Errorf("error querying for sum withdrawn : %w", err)
@@ -325,10 +566,13 @@ func (d *InDBRepo) GetUserWithdrawn(ctx context.Context, userID uuid.UUID) (deci
 	return userWithdrawn, nil
 }
 
-// GetUserWithdrawals возвращает список всех списаний пользователя в порядке к более свежей дате
-func (d *InDBRepo) GetUserWithdrawals(ctx context.Context, userID uuid.UUID) ([]models.UserWithdrawal, error) {
-	const selectQuery = `SELECT order_number,sum,date FROM withdrawals WHERE uuid = $1 ORDER BY date`
-	rows, err := d.dbPool.Query(ctx, selectQuery, userID)
+// GetUserWithdrawals возвращает список списаний пользователя, подходящих под условия фильтра
+func (d *InDBRepo) GetUserWithdrawals(ctx context.Context, userID uuid.UUID, filter models.WithdrawalFilter) ([]models.UserWithdrawal, error) {
+	where := &whereBuilder{}
+	where.add("uuid = $%d", userID)
+	where.timeRange("date", filter.From, filter.To)
+	selectQuery := `SELECT id,order_number,sum,date FROM withdrawals` + where.page("id", filter.Page)
+	rows, err := d.conn(ctx).Query(ctx, selectQuery, where.args...)
 	if err != nil {
 		logrus.Error(err)
 		return nil, err
@@ -339,7 +583,7 @@ func (d *InDBRepo) GetUserWithdrawals(ctx context.Context, userID uuid.UUID) ([]
 
 	for rows.Next() {
 		var withdrawal models.UserWithdrawal
-		if err = rows.Scan(&withdrawal.Order, &withdrawal.Sum, &withdrawal.ProcessedAt); err != nil {
+		if err = rows.Scan(&withdrawal.ID, &withdrawal.Order, &withdrawal.Sum, &withdrawal.ProcessedAt); err != nil {
 			logrus.Error(err)
 			return nil, err
 		}
@@ -352,3 +596,267 @@ func (d *InDBRepo) GetUserWithdrawals(ctx context.Context, userID uuid.UUID) ([]
 	logrus.Infof("return processing orders %v", userWithdrawals)
 	return userWithdrawals, nil
 }
+
+// StoreSession сохраняет новую сессию пользователя
+func (d *InDBRepo) StoreSession(ctx context.Context, session models.Session) error {
+	const sqlQuery = `INSERT INTO sessions (id, uuid, refresh_token_hash, date, expires_at) VALUES ($1, $2, $3, $4, $5)`
+	_, err := d.conn(ctx).Exec(ctx, sqlQuery, session.ID, session.UserID, session.RefreshTokenHash, session.CreatedAt, session.ExpiresAt)
+	if err != nil {
+		logrus.Error("new session don't save in database ", err)
+		return err
+	}
+	return nil
+}
+
+// GetSession возвращает сессию по ее идентификатору
+func (d *InDBRepo) GetSession(ctx context.Context, sessionID uuid.UUID) (models.Session, error) {
+	const selectQuery = `SELECT id, uuid, refresh_token_hash, date, expires_at, revoked_at FROM sessions WHERE id = $1`
+	return d.getSession(ctx, selectQuery, sessionID)
+}
+
+// GetSessionByRefreshToken возвращает сессию по хешу ее текущего токена обновления
+func (d *InDBRepo) GetSessionByRefreshToken(ctx context.Context, refreshTokenHash []byte) (models.Session, error) {
+	const selectQuery = `SELECT id, uuid, refresh_token_hash, date, expires_at, revoked_at FROM sessions WHERE refresh_token_hash = $1`
+	return d.getSession(ctx, selectQuery, refreshTokenHash)
+}
+
+func (d *InDBRepo) getSession(ctx context.Context, selectQuery string, arg any) (models.Session, error) {
+	var session models.Session
+	err := d.conn(ctx).QueryRow(ctx, selectQuery, arg).Scan(&session.ID, &session.UserID, &session.RefreshTokenHash,
+		&session.CreatedAt, &session.ExpiresAt, &session.RevokedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return models.Session{}, fmt.Errorf("the session not found: %w", customerrors.ErrNotFound)
+		}
+		logrus.Errorf("error querying for session: %s", err)
+		return models.Session{}, fmt.Errorf("error querying for session: %w", err)
+	}
+	return session, nil
+}
+
+// RotateSessionRefreshToken заменяет токен обновления неотозванной сессии, если ее текущий токен все еще oldHash,
+// и продлевает сессию до expiresAt. Возвращает false, если токен уже был заменен или сессия отозвана
+func (d *InDBRepo) RotateSessionRefreshToken(ctx context.Context, sessionID uuid.UUID, oldHash, newHash []byte, expiresAt time.Time) (bool, error) {
+	const sqlQuery = `UPDATE sessions SET refresh_token_hash = $3, expires_at = $4
+WHERE id = $1 AND refresh_token_hash = $2 AND revoked_at IS NULL`
+	tag, err := d.conn(ctx).Exec(ctx, sqlQuery, sessionID, oldHash, newHash, expiresAt)
+	if err != nil {
+		logrus.Error("session refresh token don't update in database ", err)
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// RevokeSession отзывает сессию
+func (d *InDBRepo) RevokeSession(ctx context.Context, sessionID uuid.UUID) error {
+	const sqlQuery = `UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE id = $1 AND revoked_at IS NULL`
+	_, err := d.conn(ctx).Exec(ctx, sqlQuery, sessionID)
+	if err != nil {
+		logrus.Error("session don't revoke in database ", err)
+		return err
+	}
+	return nil
+}
+
+// RevokeUserSessions отзывает все сессии пользователя, кроме exceptSessionID (uuid.Nil - отозвать все)
+func (d *InDBRepo) RevokeUserSessions(ctx context.Context, userID, exceptSessionID uuid.UUID) error {
+	const sqlQuery = `UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE uuid = $1 AND id <> $2 AND revoked_at IS NULL`
+	_, err := d.conn(ctx).Exec(ctx, sqlQuery, userID, exceptSessionID)
+	if err != nil {
+		logrus.Error("user sessions don't revoke in database ", err)
+		return err
+	}
+	return nil
+}
+
+// GetUserByID возвращает учетную запись пользователя по его UUID
+func (d *InDBRepo) GetUserByID(ctx context.Context, userID uuid.UUID) (models.User, error) {
+	const selectQuery = `SELECT uuid, login, hashed_password, role, date FROM users WHERE uuid = $1`
+	var user models.User
+	err := d.conn(ctx).QueryRow(ctx, selectQuery, userID).Scan(&user.ID, &user.Login, &user.HashedPassword, &user.Role,
+		&user.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return models.User{}, fmt.Errorf("the userID not found: %w", customerrors.ErrNotFound)
+		}
+		logrus.Errorf("error querying for user: %s", err)
+		return models.User{}, fmt.Errorf("error querying for user: %w", err)
+	}
+	return user, nil
+}
+
+// SetUserRole назначает пользователю роль
+func (d *InDBRepo) SetUserRole(ctx context.Context, userID uuid.UUID, role string) error {
+	const sqlQuery = `UPDATE users SET role = $2 WHERE uuid = $1`
+	tag, err := d.conn(ctx).Exec(ctx, sqlQuery, userID, role)
+	if err != nil {
+		logrus.Error("user role don't update in database ", err)
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("the userID not found: %w", customerrors.ErrNotFound)
+	}
+	return nil
+}
+
+// UpdateUserPassword заменяет хешированный пароль пользователя
+func (d *InDBRepo) UpdateUserPassword(ctx context.Context, userID uuid.UUID, hashedPassword []byte) error {
+	const sqlQuery = `UPDATE users SET hashed_password = $2 WHERE uuid = $1`
+	tag, err := d.conn(ctx).Exec(ctx, sqlQuery, userID, hashedPassword)
+	if err != nil {
+		logrus.Error("user password don't update in database ", err)
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("the userID not found: %w", customerrors.ErrNotFound)
+	}
+	return nil
+}
+
+// StorePasswordResetToken сохраняет новый токен сброса пароля, делая недействительными
+// ранее выданные и еще не использованные токены пользователя
+func (d *InDBRepo) StorePasswordResetToken(ctx context.Context, token models.PasswordResetToken) error {
+	const updateQuery = `UPDATE password_reset_tokens SET used_at = CURRENT_TIMESTAMP WHERE uuid = $1 AND used_at IS NULL`
+	const insertQuery = `INSERT INTO password_reset_tokens (token_hash, uuid, date, expires_at) VALUES ($1, $2, $3, $4)`
+	if _, err := d.conn(ctx).Exec(ctx, updateQuery, token.UserID); err != nil {
+		logrus.Error("password reset tokens don't invalidate in database ", err)
+		return err
+	}
+	if _, err := d.conn(ctx).Exec(ctx, insertQuery, token.TokenHash, token.UserID, token.CreatedAt, token.ExpiresAt); err != nil {
+		logrus.Error("password reset token don't save in database ", err)
+		return err
+	}
+	return nil
+}
+
+// GetPasswordResetTokenUser возвращает UUID пользователя действующего на момент now токена сброса пароля,
+// не помечая токен использованным
+func (d *InDBRepo) GetPasswordResetTokenUser(ctx context.Context, tokenHash []byte, now time.Time) (uuid.UUID, error) {
+	const selectQuery = `SELECT uuid FROM password_reset_tokens WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2`
+	var userID uuid.UUID
+	err := d.conn(ctx).QueryRow(ctx, selectQuery, tokenHash, now).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return uuid.Nil, fmt.Errorf("the password reset token not found: %w", customerrors.ErrNotFound)
+		}
+		logrus.Error(err)
+		return uuid.Nil, err
+	}
+	return userID, nil
+}
+
+// UsePasswordResetToken помечает использованным действующий на момент now токен сброса пароля
+// и возвращает UUID его пользователя. Каждый токен может быть использован только один раз
+func (d *InDBRepo) UsePasswordResetToken(ctx context.Context, tokenHash []byte, now time.Time) (uuid.UUID, error) {
+	const sqlQuery = `UPDATE password_reset_tokens SET used_at = $2
+WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2 RETURNING uuid`
+	var userID uuid.UUID
+	err := d.conn(ctx).QueryRow(ctx, sqlQuery, tokenHash, now).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return uuid.Nil, fmt.Errorf("the password reset token not found: %w", customerrors.ErrNotFound)
+		}
+		logrus.Error("password reset token don't use in database ", err)
+		return uuid.Nil, err
+	}
+	return userID, nil
+}
+
+// GetUserTOTP возвращает настройки двухфакторной аутентификации пользователя
+func (d *InDBRepo) GetUserTOTP(ctx context.Context, userID uuid.UUID) (models.UserTOTP, error) {
+	const selectQuery = `SELECT uuid, secret, date, enabled_at, last_used_step FROM user_totp WHERE uuid = $1`
+	var userTOTP models.UserTOTP
+	err := d.conn(ctx).QueryRow(ctx, selectQuery, userID).Scan(&userTOTP.UserID, &userTOTP.Secret, &userTOTP.CreatedAt,
+		&userTOTP.EnabledAt, &userTOTP.LastUsedStep)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return models.UserTOTP{}, fmt.Errorf("the user TOTP not found: %w", customerrors.ErrNotFound)
+		}
+		logrus.Errorf("error querying for user TOTP: %s", err)
+		return models.UserTOTP{}, fmt.Errorf("error querying for user TOTP: %w", err)
+	}
+	return userTOTP, nil
+}
+
+// StoreUserTOTP сохраняет новый неподтвержденный секрет TOTP пользователя, заменяя предыдущий неподтвержденный.
+// Возвращает false, если двухфакторная аутентификация пользователя уже включена
+func (d *InDBRepo) StoreUserTOTP(ctx context.Context, userTOTP models.UserTOTP) (bool, error) {
+	const sqlQuery = `INSERT INTO user_totp (uuid, secret, date) VALUES ($1, $2, $3)
+ON CONFLICT (uuid) DO UPDATE SET secret = EXCLUDED.secret, date = EXCLUDED.date, last_used_step = 0
+WHERE user_totp.enabled_at IS NULL`
+	tag, err := d.conn(ctx).Exec(ctx, sqlQuery, userTOTP.UserID, userTOTP.Secret, userTOTP.CreatedAt)
+	if err != nil {
+		logrus.Error("user TOTP don't save in database ", err)
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// EnableUserTOTP включает двухфакторную аутентификацию, если неподтвержденный секрет пользователя все еще secret,
+// и запоминает интервал step подтверждающего кода как использованный
+func (d *InDBRepo) EnableUserTOTP(ctx context.Context, userID uuid.UUID, secret string, step int64) (bool, error) {
+	const sqlQuery = `UPDATE user_totp SET enabled_at = CURRENT_TIMESTAMP, last_used_step = $3
+WHERE uuid = $1 AND secret = $2 AND enabled_at IS NULL`
+	tag, err := d.conn(ctx).Exec(ctx, sqlQuery, userID, secret, step)
+	if err != nil {
+		logrus.Error("user TOTP don't enable in database ", err)
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// UseTOTPStep отмечает интервал step как использованный, если он новее последнего использованного.
+// Возвращает false, если код этого интервала уже был принят
+func (d *InDBRepo) UseTOTPStep(ctx context.Context, userID uuid.UUID, step int64) (bool, error) {
+	const sqlQuery = `UPDATE user_totp SET last_used_step = $2
+WHERE uuid = $1 AND enabled_at IS NOT NULL AND last_used_step < $2`
+	tag, err := d.conn(ctx).Exec(ctx, sqlQuery, userID, step)
+	if err != nil {
+		logrus.Error("user TOTP step don't update in database ", err)
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// DeleteUserTOTP отключает двухфакторную аутентификацию пользователя и удаляет его резервные коды
+func (d *InDBRepo) DeleteUserTOTP(ctx context.Context, userID uuid.UUID) error {
+	const deleteCodesQuery = `DELETE FROM totp_recovery_codes WHERE uuid = $1`
+	const deleteTOTPQuery = `DELETE FROM user_totp WHERE uuid = $1`
+	if _, err := d.conn(ctx).Exec(ctx, deleteCodesQuery, userID); err != nil {
+		logrus.Error("recovery codes don't delete in database ", err)
+		return err
+	}
+	if _, err := d.conn(ctx).Exec(ctx, deleteTOTPQuery, userID); err != nil {
+		logrus.Error("user TOTP don't delete in database ", err)
+		return err
+	}
+	return nil
+}
+
+// StoreRecoveryCodes заменяет резервные коды пользователя новыми
+func (d *InDBRepo) StoreRecoveryCodes(ctx context.Context, userID uuid.UUID, codeHashes [][]byte) error {
+	const deleteQuery = `DELETE FROM totp_recovery_codes WHERE uuid = $1`
+	const insertQuery = `INSERT INTO totp_recovery_codes (uuid, code_hash) SELECT $1, unnest($2::bytea[])`
+	if _, err := d.conn(ctx).Exec(ctx, deleteQuery, userID); err != nil {
+		logrus.Error("recovery codes don't delete in database ", err)
+		return err
+	}
+	if _, err := d.conn(ctx).Exec(ctx, insertQuery, userID, codeHashes); err != nil {
+		logrus.Error("recovery codes don't save in database ", err)
+		return err
+	}
+	return nil
+}
+
+// UseRecoveryCode отмечает неиспользованный резервный код пользователя как использованный.
+// Возвращает false, если такого кода нет или он уже использован
+func (d *InDBRepo) UseRecoveryCode(ctx context.Context, userID uuid.UUID, codeHash []byte) (bool, error) {
+	const sqlQuery = `UPDATE totp_recovery_codes SET used_at = CURRENT_TIMESTAMP
+WHERE uuid = $1 AND code_hash = $2 AND used_at IS NULL`
+	tag, err := d.conn(ctx).Exec(ctx, sqlQuery, userID, codeHash)
+	if err != nil {
+		logrus.Error("recovery code don't use in database ", err)
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
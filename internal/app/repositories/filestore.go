@@ -0,0 +1,295 @@
+package repositories
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// compactThreshold количество записей журнала, после которого журнал сворачивается в снимок
+const compactThreshold = 1000
+
+// fileTable таблица хранилища в памяти, которую можно сохранить в файл и восстановить из него
+type fileTable interface {
+	snapshot() ([]byte, error)
+	loadSnapshot(data []byte) error
+	restore(key string, row json.RawMessage) error
+}
+
+func (t *memTable[V]) snapshot() ([]byte, error) {
+	return json.Marshal(t.rows)
+}
+
+func (t *memTable[V]) loadSnapshot(data []byte) error {
+	return json.Unmarshal(data, &t.rows)
+}
+
+// restore повторяет сохраненное в журнале изменение строки, пустая строка означает удаление
+func (t *memTable[V]) restore(key string, row json.RawMessage) error {
+	if bytes.Equal(row, []byte("null")) {
+		delete(t.rows, key)
+		return nil
+	}
+	var value V
+	if err := json.Unmarshal(row, &value); err != nil {
+		return err
+	}
+	t.rows[key] = value
+	return nil
+}
+
+// fileSnapshot содержимое файла снимка хранилища
+type fileSnapshot struct {
+	Seq    int64                      `json:"seq"`
+	Tables map[string]json.RawMessage `json:"tables"`
+}
+
+// journalRecord запись журнала, содержит все изменения одной зафиксированной транзакции
+type journalRecord struct {
+	Seq     int64           `json:"seq"`
+	Changes []journalChange `json:"changes"`
+}
+
+type journalChange struct {
+	Table string          `json:"table"`
+	Key   string          `json:"key"`
+	Row   json.RawMessage `json:"row"`
+}
+
+// InFileRepo реализация services.Repository, которая хранит данные в памяти и сохраняет их на диск.
+// Каждая зафиксированная транзакция дописывается одной строкой в журнал <path>.journal, а после
+// compactThreshold записей и при закрытии журнал сворачивается в снимок <path>. При запуске состояние
+// восстанавливается из снимка и журнала, оборванная при сбое последняя запись журнала отбрасывается
+type InFileRepo struct {
+	*InMemoryRepo
+	path           string
+	journal        *os.File
+	journalSize    int64 // размер журнала после последней успешно записанной транзакции
+	journalRecords int
+}
+
+func NewInFileRepo(path string) (*InFileRepo, error) {
+	f := &InFileRepo{
+		InMemoryRepo: NewInMemoryRepo(),
+		path:         path,
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := f.loadSnapshot(); err != nil {
+		return nil, fmt.Errorf("load storage snapshot %s: %w", path, err)
+	}
+	if err := f.replayJournal(); err != nil {
+		return nil, fmt.Errorf("replay storage journal %s: %w", f.journalPath(), err)
+	}
+	// восстановленное состояние сразу сворачивается в снимок, чтобы начать с пустого журнала
+	if err := f.compact(); err != nil {
+		return nil, err
+	}
+	f.onCommit = f.appendJournal
+	return f, nil
+}
+
+func (f *InFileRepo) journalPath() string {
+	return f.path + ".journal"
+}
+
+func (f *InFileRepo) tables() map[string]fileTable {
+	return map[string]fileTable{
+		f.users.name:         f.users,
+		f.orders.name:        f.orders,
+		f.withdrawals.name:   f.withdrawals,
+		f.balances.name:      f.balances,
+		f.ledger.name:        f.ledger,
+		f.sessions.name:      f.sessions,
+		f.resetTokens.name:   f.resetTokens,
+		f.totp.name:          f.totp,
+		f.recoveryCodes.name: f.recoveryCodes,
+		f.orderHistory.name:  f.orderHistory,
+	}
+}
+
+// loadSnapshot загружает состояние из файла снимка, если он существует
+func (f *InFileRepo) loadSnapshot() error {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snapshot fileSnapshot
+	if err = json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	f.seq = snapshot.Seq
+	tables := f.tables()
+	for name, rows := range snapshot.Tables {
+		table, ok := tables[name]
+		if !ok {
+			return fmt.Errorf("unknown table %q", name)
+		}
+		if err = table.loadSnapshot(rows); err != nil {
+			return fmt.Errorf("table %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// replayJournal применяет к загруженному снимку записи журнала
+func (f *InFileRepo) replayJournal() error {
+	journal, err := os.Open(f.journalPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer journal.Close()
+
+	tables := f.tables()
+	reader := bufio.NewReader(journal)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(bytes.TrimSpace(line)) > 0 {
+				logrus.Warnf("discard incomplete last record of storage journal %s", f.journalPath())
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var record journalRecord
+		if err = json.Unmarshal(line, &record); err != nil {
+			return err
+		}
+		for _, change := range record.Changes {
+			table, ok := tables[change.Table]
+			if !ok {
+				return fmt.Errorf("unknown table %q", change.Table)
+			}
+			if err = table.restore(change.Key, change.Row); err != nil {
+				return fmt.Errorf("table %s: %w", change.Table, err)
+			}
+		}
+		// после сбоя между записью снимка и очисткой журнала журнал повторяется поверх снимка,
+		// поэтому счетчик идентификаторов не уменьшается
+		f.seq = max(f.seq, record.Seq)
+	}
+}
+
+// appendJournal дописывает изменения транзакции в журнал и сбрасывает его на диск,
+// вызывается под блокировкой хранилища перед фиксацией транзакции
+func (f *InFileRepo) appendJournal(tx *memTx) error {
+	record := journalRecord{Seq: f.seq, Changes: make([]journalChange, 0, len(tx.changes))}
+	for _, change := range tx.changes {
+		row, err := json.Marshal(change.Row)
+		if err != nil {
+			return err
+		}
+		record.Changes = append(record.Changes, journalChange{Table: change.Table, Key: change.Key, Row: row})
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err = f.writeJournal(append(line, '\n')); err != nil {
+		logrus.Error("storage journal write error: ", err)
+		// отбрасывается частично записанная строка, чтобы следующие записи журнала остались читаемыми
+		if truncErr := f.journal.Truncate(f.journalSize); truncErr != nil {
+			logrus.Error("storage journal truncate error: ", truncErr)
+		} else if _, seekErr := f.journal.Seek(f.journalSize, io.SeekStart); seekErr != nil {
+			logrus.Error("storage journal seek error: ", seekErr)
+		}
+		return err
+	}
+	f.journalSize += int64(len(line) + 1)
+	f.journalRecords++
+	if f.journalRecords >= compactThreshold {
+		// транзакция уже сохранена в журнале, поэтому ошибка сворачивания ее не отменяет
+		if err = f.compact(); err != nil {
+			logrus.Error("storage journal compaction error: ", err)
+		}
+	}
+	return nil
+}
+
+func (f *InFileRepo) writeJournal(line []byte) error {
+	if _, err := f.journal.Write(line); err != nil {
+		return err
+	}
+	return f.journal.Sync()
+}
+
+// compact атомарно записывает снимок текущего состояния и начинает новый пустой журнал.
+// Вызывающий должен исключить одновременные изменения хранилища
+func (f *InFileRepo) compact() error {
+	snapshot := fileSnapshot{Seq: f.seq, Tables: make(map[string]json.RawMessage)}
+	for name, table := range f.tables() {
+		rows, err := table.snapshot()
+		if err != nil {
+			return err
+		}
+		snapshot.Tables[name] = rows
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(f.path, data); err != nil {
+		return err
+	}
+
+	journal, err := os.OpenFile(f.journalPath(), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if f.journal != nil {
+		if err = f.journal.Close(); err != nil {
+			logrus.Error("storage journal close error: ", err)
+		}
+	}
+	f.journal = journal
+	f.journalSize = 0
+	f.journalRecords = 0
+	return nil
+}
+
+// Close сворачивает журнал в снимок и закрывает файлы хранилища
+func (f *InFileRepo) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.compact(); err != nil {
+		return err
+	}
+	return f.journal.Close()
+}
+
+// writeFileAtomic записывает данные во временный файл рядом с path и переименовывает его в path,
+// поэтому при сбое на диске остается либо старая, либо новая версия файла целиком
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
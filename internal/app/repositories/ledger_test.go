@@ -0,0 +1,150 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"github.com/DenisKhanov/Gophermart/internal/app/customerrors"
+	"github.com/DenisKhanov/Gophermart/internal/app/migrations"
+	"github.com/DenisKhanov/Gophermart/internal/app/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/shopspring/decimal"
+	"os"
+	"sync"
+	"testing"
+)
+
+// ledgerRepo методы репозитория, через которые сервис проводит изменения баланса
+type ledgerRepo interface {
+	WithTx(ctx context.Context, fn func(ctx context.Context) error) error
+	StoreNewUser(ctx context.Context, userID uuid.UUID, login string, hashedPassword []byte) error
+	StoreNewUserBalance(ctx context.Context, userID uuid.UUID) error
+	AppendLedgerEntry(ctx context.Context, entry *models.LedgerEntry) error
+	GetUserLedger(ctx context.Context, userID uuid.UUID) ([]models.LedgerEntry, error)
+	GetUserBalance(ctx context.Context, userID uuid.UUID) (decimal.Decimal, error)
+}
+
+func TestInMemoryRepoLedgerConcurrency(t *testing.T) {
+	testLedgerConcurrency(t, NewInMemoryRepo())
+}
+
+// TestInDBRepoLedgerConcurrency выполняется, только если в TEST_DATABASE_URI задана тестовая база данных
+func TestInDBRepoLedgerConcurrency(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URI")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URI is not set")
+	}
+	ctx := context.Background()
+	dbPool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbPool.Close()
+	migrator, err := migrations.NewMigrator(dbPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = migrator.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	testLedgerConcurrency(t, NewURLInDBRepo(dbPool))
+}
+
+// testLedgerConcurrency параллельно проводит начисления и списания по одному пользователю и проверяет,
+// что ни одно изменение не потеряно, а баланс ни разу не стал отрицательным
+func testLedgerConcurrency(t *testing.T, repo ledgerRepo) {
+	const (
+		workers     = 50
+		accrual     = "5.25"
+		withdrawal  = "10.50"
+		initialSeed = "100"
+	)
+	ctx := context.Background()
+	userID := uuid.New()
+	if err := repo.StoreNewUser(ctx, userID, "ledger-test-"+userID.String(), []byte("hash")); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.StoreNewUserBalance(ctx, userID); err != nil {
+		t.Fatal(err)
+	}
+	appendEntry := func(entryType, contraAccount, amount string) error {
+		entry := &models.LedgerEntry{
+			UserID:        userID,
+			Type:          entryType,
+			Amount:        decimal.RequireFromString(amount),
+			ContraAccount: contraAccount,
+		}
+		return repo.WithTx(ctx, func(ctx context.Context) error {
+			return repo.AppendLedgerEntry(ctx, entry)
+		})
+	}
+	if err := appendEntry(models.LedgerEntryAccrual, models.AccountAccrual, initialSeed); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		applied  = decimal.RequireFromString(initialSeed)
+		rejected int
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := appendEntry(models.LedgerEntryAccrual, models.AccountAccrual, accrual); err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			applied = applied.Add(decimal.RequireFromString(accrual))
+			mu.Unlock()
+		}()
+		go func() {
+			defer wg.Done()
+			err := appendEntry(models.LedgerEntryWithdrawal, models.AccountWithdrawals, "-"+withdrawal)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case errors.Is(err, customerrors.ErrNotEnoughFunds):
+				rejected++
+			case err != nil:
+				t.Error(err)
+			default:
+				applied = applied.Sub(decimal.RequireFromString(withdrawal))
+			}
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	balance, err := repo.GetUserBalance(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := repo.GetUserLedger(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ledgerSum := decimal.Zero
+	for _, entry := range entries {
+		ledgerSum = ledgerSum.Add(entry.Amount)
+		if entry.BalanceAfter.IsNegative() {
+			t.Errorf("entry %d left negative balance %s", entry.ID, entry.BalanceAfter)
+		}
+	}
+	if want := 1 + 2*workers - rejected; len(entries) != want {
+		t.Errorf("ledger has %d entries, want %d", len(entries), want)
+	}
+	if !balance.Equal(ledgerSum) {
+		t.Errorf("balance %s, sum of ledger entries %s", balance, ledgerSum)
+	}
+	if !balance.Equal(applied) {
+		t.Errorf("balance %s, sum of applied changes %s", balance, applied)
+	}
+	if balance.IsNegative() {
+		t.Errorf("negative balance %s", balance)
+	}
+}
@@ -0,0 +1,1037 @@
+package repositories
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"github.com/DenisKhanov/Gophermart/internal/app/customerrors"
+	"github.com/DenisKhanov/Gophermart/internal/app/models"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Строки таблиц хранилища в памяти. Хранятся по значению, чтобы журнал отмены транзакции мог восстановить
+// прежнее состояние строки
+type (
+	memUser struct {
+		UserID         uuid.UUID `json:"uuid"`
+		Login          string    `json:"login"`
+		HashedPassword []byte    `json:"hashed_password"`
+		Role           string    `json:"role"`
+		CreatedAt      time.Time `json:"date"`
+	}
+	memOrder struct {
+		ID            int64            `json:"id"`
+		Number        string           `json:"order_number"`
+		UserID        uuid.UUID        `json:"uuid"`
+		Accrual       *decimal.Decimal `json:"accrual"`
+		Status        string           `json:"status"`
+		UploadedAt    time.Time        `json:"date"`
+		CheckAttempts int              `json:"check_attempts"`
+		NextCheckAt   time.Time        `json:"next_check_at"`
+	}
+	memOrderStatus struct {
+		ID          int64            `json:"id"`
+		OrderNumber string           `json:"order_number"`
+		Status      string           `json:"status"`
+		Accrual     *decimal.Decimal `json:"accrual"`
+		CreatedAt   time.Time        `json:"date"`
+	}
+	memWithdrawal struct {
+		ID             int64           `json:"id"`
+		Order          string          `json:"order_number"`
+		UserID         uuid.UUID       `json:"uuid"`
+		Sum            decimal.Decimal `json:"sum"`
+		ProcessedAt    time.Time       `json:"date"`
+		IdempotencyKey string          `json:"idempotency_key"`
+	}
+	memBalance struct {
+		UserID  uuid.UUID       `json:"uuid"`
+		Balance decimal.Decimal `json:"user_balance"`
+	}
+	memSession struct {
+		ID               uuid.UUID  `json:"id"`
+		UserID           uuid.UUID  `json:"uuid"`
+		RefreshTokenHash []byte     `json:"refresh_token_hash"`
+		CreatedAt        time.Time  `json:"date"`
+		ExpiresAt        time.Time  `json:"expires_at"`
+		RevokedAt        *time.Time `json:"revoked_at"`
+	}
+	memResetToken struct {
+		TokenHash []byte     `json:"token_hash"`
+		UserID    uuid.UUID  `json:"uuid"`
+		CreatedAt time.Time  `json:"date"`
+		ExpiresAt time.Time  `json:"expires_at"`
+		UsedAt    *time.Time `json:"used_at"`
+	}
+	memTOTP struct {
+		UserID       uuid.UUID  `json:"uuid"`
+		Secret       string     `json:"secret"`
+		CreatedAt    time.Time  `json:"date"`
+		EnabledAt    *time.Time `json:"enabled_at"`
+		LastUsedStep int64      `json:"last_used_step"`
+	}
+	memRecoveryCode struct {
+		UserID   uuid.UUID  `json:"uuid"`
+		CodeHash []byte     `json:"code_hash"`
+		UsedAt   *time.Time `json:"used_at"`
+	}
+	memLedgerEntry struct {
+		ID            int64           `json:"id"`
+		UserID        uuid.UUID       `json:"uuid"`
+		Type          string          `json:"entry_type"`
+		Amount        decimal.Decimal `json:"amount"`
+		BalanceAfter  decimal.Decimal `json:"balance_after"`
+		ContraAccount string          `json:"contra_account"`
+		OrderNumber   string          `json:"order_number"`
+		Reason        string          `json:"reason"`
+		Actor         string          `json:"actor"`
+		CreatedAt     time.Time       `json:"date"`
+	}
+)
+
+func (u memUser) toModel() models.User {
+	role := u.Role
+	// пользователи, сохраненные до появления ролей
+	if role == "" {
+		role = models.RoleUser
+	}
+	return models.User{ID: u.UserID, Login: u.Login, HashedPassword: u.HashedPassword, Role: role, CreatedAt: u.CreatedAt}
+}
+
+// memTable таблица хранилища в памяти, строки которой доступны по первичному ключу
+type memTable[V any] struct {
+	name string
+	rows map[string]V
+}
+
+func newMemTable[V any](name string) *memTable[V] {
+	return &memTable[V]{name: name, rows: make(map[string]V)}
+}
+
+// get возвращает строку по ключу
+func (t *memTable[V]) get(key string) (V, bool) {
+	row, ok := t.rows[key]
+	return row, ok
+}
+
+// put сохраняет строку по ключу в рамках транзакции tx, запоминая прежнее состояние для отката
+func (t *memTable[V]) put(tx *memTx, key string, row V) {
+	old, existed := t.rows[key]
+	t.rows[key] = row
+	tx.undo = append(tx.undo, func() {
+		if existed {
+			t.rows[key] = old
+			return
+		}
+		delete(t.rows, key)
+	})
+	tx.changes = append(tx.changes, memChange{Table: t.name, Key: key, Row: row})
+}
+
+// del удаляет строку по ключу в рамках транзакции tx, в журнале изменений удаление записывается пустой строкой
+func (t *memTable[V]) del(tx *memTx, key string) {
+	old, existed := t.rows[key]
+	if !existed {
+		return
+	}
+	delete(t.rows, key)
+	tx.undo = append(tx.undo, func() {
+		t.rows[key] = old
+	})
+	tx.changes = append(tx.changes, memChange{Table: t.name, Key: key, Row: nil})
+}
+
+// filter возвращает все строки, для которых match вернула true
+func (t *memTable[V]) filter(match func(V) bool) []V {
+	var rows []V
+	for _, row := range t.rows {
+		if match(row) {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// memChange измененная в транзакции строка таблицы
+type memChange struct {
+	Table string `json:"table"`
+	Key   string `json:"key"`
+	Row   any    `json:"row"`
+}
+
+// memTx транзакция хранилища в памяти, хранит журнал отмены и список выполненных в ней изменений
+type memTx struct {
+	undo    []func()
+	changes []memChange
+}
+
+// rollback отменяет изменения транзакции в обратном порядке
+func (tx *memTx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	tx.undo = nil
+	tx.changes = nil
+}
+
+// memTxKey ключ контекста, под которым WithTx хранит открытую транзакцию хранилища в памяти
+type memTxKey struct{}
+
+func memTxFromContext(ctx context.Context) *memTx {
+	tx, _ := ctx.Value(memTxKey{}).(*memTx)
+	return tx
+}
+
+// InMemoryRepo потокобезопасная реализация services.Repository, хранящая все данные в памяти процесса.
+// Повторяет семантику InDBRepo: уникальные ключи, условное обновление заказов, запрет отрицательного баланса
+type InMemoryRepo struct {
+	mu          sync.RWMutex
+	seq         int64 // последний выданный идентификатор строки
+	users       *memTable[memUser]
+	orders      *memTable[memOrder]
+	withdrawals *memTable[memWithdrawal]
+	balances    *memTable[memBalance]
+	ledger      *memTable[memLedgerEntry]
+	sessions    *memTable[memSession]
+	resetTokens *memTable[memResetToken]
+	totp        *memTable[memTOTP]
+	// резервные коды двухфакторной аутентификации по ключу "<uuid>:<hex хеша кода>"
+	recoveryCodes *memTable[memRecoveryCode]
+	// история статусов заказов по ключу идентификатора записи
+	orderHistory *memTable[memOrderStatus]
+	// onCommit вызывается под блокировкой перед фиксацией транзакции, ошибка откатывает транзакцию
+	onCommit func(tx *memTx) error
+}
+
+func NewInMemoryRepo() *InMemoryRepo {
+	return &InMemoryRepo{
+		users:         newMemTable[memUser]("users"),
+		orders:        newMemTable[memOrder]("orders"),
+		withdrawals:   newMemTable[memWithdrawal]("withdrawals"),
+		balances:      newMemTable[memBalance]("balance"),
+		ledger:        newMemTable[memLedgerEntry]("ledger"),
+		sessions:      newMemTable[memSession]("sessions"),
+		resetTokens:   newMemTable[memResetToken]("password_reset_tokens"),
+		totp:          newMemTable[memTOTP]("user_totp"),
+		recoveryCodes: newMemTable[memRecoveryCode]("totp_recovery_codes"),
+		orderHistory:  newMemTable[memOrderStatus]("order_status_history"),
+	}
+}
+
+// WithTx выполняет fn как единицу работы. На время выполнения хранилище блокируется на запись, а если fn
+// вернула ошибку или запаниковала, все изменения, сделанные с переданным в fn контекстом, откатываются.
+// Если транзакция уже открыта, fn выполняется в ней же
+func (r *InMemoryRepo) WithTx(ctx context.Context, fn func(ctx context.Context) error) (err error) {
+	if memTxFromContext(ctx) != nil {
+		return fn(ctx)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tx := &memTx{}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.rollback()
+			panic(p)
+		}
+		if err == nil && r.onCommit != nil && len(tx.changes) > 0 {
+			err = r.onCommit(tx)
+		}
+		if err != nil {
+			tx.rollback()
+		}
+	}()
+	return fn(context.WithValue(ctx, memTxKey{}, tx))
+}
+
+// read выполняет fn под блокировкой на чтение, если вызов происходит не внутри транзакции
+func (r *InMemoryRepo) read(ctx context.Context, fn func()) {
+	if memTxFromContext(ctx) == nil {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+	}
+	fn()
+}
+
+// write выполняет fn в открытой транзакции или, если ее нет, в отдельной транзакции
+func (r *InMemoryRepo) write(ctx context.Context, fn func(tx *memTx) error) error {
+	if tx := memTxFromContext(ctx); tx != nil {
+		return fn(tx)
+	}
+	return r.WithTx(ctx, func(ctx context.Context) error {
+		return fn(memTxFromContext(ctx))
+	})
+}
+
+// nextID выдает следующий идентификатор строки, как и последовательности Postgres, не откатывается
+func (r *InMemoryRepo) nextID() int64 {
+	r.seq++
+	return r.seq
+}
+
+// StoreNewUser сохраняет нового пользователя или возвращает customerrors.ErrUserAlreadyTaken, если логин уже занят
+func (r *InMemoryRepo) StoreNewUser(ctx context.Context, userID uuid.UUID, login string, hashedPassword []byte) error {
+	return r.write(ctx, func(tx *memTx) error {
+		if _, ok := r.users.get(login); ok {
+			return customerrors.ErrUserAlreadyTaken
+		}
+		r.users.put(tx, login, memUser{UserID: userID, Login: login, HashedPassword: hashedPassword, Role: models.RoleUser, CreatedAt: time.Now()})
+		return nil
+	})
+}
+
+// StoreNewUserBalance создает нулевой баланс пользователя
+func (r *InMemoryRepo) StoreNewUserBalance(ctx context.Context, userID uuid.UUID) error {
+	return r.write(ctx, func(tx *memTx) error {
+		if _, ok := r.balances.get(userID.String()); ok {
+			return fmt.Errorf("balance of user %s already exists", userID)
+		}
+		r.balances.put(tx, userID.String(), memBalance{UserID: userID, Balance: decimal.Zero})
+		return nil
+	})
+}
+
+// StoreUserOrder сохраняет новый заказ пользователя без начисления или возвращает ошибку, если номер уже загружен
+func (r *InMemoryRepo) StoreUserOrder(ctx context.Context, orderNumber, orderStatus string, userID uuid.UUID) error {
+	stored, err := r.StoreUserOrderIfNew(ctx, orderNumber, orderStatus, userID)
+	if err == nil && !stored {
+		return fmt.Errorf("order %s already exists", orderNumber)
+	}
+	return err
+}
+
+// StoreUserOrderIfNew сохраняет новый заказ пользователя без начисления, если номер еще не загружен
+func (r *InMemoryRepo) StoreUserOrderIfNew(ctx context.Context, orderNumber, orderStatus string, userID uuid.UUID) (bool, error) {
+	var stored bool
+	err := r.write(ctx, func(tx *memTx) error {
+		if _, ok := r.orders.get(orderNumber); ok {
+			return nil
+		}
+		now := time.Now()
+		r.orders.put(tx, orderNumber, memOrder{
+			ID:          r.nextID(),
+			Number:      orderNumber,
+			UserID:      userID,
+			Status:      orderStatus,
+			UploadedAt:  now,
+			NextCheckAt: now,
+		})
+		r.appendOrderStatus(tx, orderNumber, orderStatus, nil, now)
+		stored = true
+		return nil
+	})
+	return stored, err
+}
+
+// GetUUIDFromUsers возвращает userID по логину
+func (r *InMemoryRepo) GetUUIDFromUsers(ctx context.Context, login string) (userID uuid.UUID, err error) {
+	r.read(ctx, func() {
+		user, ok := r.users.get(login)
+		if !ok {
+			err = fmt.Errorf("login not found: %w", customerrors.ErrNotFound)
+			return
+		}
+		userID = user.UserID
+	})
+	return userID, err
+}
+
+// GetUserHashPassword возвращает хешированный пароль пользователя по логину
+func (r *InMemoryRepo) GetUserHashPassword(ctx context.Context, login string) (hashedPassword []byte, err error) {
+	r.read(ctx, func() {
+		user, ok := r.users.get(login)
+		if !ok {
+			err = fmt.Errorf("login not found: %w", customerrors.ErrNotFound)
+			return
+		}
+		hashedPassword = user.HashedPassword
+	})
+	return hashedPassword, err
+}
+
+// GetUUIDFromOrders возвращает userID владельца заказа по номеру заказа
+func (r *InMemoryRepo) GetUUIDFromOrders(ctx context.Context, orderNumber string) (userID uuid.UUID, err error) {
+	r.read(ctx, func() {
+		order, ok := r.orders.get(orderNumber)
+		if !ok {
+			err = fmt.Errorf("the order number not found: %w", customerrors.ErrNotFound)
+			return
+		}
+		userID = order.UserID
+	})
+	return userID, err
+}
+
+// UpdateOrders обновляет статус и начисление заказов, если статус действительно меняется и еще не является
+// окончательным, возвращает список фактически обновленных заказов с UUID их владельцев
+func (r *InMemoryRepo) UpdateOrders(ctx context.Context, updatedOrders []models.AccrualResponseData) ([]models.AccrualResponseData, error) {
+	var appliedOrders []models.AccrualResponseData
+	err := r.write(ctx, func(tx *memTx) error {
+		for _, order := range updatedOrders {
+			saved, ok := r.orders.get(order.Order)
+			if !ok || saved.Status == order.Status || isFinalOrderStatus(saved.Status) {
+				continue
+			}
+			saved.Status = order.Status
+			saved.Accrual = roundAmount(order.Accrual)
+			r.orders.put(tx, saved.Number, saved)
+			r.appendOrderStatus(tx, saved.Number, saved.Status, saved.Accrual, time.Now())
+			order.UserID = saved.UserID
+			appliedOrders = append(appliedOrders, order)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return appliedOrders, nil
+}
+
+// appendOrderStatus сохраняет переход заказа в новый статус в истории статусов
+func (r *InMemoryRepo) appendOrderStatus(tx *memTx, orderNumber, status string, accrual *decimal.Decimal, at time.Time) {
+	id := r.nextID()
+	r.orderHistory.put(tx, fmt.Sprint(id), memOrderStatus{
+		ID:          id,
+		OrderNumber: orderNumber,
+		Status:      status,
+		Accrual:     accrual,
+		CreatedAt:   at,
+	})
+}
+
+// GetOrder возвращает заказ по номеру вместе с UUID владельца и расписанием его проверки в accrual
+func (r *InMemoryRepo) GetOrder(ctx context.Context, orderNumber string) (order models.UserOrder, err error) {
+	r.read(ctx, func() {
+		saved, ok := r.orders.get(orderNumber)
+		if !ok {
+			err = fmt.Errorf("the order number not found: %w", customerrors.ErrNotFound)
+			return
+		}
+		order = models.UserOrder{
+			ID:            saved.ID,
+			UserID:        saved.UserID,
+			Number:        saved.Number,
+			Status:        saved.Status,
+			Accrual:       saved.Accrual,
+			UploadedAt:    saved.UploadedAt,
+			CheckAttempts: saved.CheckAttempts,
+			NextCheckAt:   saved.NextCheckAt,
+		}
+	})
+	return order, err
+}
+
+// GetOrderStatusHistory возвращает все изменения статуса заказа в порядке их сохранения
+func (r *InMemoryRepo) GetOrderStatusHistory(ctx context.Context, orderNumber string) ([]models.OrderStatusChange, error) {
+	var saved []memOrderStatus
+	r.read(ctx, func() {
+		saved = r.orderHistory.filter(func(change memOrderStatus) bool { return change.OrderNumber == orderNumber })
+	})
+	sort.Slice(saved, func(i, j int) bool { return saved[i].ID < saved[j].ID })
+	var history []models.OrderStatusChange
+	for _, change := range saved {
+		history = append(history, models.OrderStatusChange{Status: change.Status, Accrual: change.Accrual, ChangedAt: change.CreatedAt})
+	}
+	return history, nil
+}
+
+// ClaimDueOrders захватывает не более limit заказов без финального статуса, у которых подошло время проверки,
+// начиная с самых давно ожидающих, и сдвигает им время проверки на lease
+func (r *InMemoryRepo) ClaimDueOrders(ctx context.Context, limit int, lease time.Duration) ([]models.UserOrder, error) {
+	var orders []models.UserOrder
+	err := r.write(ctx, func(tx *memTx) error {
+		now := time.Now()
+		due := r.orders.filter(func(order memOrder) bool {
+			return !isFinalOrderStatus(order.Status) && !order.NextCheckAt.After(now)
+		})
+		sort.Slice(due, func(i, j int) bool {
+			if due[i].NextCheckAt.Equal(due[j].NextCheckAt) {
+				return due[i].ID < due[j].ID
+			}
+			return due[i].NextCheckAt.Before(due[j].NextCheckAt)
+		})
+		if len(due) > limit {
+			due = due[:limit]
+		}
+		for _, order := range due {
+			order.NextCheckAt = now.Add(lease)
+			r.orders.put(tx, order.Number, order)
+			orders = append(orders, models.UserOrder{
+				Number:        order.Number,
+				Status:        order.Status,
+				UserID:        order.UserID,
+				CheckAttempts: order.CheckAttempts,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// ScheduleOrdersCheck сохраняет количество попыток и время следующей проверки заказов в accrual
+func (r *InMemoryRepo) ScheduleOrdersCheck(ctx context.Context, orders []models.UserOrder) error {
+	return r.write(ctx, func(tx *memTx) error {
+		for _, order := range orders {
+			saved, ok := r.orders.get(order.Number)
+			if !ok {
+				continue
+			}
+			saved.CheckAttempts = order.CheckAttempts
+			saved.NextCheckAt = order.NextCheckAt
+			r.orders.put(tx, saved.Number, saved)
+		}
+		return nil
+	})
+}
+
+// GetUserOrders возвращает заказы пользователя, подходящие под условия фильтра, в порядке загрузки
+func (r *InMemoryRepo) GetUserOrders(ctx context.Context, userID uuid.UUID, filter models.OrderFilter) ([]models.UserOrder, error) {
+	filter.UserID = &userID
+	var orders []models.UserOrder
+	r.read(ctx, func() {
+		for _, order := range r.findOrders(filter) {
+			orders = append(orders, models.UserOrder{
+				ID:         order.ID,
+				Number:     order.Number,
+				Status:     order.Status,
+				Accrual:    order.Accrual,
+				UploadedAt: order.UploadedAt,
+			})
+		}
+	})
+	return orders, nil
+}
+
+// FindOrders возвращает заказы всех пользователей, подходящие под условия фильтра
+func (r *InMemoryRepo) FindOrders(ctx context.Context, filter models.OrderFilter) ([]models.AdminOrder, error) {
+	var orders []models.AdminOrder
+	r.read(ctx, func() {
+		saved := r.findOrders(filter)
+		logins := make(map[uuid.UUID]string)
+		for _, user := range r.users.filter(func(memUser) bool { return true }) {
+			logins[user.UserID] = user.Login
+		}
+		for _, order := range saved {
+			orders = append(orders, models.AdminOrder{
+				UserID:        order.UserID,
+				Login:         logins[order.UserID],
+				Number:        order.Number,
+				Status:        order.Status,
+				Accrual:       order.Accrual,
+				UploadedAt:    order.UploadedAt,
+				CheckAttempts: order.CheckAttempts,
+				NextCheckAt:   order.NextCheckAt,
+			})
+		}
+	})
+	return orders, nil
+}
+
+// findOrders возвращает страницу заказов, подходящих под условия фильтра. Вызывается под блокировкой хранилища
+func (r *InMemoryRepo) findOrders(filter models.OrderFilter) []memOrder {
+	saved := r.orders.filter(func(order memOrder) bool {
+		return (filter.UserID == nil || order.UserID == *filter.UserID) &&
+			(len(filter.Statuses) == 0 || slices.Contains(filter.Statuses, order.Status)) &&
+			inTimeRange(order.UploadedAt, filter.From, filter.To)
+	})
+	return pageRows(saved, func(order memOrder) int64 { return order.ID }, filter.Page)
+}
+
+// RescheduleOrderCheck назначает немедленную проверку заказа без финального статуса и сбрасывает счетчик попыток.
+// Возвращает false, если статус заказа уже окончательный
+func (r *InMemoryRepo) RescheduleOrderCheck(ctx context.Context, orderNumber string) (bool, error) {
+	var rescheduled bool
+	err := r.write(ctx, func(tx *memTx) error {
+		order, ok := r.orders.get(orderNumber)
+		if !ok {
+			return fmt.Errorf("the order number not found: %w", customerrors.ErrNotFound)
+		}
+		if isFinalOrderStatus(order.Status) {
+			return nil
+		}
+		order.CheckAttempts = 0
+		order.NextCheckAt = time.Now()
+		r.orders.put(tx, order.Number, order)
+		rescheduled = true
+		return nil
+	})
+	return rescheduled, err
+}
+
+// StoreUserWithdrawal сохраняет новое списание пользователя. Если у пользователя уже есть списание с тем же
+// номером заказа или ключом идемпотентности, ничего не сохраняет и возвращает false
+func (r *InMemoryRepo) StoreUserWithdrawal(ctx context.Context, userID uuid.UUID, orderNumber string, sum decimal.Decimal, idempotencyKey string) (bool, error) {
+	var stored bool
+	err := r.write(ctx, func(tx *memTx) error {
+		conflicts := r.withdrawals.filter(func(w memWithdrawal) bool {
+			return w.UserID == userID && (w.Order == orderNumber || idempotencyKey != "" && w.IdempotencyKey == idempotencyKey)
+		})
+		if len(conflicts) > 0 {
+			return nil
+		}
+		id := r.nextID()
+		r.withdrawals.put(tx, fmt.Sprint(id), memWithdrawal{
+			ID:             id,
+			Order:          orderNumber,
+			UserID:         userID,
+			Sum:            sum.Round(2),
+			ProcessedAt:    time.Now(),
+			IdempotencyKey: idempotencyKey,
+		})
+		stored = true
+		return nil
+	})
+	return stored, err
+}
+
+// GetUserWithdrawal возвращает списание пользователя с указанным ключом идемпотентности или, если такого нет,
+// с указанным номером заказа
+func (r *InMemoryRepo) GetUserWithdrawal(ctx context.Context, userID uuid.UUID, orderNumber, idempotencyKey string) (withdrawal models.UserWithdrawal, err error) {
+	r.read(ctx, func() {
+		var byOrder, byKey *memWithdrawal
+		for _, w := range r.withdrawals.filter(func(w memWithdrawal) bool { return w.UserID == userID }) {
+			w := w
+			if idempotencyKey != "" && w.IdempotencyKey == idempotencyKey {
+				byKey = &w
+			} else if w.Order == orderNumber {
+				byOrder = &w
+			}
+		}
+		found := byKey
+		if found == nil {
+			found = byOrder
+		}
+		if found == nil {
+			err = fmt.Errorf("the withdrawal not found: %w", customerrors.ErrNotFound)
+			return
+		}
+		withdrawal = found.toModel()
+	})
+	return withdrawal, err
+}
+
+// AppendLedgerEntry изменяет баланс пользователя на entry.Amount и сохраняет запись журнала. Если после
+// проведения баланс стал бы отрицательным, возвращает customerrors.ErrNotEnoughFunds.
+// Заполняет ID, BalanceAfter и CreatedAt сохраненной записи
+func (r *InMemoryRepo) AppendLedgerEntry(ctx context.Context, entry *models.LedgerEntry) error {
+	return r.write(ctx, func(tx *memTx) error {
+		balance, ok := r.balances.get(entry.UserID.String())
+		amount := entry.Amount.Round(2)
+		if !ok || balance.Balance.Add(amount).IsNegative() {
+			return customerrors.ErrNotEnoughFunds
+		}
+		balance.Balance = balance.Balance.Add(amount)
+		r.balances.put(tx, balance.UserID.String(), balance)
+
+		entry.Amount = amount
+		entry.BalanceAfter = balance.Balance
+		entry.ID = r.nextID()
+		entry.CreatedAt = time.Now()
+		r.ledger.put(tx, fmt.Sprint(entry.ID), memLedgerEntry(*entry))
+		return nil
+	})
+}
+
+// GetUserLedger возвращает все записи журнала движения баллов пользователя в порядке их проведения
+func (r *InMemoryRepo) GetUserLedger(ctx context.Context, userID uuid.UUID) ([]models.LedgerEntry, error) {
+	var saved []memLedgerEntry
+	r.read(ctx, func() {
+		saved = r.ledger.filter(func(entry memLedgerEntry) bool { return entry.UserID == userID })
+	})
+	sort.Slice(saved, func(i, j int) bool { return saved[i].ID < saved[j].ID })
+	var entries []models.LedgerEntry
+	for _, entry := range saved {
+		entries = append(entries, models.LedgerEntry(entry))
+	}
+	return entries, nil
+}
+
+// GetUserBalance возвращает имеющийся на данный момент баланс пользователя
+func (r *InMemoryRepo) GetUserBalance(ctx context.Context, userID uuid.UUID) (balance decimal.Decimal, err error) {
+	r.read(ctx, func() {
+		saved, ok := r.balances.get(userID.String())
+		if !ok {
+			err = fmt.Errorf("the userID not found: %w", customerrors.ErrNotFound)
+			return
+		}
+		balance = saved.Balance
+	})
+	return balance, err
+}
+
+// GetUserWithdrawn возвращает сумму всех списаний пользователя
+func (r *InMemoryRepo) GetUserWithdrawn(ctx context.Context, userID uuid.UUID) (decimal.Decimal, error) {
+	withdrawn := decimal.Zero
+	r.read(ctx, func() {
+		for _, w := range r.withdrawals.filter(func(w memWithdrawal) bool { return w.UserID == userID }) {
+			withdrawn = withdrawn.Add(w.Sum)
+		}
+	})
+	return withdrawn, nil
+}
+
+// GetUserWithdrawals возвращает списания пользователя, подходящие под условия фильтра, в порядке их проведения
+func (r *InMemoryRepo) GetUserWithdrawals(ctx context.Context, userID uuid.UUID, filter models.WithdrawalFilter) ([]models.UserWithdrawal, error) {
+	var withdrawals []models.UserWithdrawal
+	r.read(ctx, func() {
+		saved := r.withdrawals.filter(func(w memWithdrawal) bool {
+			return w.UserID == userID && inTimeRange(w.ProcessedAt, filter.From, filter.To)
+		})
+		for _, w := range pageRows(saved, func(w memWithdrawal) int64 { return w.ID }, filter.Page) {
+			withdrawal := w.toModel()
+			withdrawal.IdempotencyKey = ""
+			withdrawals = append(withdrawals, withdrawal)
+		}
+	})
+	return withdrawals, nil
+}
+
+func (w memWithdrawal) toModel() models.UserWithdrawal {
+	sum, processedAt := w.Sum, w.ProcessedAt
+	return models.UserWithdrawal{
+		ID:             w.ID,
+		Order:          w.Order,
+		Sum:            &sum,
+		ProcessedAt:    &processedAt,
+		IdempotencyKey: w.IdempotencyKey,
+	}
+}
+
+// inTimeRange проверяет, что момент t не раньше from и раньше to. Нулевые границы не ограничивают интервал
+func inTimeRange(t, from, to time.Time) bool {
+	return (from.IsZero() || !t.Before(from)) && (to.IsZero() || t.Before(to))
+}
+
+// pageRows упорядочивает строки по идентификатору в направлении page и возвращает не более page.Limit строк,
+// следующих за строкой page.AfterID
+func pageRows[V any](rows []V, id func(V) int64, page models.Page) []V {
+	if page.AfterID != 0 {
+		rows = slices.DeleteFunc(rows, func(row V) bool {
+			if page.Descending {
+				return id(row) >= page.AfterID
+			}
+			return id(row) <= page.AfterID
+		})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if page.Descending {
+			return id(rows[i]) > id(rows[j])
+		}
+		return id(rows[i]) < id(rows[j])
+	})
+	if page.Limit > 0 && len(rows) > page.Limit {
+		rows = rows[:page.Limit]
+	}
+	return rows
+}
+
+// isFinalOrderStatus проверяет, является ли статус заказа окончательным
+func isFinalOrderStatus(status string) bool {
+	return status == "PROCESSED" || status == "INVALID"
+}
+
+// roundAmount округляет сумму до копеек, как это делает столбец DECIMAL(9, 2)
+func roundAmount(amount *decimal.Decimal) *decimal.Decimal {
+	if amount == nil {
+		return nil
+	}
+	rounded := amount.Round(2)
+	return &rounded
+}
+
+// StoreSession сохраняет новую сессию пользователя
+func (r *InMemoryRepo) StoreSession(ctx context.Context, session models.Session) error {
+	return r.write(ctx, func(tx *memTx) error {
+		if _, ok := r.sessions.get(session.ID.String()); ok {
+			return fmt.Errorf("session %s already exists", session.ID)
+		}
+		r.sessions.put(tx, session.ID.String(), memSession(session))
+		return nil
+	})
+}
+
+// GetSession возвращает сессию по ее идентификатору
+func (r *InMemoryRepo) GetSession(ctx context.Context, sessionID uuid.UUID) (session models.Session, err error) {
+	r.read(ctx, func() {
+		saved, ok := r.sessions.get(sessionID.String())
+		if !ok {
+			err = fmt.Errorf("the session not found: %w", customerrors.ErrNotFound)
+			return
+		}
+		session = models.Session(saved)
+	})
+	return session, err
+}
+
+// GetSessionByRefreshToken возвращает сессию по хешу ее текущего токена обновления
+func (r *InMemoryRepo) GetSessionByRefreshToken(ctx context.Context, refreshTokenHash []byte) (session models.Session, err error) {
+	r.read(ctx, func() {
+		found := r.sessions.filter(func(s memSession) bool { return bytes.Equal(s.RefreshTokenHash, refreshTokenHash) })
+		if len(found) == 0 {
+			err = fmt.Errorf("the session not found: %w", customerrors.ErrNotFound)
+			return
+		}
+		session = models.Session(found[0])
+	})
+	return session, err
+}
+
+// RotateSessionRefreshToken заменяет токен обновления неотозванной сессии, если ее текущий токен все еще oldHash,
+// и продлевает сессию до expiresAt. Возвращает false, если токен уже был заменен или сессия отозвана
+func (r *InMemoryRepo) RotateSessionRefreshToken(ctx context.Context, sessionID uuid.UUID, oldHash, newHash []byte, expiresAt time.Time) (bool, error) {
+	var rotated bool
+	err := r.write(ctx, func(tx *memTx) error {
+		saved, ok := r.sessions.get(sessionID.String())
+		if !ok || saved.RevokedAt != nil || !bytes.Equal(saved.RefreshTokenHash, oldHash) {
+			return nil
+		}
+		saved.RefreshTokenHash = newHash
+		saved.ExpiresAt = expiresAt
+		r.sessions.put(tx, saved.ID.String(), saved)
+		rotated = true
+		return nil
+	})
+	return rotated, err
+}
+
+// RevokeSession отзывает сессию
+func (r *InMemoryRepo) RevokeSession(ctx context.Context, sessionID uuid.UUID) error {
+	return r.write(ctx, func(tx *memTx) error {
+		saved, ok := r.sessions.get(sessionID.String())
+		if !ok || saved.RevokedAt != nil {
+			return nil
+		}
+		now := time.Now()
+		saved.RevokedAt = &now
+		r.sessions.put(tx, saved.ID.String(), saved)
+		return nil
+	})
+}
+
+// RevokeUserSessions отзывает все сессии пользователя, кроме exceptSessionID (uuid.Nil - отозвать все)
+func (r *InMemoryRepo) RevokeUserSessions(ctx context.Context, userID, exceptSessionID uuid.UUID) error {
+	return r.write(ctx, func(tx *memTx) error {
+		now := time.Now()
+		for _, saved := range r.sessions.filter(func(s memSession) bool {
+			return s.UserID == userID && s.ID != exceptSessionID && s.RevokedAt == nil
+		}) {
+			saved.RevokedAt = &now
+			r.sessions.put(tx, saved.ID.String(), saved)
+		}
+		return nil
+	})
+}
+
+// GetUserByID возвращает учетную запись пользователя по его UUID
+func (r *InMemoryRepo) GetUserByID(ctx context.Context, userID uuid.UUID) (user models.User, err error) {
+	r.read(ctx, func() {
+		found := r.users.filter(func(u memUser) bool { return u.UserID == userID })
+		if len(found) == 0 {
+			err = fmt.Errorf("the userID not found: %w", customerrors.ErrNotFound)
+			return
+		}
+		user = found[0].toModel()
+	})
+	return user, err
+}
+
+// SetUserRole назначает пользователю роль
+func (r *InMemoryRepo) SetUserRole(ctx context.Context, userID uuid.UUID, role string) error {
+	return r.write(ctx, func(tx *memTx) error {
+		found := r.users.filter(func(u memUser) bool { return u.UserID == userID })
+		if len(found) == 0 {
+			return fmt.Errorf("the userID not found: %w", customerrors.ErrNotFound)
+		}
+		user := found[0]
+		user.Role = role
+		r.users.put(tx, user.Login, user)
+		return nil
+	})
+}
+
+// UpdateUserPassword заменяет хешированный пароль пользователя
+func (r *InMemoryRepo) UpdateUserPassword(ctx context.Context, userID uuid.UUID, hashedPassword []byte) error {
+	return r.write(ctx, func(tx *memTx) error {
+		found := r.users.filter(func(u memUser) bool { return u.UserID == userID })
+		if len(found) == 0 {
+			return fmt.Errorf("the userID not found: %w", customerrors.ErrNotFound)
+		}
+		user := found[0]
+		user.HashedPassword = hashedPassword
+		r.users.put(tx, user.Login, user)
+		return nil
+	})
+}
+
+// StorePasswordResetToken сохраняет новый токен сброса пароля, делая недействительными
+// ранее выданные и еще не использованные токены пользователя
+func (r *InMemoryRepo) StorePasswordResetToken(ctx context.Context, token models.PasswordResetToken) error {
+	return r.write(ctx, func(tx *memTx) error {
+		now := time.Now()
+		for _, saved := range r.resetTokens.filter(func(t memResetToken) bool { return t.UserID == token.UserID && t.UsedAt == nil }) {
+			saved.UsedAt = &now
+			r.resetTokens.put(tx, hex.EncodeToString(saved.TokenHash), saved)
+		}
+		key := hex.EncodeToString(token.TokenHash)
+		if _, ok := r.resetTokens.get(key); ok {
+			return fmt.Errorf("password reset token already exists")
+		}
+		r.resetTokens.put(tx, key, memResetToken(token))
+		return nil
+	})
+}
+
+// GetPasswordResetTokenUser возвращает UUID пользователя действующего на момент now токена сброса пароля,
+// не помечая токен использованным
+func (r *InMemoryRepo) GetPasswordResetTokenUser(ctx context.Context, tokenHash []byte, now time.Time) (userID uuid.UUID, err error) {
+	r.read(ctx, func() {
+		saved, ok := r.resetTokens.get(hex.EncodeToString(tokenHash))
+		if !ok || saved.UsedAt != nil || !now.Before(saved.ExpiresAt) {
+			err = fmt.Errorf("the password reset token not found: %w", customerrors.ErrNotFound)
+			return
+		}
+		userID = saved.UserID
+	})
+	return userID, err
+}
+
+// UsePasswordResetToken помечает использованным действующий на момент now токен сброса пароля
+// и возвращает UUID его пользователя. Каждый токен может быть использован только один раз
+func (r *InMemoryRepo) UsePasswordResetToken(ctx context.Context, tokenHash []byte, now time.Time) (uuid.UUID, error) {
+	var userID uuid.UUID
+	err := r.write(ctx, func(tx *memTx) error {
+		key := hex.EncodeToString(tokenHash)
+		saved, ok := r.resetTokens.get(key)
+		if !ok || saved.UsedAt != nil || !now.Before(saved.ExpiresAt) {
+			return fmt.Errorf("the password reset token not found: %w", customerrors.ErrNotFound)
+		}
+		saved.UsedAt = &now
+		r.resetTokens.put(tx, key, saved)
+		userID = saved.UserID
+		return nil
+	})
+	return userID, err
+}
+
+// GetUserTOTP возвращает настройки двухфакторной аутентификации пользователя
+func (r *InMemoryRepo) GetUserTOTP(ctx context.Context, userID uuid.UUID) (userTOTP models.UserTOTP, err error) {
+	r.read(ctx, func() {
+		saved, ok := r.totp.get(userID.String())
+		if !ok {
+			err = fmt.Errorf("the user TOTP not found: %w", customerrors.ErrNotFound)
+			return
+		}
+		userTOTP = models.UserTOTP(saved)
+	})
+	return userTOTP, err
+}
+
+// StoreUserTOTP сохраняет новый неподтвержденный секрет TOTP пользователя, заменяя предыдущий неподтвержденный.
+// Возвращает false, если двухфакторная аутентификация пользователя уже включена
+func (r *InMemoryRepo) StoreUserTOTP(ctx context.Context, userTOTP models.UserTOTP) (bool, error) {
+	var stored bool
+	err := r.write(ctx, func(tx *memTx) error {
+		if saved, ok := r.totp.get(userTOTP.UserID.String()); ok && saved.EnabledAt != nil {
+			return nil
+		}
+		userTOTP.EnabledAt = nil
+		userTOTP.LastUsedStep = 0
+		r.totp.put(tx, userTOTP.UserID.String(), memTOTP(userTOTP))
+		stored = true
+		return nil
+	})
+	return stored, err
+}
+
+// EnableUserTOTP включает двухфакторную аутентификацию, если неподтвержденный секрет пользователя все еще secret,
+// и запоминает интервал step подтверждающего кода как использованный
+func (r *InMemoryRepo) EnableUserTOTP(ctx context.Context, userID uuid.UUID, secret string, step int64) (bool, error) {
+	var enabled bool
+	err := r.write(ctx, func(tx *memTx) error {
+		saved, ok := r.totp.get(userID.String())
+		if !ok || saved.EnabledAt != nil || saved.Secret != secret {
+			return nil
+		}
+		now := time.Now()
+		saved.EnabledAt = &now
+		saved.LastUsedStep = step
+		r.totp.put(tx, userID.String(), saved)
+		enabled = true
+		return nil
+	})
+	return enabled, err
+}
+
+// UseTOTPStep отмечает интервал step как использованный, если он новее последнего использованного.
+// Возвращает false, если код этого интервала уже был принят
+func (r *InMemoryRepo) UseTOTPStep(ctx context.Context, userID uuid.UUID, step int64) (bool, error) {
+	var used bool
+	err := r.write(ctx, func(tx *memTx) error {
+		saved, ok := r.totp.get(userID.String())
+		if !ok || saved.EnabledAt == nil || saved.LastUsedStep >= step {
+			return nil
+		}
+		saved.LastUsedStep = step
+		r.totp.put(tx, userID.String(), saved)
+		used = true
+		return nil
+	})
+	return used, err
+}
+
+// DeleteUserTOTP отключает двухфакторную аутентификацию пользователя и удаляет его резервные коды
+func (r *InMemoryRepo) DeleteUserTOTP(ctx context.Context, userID uuid.UUID) error {
+	return r.write(ctx, func(tx *memTx) error {
+		r.totp.del(tx, userID.String())
+		r.deleteRecoveryCodes(tx, userID)
+		return nil
+	})
+}
+
+// StoreRecoveryCodes заменяет резервные коды пользователя новыми
+func (r *InMemoryRepo) StoreRecoveryCodes(ctx context.Context, userID uuid.UUID, codeHashes [][]byte) error {
+	return r.write(ctx, func(tx *memTx) error {
+		r.deleteRecoveryCodes(tx, userID)
+		for _, codeHash := range codeHashes {
+			r.recoveryCodes.put(tx, recoveryCodeKey(userID, codeHash), memRecoveryCode{UserID: userID, CodeHash: codeHash})
+		}
+		return nil
+	})
+}
+
+// UseRecoveryCode отмечает неиспользованный резервный код пользователя как использованный.
+// Возвращает false, если такого кода нет или он уже использован
+func (r *InMemoryRepo) UseRecoveryCode(ctx context.Context, userID uuid.UUID, codeHash []byte) (bool, error) {
+	var used bool
+	err := r.write(ctx, func(tx *memTx) error {
+		key := recoveryCodeKey(userID, codeHash)
+		saved, ok := r.recoveryCodes.get(key)
+		if !ok || saved.UsedAt != nil {
+			return nil
+		}
+		now := time.Now()
+		saved.UsedAt = &now
+		r.recoveryCodes.put(tx, key, saved)
+		used = true
+		return nil
+	})
+	return used, err
+}
+
+func (r *InMemoryRepo) deleteRecoveryCodes(tx *memTx, userID uuid.UUID) {
+	for _, saved := range r.recoveryCodes.filter(func(c memRecoveryCode) bool { return c.UserID == userID }) {
+		r.recoveryCodes.del(tx, recoveryCodeKey(userID, saved.CodeHash))
+	}
+}
+
+func recoveryCodeKey(userID uuid.UUID, codeHash []byte) string {
+	return userID.String() + ":" + hex.EncodeToString(codeHash)
+}
@@ -4,70 +4,169 @@ package services
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
-	"fmt"
 	"github.com/DenisKhanov/Gophermart/internal/app/auth"
 	"github.com/DenisKhanov/Gophermart/internal/app/customerrors"
+	"github.com/DenisKhanov/Gophermart/internal/app/loginguard"
 	"github.com/DenisKhanov/Gophermart/internal/app/models"
+	"github.com/DenisKhanov/Gophermart/internal/app/policy"
+	"github.com/DenisKhanov/Gophermart/internal/app/ratelimit"
+	"github.com/DenisKhanov/Gophermart/internal/app/totp"
 	"github.com/google/uuid"
-	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/shopspring/decimal"
 	"github.com/sirupsen/logrus"
-	"io"
-	"net/http"
-	"regexp"
+	"math/rand"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
-	"unicode"
 )
 
 // Repository defines the interface for interacting with the storage backend.
 //
 //go:generate mockgen -source=service.go -destination=mocks/service_mock.go -package=mocks
 type Repository interface {
-	StoreNewUser(ctx context.Context, tx pgx.Tx, userID uuid.UUID, login string, hashedPassword []byte) error
-	StoreNewUserBalance(ctx context.Context, tx pgx.Tx, userID uuid.UUID) error
-	StoreUserOrder(ctx context.Context, tx pgx.Tx, orderNumber, orderStatus string, userID uuid.UUID, bonus decimal.Decimal) error
-	StoreUserWithdrawal(ctx context.Context, tx pgx.Tx, userID uuid.UUID, orderNumber string, sum decimal.Decimal) error
+	// WithTx выполняет fn как единицу работы: все изменения, сделанные через репозиторий с переданным в fn контекстом,
+	// применяются целиком, если fn вернула nil, и отменяются, если fn вернула ошибку
+	WithTx(ctx context.Context, fn func(ctx context.Context) error) error
+	StoreNewUser(ctx context.Context, userID uuid.UUID, login string, hashedPassword []byte) error
+	StoreNewUserBalance(ctx context.Context, userID uuid.UUID) error
+	StoreUserOrder(ctx context.Context, orderNumber, orderStatus string, userID uuid.UUID) error
+	StoreUserOrderIfNew(ctx context.Context, orderNumber, orderStatus string, userID uuid.UUID) (bool, error)
+	StoreUserWithdrawal(ctx context.Context, userID uuid.UUID, orderNumber string, sum decimal.Decimal, idempotencyKey string) (bool, error)
 	GetUserHashPassword(ctx context.Context, login string) ([]byte, error)
 	GetUUIDFromOrders(ctx context.Context, orderNumber string) (uuid.UUID, error)
 	GetUUIDFromUsers(ctx context.Context, login string) (uuid.UUID, error)
-	GetProcessingOrders(ctx context.Context) ([]models.UserOrder, error)
-	GetUserProcessingOrders(ctx context.Context, userID uuid.UUID) ([]models.UserOrder, error)
-	GetUserOrders(ctx context.Context, userID uuid.UUID) ([]models.UserOrder, error)
+	ClaimDueOrders(ctx context.Context, limit int, lease time.Duration) ([]models.UserOrder, error)
+	GetUserOrders(ctx context.Context, userID uuid.UUID, filter models.OrderFilter) ([]models.UserOrder, error)
+	GetOrder(ctx context.Context, orderNumber string) (models.UserOrder, error)
+	GetOrderStatusHistory(ctx context.Context, orderNumber string) ([]models.OrderStatusChange, error)
 	GetUserBalance(ctx context.Context, userID uuid.UUID) (decimal.Decimal, error)
 	GetUserWithdrawn(ctx context.Context, userID uuid.UUID) (decimal.Decimal, error)
-	GetUserWithdrawals(ctx context.Context, userID uuid.UUID) ([]models.UserWithdrawal, error)
-	UpdateOrders(ctx context.Context, tx pgx.Tx, orders []models.AccrualResponseData) error
-	UpdateUserBalance(ctx context.Context, tx pgx.Tx, userID uuid.UUID, newBalance decimal.Decimal) error
-	UsersBalanceUpdate(ctx context.Context, tx pgx.Tx, usersBalanceToUpdate map[uuid.UUID]decimal.Decimal) error
+	GetUserWithdrawals(ctx context.Context, userID uuid.UUID, filter models.WithdrawalFilter) ([]models.UserWithdrawal, error)
+	GetUserWithdrawal(ctx context.Context, userID uuid.UUID, orderNumber, idempotencyKey string) (models.UserWithdrawal, error)
+	UpdateOrders(ctx context.Context, orders []models.AccrualResponseData) ([]models.AccrualResponseData, error)
+	ScheduleOrdersCheck(ctx context.Context, orders []models.UserOrder) error
+	FindOrders(ctx context.Context, filter models.OrderFilter) ([]models.AdminOrder, error)
+	RescheduleOrderCheck(ctx context.Context, orderNumber string) (bool, error)
+	AppendLedgerEntry(ctx context.Context, entry *models.LedgerEntry) error
+	GetUserLedger(ctx context.Context, userID uuid.UUID) ([]models.LedgerEntry, error)
+	StoreSession(ctx context.Context, session models.Session) error
+	GetSession(ctx context.Context, sessionID uuid.UUID) (models.Session, error)
+	GetSessionByRefreshToken(ctx context.Context, refreshTokenHash []byte) (models.Session, error)
+	RotateSessionRefreshToken(ctx context.Context, sessionID uuid.UUID, oldHash, newHash []byte, expiresAt time.Time) (bool, error)
+	RevokeSession(ctx context.Context, sessionID uuid.UUID) error
+	RevokeUserSessions(ctx context.Context, userID, exceptSessionID uuid.UUID) error
+	GetUserByID(ctx context.Context, userID uuid.UUID) (models.User, error)
+	UpdateUserPassword(ctx context.Context, userID uuid.UUID, hashedPassword []byte) error
+	SetUserRole(ctx context.Context, userID uuid.UUID, role string) error
+	StorePasswordResetToken(ctx context.Context, token models.PasswordResetToken) error
+	GetPasswordResetTokenUser(ctx context.Context, tokenHash []byte, now time.Time) (uuid.UUID, error)
+	UsePasswordResetToken(ctx context.Context, tokenHash []byte, now time.Time) (uuid.UUID, error)
+	GetUserTOTP(ctx context.Context, userID uuid.UUID) (models.UserTOTP, error)
+	StoreUserTOTP(ctx context.Context, userTOTP models.UserTOTP) (bool, error)
+	EnableUserTOTP(ctx context.Context, userID uuid.UUID, secret string, step int64) (bool, error)
+	UseTOTPStep(ctx context.Context, userID uuid.UUID, step int64) (bool, error)
+	DeleteUserTOTP(ctx context.Context, userID uuid.UUID) error
+	StoreRecoveryCodes(ctx context.Context, userID uuid.UUID, codeHashes [][]byte) error
+	UseRecoveryCode(ctx context.Context, userID uuid.UUID, codeHash []byte) (bool, error)
+}
+
+// AccrualClient defines the interface for requesting accrual data from the loyalty points calculation system.
+// Responses without data are returned as errors: customerrors.ErrAccrualOrderNotRegistered (204),
+// *customerrors.AccrualRateLimitError (429) and customerrors.ErrAccrualInternal (500).
+type AccrualClient interface {
+	GetOrderAccrual(ctx context.Context, orderNumber string) (models.AccrualResponseData, error)
+}
+
+// Notifier доставляет пользователю токен сброса пароля, например по электронной почте
+type Notifier interface {
+	NotifyPasswordReset(ctx context.Context, login, token string, expiresAt time.Time) error
+}
+
+// EventBus доставляет пользователям события об изменении их заказов и баланса, в том числе подписчикам,
+// подключенным к другим экземплярам сервиса
+type EventBus interface {
+	Publish(ctx context.Context, event models.UserEvent) error
+	Subscribe(userID uuid.UUID) (events <-chan models.UserEvent, cancel func())
+}
+
+const (
+	numOfWorkers  = 10               // количество воркеров, одновременно обращающихся к accrual
+	pollBatchSize = 100              // максимальное количество заказов, проверяемых за один проход
+	minCheckDelay = time.Second      // задержка перед повторной проверкой заказа после первой попытки
+	maxCheckDelay = 10 * time.Minute // максимальная задержка между проверками одного заказа
+	claimLease    = 5 * time.Minute  // время, на которое заказы захватываются одним экземпляром сервиса
+
+	maxOrdersBatch = 1000 // максимальное количество номеров заказов в одном пакете
+
+	challengeTokenExp  = 5 * time.Minute // время на ввод кода второго фактора после проверки пароля
+	recoveryCodesCount = 10              // количество резервных кодов, выдаваемых при включении двухфакторной аутентификации
+)
+
+// AuthConfig зависимости и параметры аутентификации пользователей
+type AuthConfig struct {
+	JWTManager         *auth.JWTManager
+	RefreshTokenExp    time.Duration // время жизни сессии без обновления токена
+	ResetTokenExp      time.Duration // время жизни токена сброса пароля
+	RegistrationPolicy *policy.RegistrationPolicy
+	LoginGuard         *loginguard.Guard
+	Notifier           Notifier
+	TOTPIssuer         string // название сервиса в приложении-аутентификаторе
+	// списания на сумму больше порога требуют кода TOTP у пользователей с двухфакторной аутентификацией, nil - не требуют
+	TOTPWithdrawalThreshold *decimal.Decimal
 }
 
 type GmartServices struct {
-	repository     Repository
-	accrualAddress string
-	dbPool         *pgxpool.Pool //opened in main func dbPool pool connections
+	repository         Repository
+	accrualClient      AccrualClient
+	events             EventBus
+	limiter            *ratelimit.Limiter // общий для всех воркеров ограничитель запросов к accrual
+	jwtManager         *auth.JWTManager
+	refreshTokenExp    time.Duration // время жизни сессии без обновления токена
+	resetTokenExp      time.Duration // время жизни токена сброса пароля
+	registrationPolicy *policy.RegistrationPolicy
+	loginGuard         *loginguard.Guard
+	notifier           Notifier
+	totpIssuer         string
+	// списания на сумму больше порога требуют кода TOTP у пользователей с двухфакторной аутентификацией, nil - не требуют
+	totpWithdrawalThreshold *decimal.Decimal
 }
 
-func NewGmartServices(repository Repository, accrualAddress string, dbPool *pgxpool.Pool) *GmartServices {
+// dummyPasswordHash хеш, с которым сравнивается пароль при входе под неизвестным логином
+var dummyPasswordHash, _ = auth.CreateHashPassword("dummy password for unknown logins")
+
+func NewGmartServices(repository Repository, accrualClient AccrualClient, events EventBus, authCfg AuthConfig) *GmartServices {
 	return &GmartServices{
-		repository:     repository,
-		accrualAddress: accrualAddress,
-		dbPool:         dbPool,
+		repository:              repository,
+		accrualClient:           accrualClient,
+		events:                  events,
+		limiter:                 ratelimit.NewLimiter(),
+		jwtManager:              authCfg.JWTManager,
+		refreshTokenExp:         authCfg.RefreshTokenExp,
+		resetTokenExp:           authCfg.ResetTokenExp,
+		registrationPolicy:      authCfg.RegistrationPolicy,
+		loginGuard:              authCfg.LoginGuard,
+		notifier:                authCfg.Notifier,
+		totpIssuer:              authCfg.TOTPIssuer,
+		totpWithdrawalThreshold: authCfg.TOTPWithdrawalThreshold,
 	}
 }
 
 // isValidLuhn проверяет, действителен ли номер согласно алгоритму Луна.
 func isValidLuhn(number string) bool {
+	if number == "" {
+		return false
+	}
 	var sum int
 	nDigits := len(number)
 	parity := nDigits % 2
 
 	for i, r := range number {
-		digit, _ := strconv.Atoi(string(r))
+		digit, err := strconv.Atoi(string(r))
+		if err != nil {
+			return false
+		}
 
 		if i%2 == parity {
 			digit = digit * 2
@@ -80,177 +179,596 @@ func isValidLuhn(number string) bool {
 	return sum%10 == 0
 }
 
-// CreateUser метод регистрации пользователя, выполняет проверки на качество логина и пароля
-// и в случае соответствия сохраняет пользователя в базу данных
-func (s GmartServices) CreateUser(ctx context.Context, login, password string) (token string, err error) {
-	//Пришлось выключить, данные условия не заложены в автотесты((
-	//if err = s.checkRegistrationData(login, password); err != nil {
-	//	logrus.Error(err)
-	//	return "", err
-	//}
-	if len(login) < 1 || len(password) < 1 {
-		return "", customerrors.ErrSaveNewUser
+// CreateUser метод регистрации пользователя, проверяет логин и пароль по политике регистрации
+// и в случае соответствия сохраняет пользователя в базу данных и открывает для него сессию
+func (s GmartServices) CreateUser(ctx context.Context, login, password string) (tokens models.AuthTokens, err error) {
+	if err = s.registrationPolicy.Validate(login, password); err != nil {
+		logrus.Info(err)
+		return models.AuthTokens{}, err
 	}
 	_, err = s.repository.GetUserHashPassword(ctx, login)
 	if err == nil {
 		logrus.Error(customerrors.ErrUserAlreadyTaken)
-		return "", customerrors.ErrUserAlreadyTaken
+		return models.AuthTokens{}, customerrors.ErrUserAlreadyTaken
 	}
 	hashedPassword, err := auth.CreateHashPassword(password)
 	if err != nil {
 		logrus.Error(err)
-		return "", err
+		return models.AuthTokens{}, err
 	}
 	userID := auth.GenerateUniqueID()
-	token, err = auth.BuildJWTString(userID)
-	if err != nil {
-		return "", customerrors.ErrSaveNewUser
-	}
-	if err = s.withTransaction(ctx, func(tx pgx.Tx) error {
-		if err = s.repository.StoreNewUser(ctx, tx, userID, login, hashedPassword); err != nil {
+	if err = s.repository.WithTx(ctx, func(ctx context.Context) error {
+		if err = s.repository.StoreNewUser(ctx, userID, login, hashedPassword); err != nil {
+			// логин мог быть занят параллельной регистрацией после проверки выше
+			if errors.Is(err, customerrors.ErrUserAlreadyTaken) {
+				logrus.Error(err)
+				return err
+			}
 			logrus.Error(customerrors.ErrSaveNewUser)
 			return customerrors.ErrSaveNewUser
 		}
-		if err = s.repository.StoreNewUserBalance(ctx, tx, userID); err != nil {
+		if err = s.repository.StoreNewUserBalance(ctx, userID); err != nil {
 			logrus.Error(customerrors.ErrSaveNewUser)
 			return customerrors.ErrSaveNewUser
 		}
 		return nil
 	}); err != nil {
-		return "", err
+		return models.AuthTokens{}, err
 	}
-	return token, nil
+	tokens, err = s.openSession(ctx, userID)
+	if err != nil {
+		return models.AuthTokens{}, customerrors.ErrSaveNewUser
+	}
+	return tokens, nil
 }
 
-// LogIn метод аутентификации пользователя, в случае успеха возвращает token
-func (s GmartServices) LogIn(ctx context.Context, login, password string) (token string, err error) {
-	//Пришлось выключить, данные условия не заложены в автотесты((
-	//if err = s.checkLogin(login); err != nil {
-	//	logrus.Error(err)
-	//	return "", err
-	//}
+// LogIn метод аутентификации пользователя, в случае успеха открывает новую сессию и возвращает ее токены.
+// Если у пользователя включена двухфакторная аутентификация, вместо токенов возвращается challenge, токен
+// которого вместе с кодом второго фактора обменивается на токены сессии в LogInTwoFactor.
+// Неудачные попытки учитываются по логину и IP-адресу клиента ip, и после них новые попытки временно
+// отклоняются с ошибкой *customerrors.LoginThrottledError. Для неизвестного логина пароль сравнивается
+// с фиктивным хешем, чтобы по времени ответа нельзя было определить, существует ли логин
+func (s GmartServices) LogIn(ctx context.Context, login, password, ip string) (tokens models.AuthTokens, challenge *models.TwoFactorChallenge, err error) {
+	if retryAfter, ok := s.loginGuard.Allow(login, ip); !ok {
+		logrus.Warnf("login attempt for %q from %s is throttled for %s", login, ip, retryAfter)
+		return models.AuthTokens{}, nil, &customerrors.LoginThrottledError{RetryAfter: retryAfter}
+	}
 	savedHashedPassword, err := s.repository.GetUserHashPassword(ctx, login)
-	if err != nil {
+	if err != nil && !errors.Is(err, customerrors.ErrNotFound) {
 		logrus.Error(err)
-		return "", err
+		return models.AuthTokens{}, nil, customerrors.ErrAccessingDB
 	}
-	if auth.CheckHashPasswordForValid(savedHashedPassword, password) {
-		savedUserID, err := s.repository.GetUUIDFromUsers(ctx, login)
-		if err != nil {
-			return "", customerrors.ErrAccessingDB
-		}
-		token, err = auth.BuildJWTString(savedUserID)
+	userExists := err == nil
+	if !userExists {
+		savedHashedPassword = dummyPasswordHash
+	}
+	if !auth.CheckHashPasswordForValid(savedHashedPassword, password) || !userExists {
+		s.loginGuard.Fail(login, ip)
+		return models.AuthTokens{}, nil, customerrors.ErrUnauthorizedUser
+	}
+	savedUserID, err := s.repository.GetUUIDFromUsers(ctx, login)
+	if err != nil {
+		return models.AuthTokens{}, nil, customerrors.ErrAccessingDB
+	}
+	twoFactor, err := s.twoFactorEnabled(ctx, savedUserID)
+	if err != nil {
+		return models.AuthTokens{}, nil, err
+	}
+	if twoFactor {
+		// неудачные попытки не сбрасываются до проверки второго фактора, иначе, зная пароль,
+		// можно было бы перебирать коды без ограничений
+		challengeToken, err := s.jwtManager.BuildChallengeToken(savedUserID, challengeTokenExp)
 		if err != nil {
-			return "", customerrors.ErrSaveNewUser
+			return models.AuthTokens{}, nil, err
 		}
-		return token, nil
+		return models.AuthTokens{}, &models.TwoFactorChallenge{
+			ChallengeToken: challengeToken,
+			ExpiresIn:      int64(challengeTokenExp.Seconds()),
+		}, nil
+	}
+	s.loginGuard.Reset(login)
+	tokens, err = s.openSession(ctx, savedUserID)
+	if err != nil {
+		return models.AuthTokens{}, nil, customerrors.ErrAccessingDB
 	}
-	return "", customerrors.ErrUnauthorizedUser
+	return tokens, nil, nil
 }
 
-// checkRegistrationData объединяет checkLogin и checkPassword, если логин или пароль не соответствует, то возвращает ошибку
-func (s GmartServices) checkRegistrationData(login, password string) error {
-	if err := s.checkLogin(login); err != nil {
+// LogInTwoFactor второй шаг входа пользователя с двухфакторной аутентификацией: обменивает токен,
+// выданный LogIn, и код TOTP или резервный код на токены новой сессии
+func (s GmartServices) LogInTwoFactor(ctx context.Context, challengeToken, code, ip string) (models.AuthTokens, error) {
+	claims, err := s.jwtManager.ParseChallengeToken(challengeToken)
+	if err != nil {
+		logrus.Info(err)
+		return models.AuthTokens{}, customerrors.ErrTokenIsNotValid
+	}
+	user, err := s.repository.GetUserByID(ctx, claims.UserID)
+	if err != nil {
 		logrus.Error(err)
-		return err
+		return models.AuthTokens{}, customerrors.ErrAccessingDB
+	}
+	if err = s.checkSecondFactor(ctx, user, code, ip, true); err != nil {
+		return models.AuthTokens{}, err
+	}
+	s.loginGuard.Reset(user.Login)
+	tokens, err := s.openSession(ctx, user.ID)
+	if err != nil {
+		return models.AuthTokens{}, customerrors.ErrAccessingDB
 	}
-	return s.checkPassword(password)
+	return tokens, nil
 }
 
-// checkLogin метод проверки логина на соответствие критериям (длина не меньше 5 и не больше 20 символов,
-// и не должен содержать символов кроме "-" и "_")
-func (s GmartServices) checkLogin(login string) error {
-	var (
-		hasMinLen     = false
-		hasMaxLen     = false
-		hasValidChars = false
-	)
+// UnlockLogin снимает блокировку входа по логину после неудачных попыток
+func (s GmartServices) UnlockLogin(_ context.Context, login string) error {
+	s.loginGuard.Reset(login)
+	logrus.Infof("login %q unlocked", login)
+	return nil
+}
 
-	const minLen = 5
-	const maxLen = 20
+// ChangePassword меняет пароль пользователя после проверки текущего пароля. Все остальные сессии
+// пользователя отзываются, текущая сессия sessionID остается действующей
+func (s GmartServices) ChangePassword(ctx context.Context, userID, sessionID uuid.UUID, currentPassword, newPassword string) error {
+	user, err := s.repository.GetUserByID(ctx, userID)
+	if err != nil {
+		logrus.Error(err)
+		return customerrors.ErrAccessingDB
+	}
+	if !auth.CheckHashPasswordForValid(user.HashedPassword, currentPassword) {
+		return customerrors.ErrWrongPassword
+	}
+	if err = s.registrationPolicy.ValidatePassword(user.Login, newPassword); err != nil {
+		logrus.Info(err)
+		return err
+	}
+	hashedPassword, err := auth.CreateHashPassword(newPassword)
+	if err != nil {
+		logrus.Error(err)
+		return err
+	}
+	if err = s.repository.WithTx(ctx, func(ctx context.Context) error {
+		if err := s.repository.UpdateUserPassword(ctx, userID, hashedPassword); err != nil {
+			return err
+		}
+		return s.repository.RevokeUserSessions(ctx, userID, sessionID)
+	}); err != nil {
+		logrus.Error(err)
+		return customerrors.ErrAccessingDB
+	}
+	logrus.Infof("password of user %s changed", userID)
+	return nil
+}
 
-	// Check login length
-	l := len(login)
-	if l >= minLen {
-		hasMinLen = true
+// RequestPasswordReset выпускает одноразовый токен сброса пароля и отправляет его пользователю через Notifier.
+// Ранее выпущенные токены перестают действовать. Для неизвестного логина ничего не делает и не возвращает ошибку,
+// чтобы по ответу нельзя было определить, существует ли логин
+func (s GmartServices) RequestPasswordReset(ctx context.Context, login string) error {
+	userID, err := s.repository.GetUUIDFromUsers(ctx, login)
+	if err != nil {
+		if errors.Is(err, customerrors.ErrNotFound) {
+			logrus.Infof("password reset requested for unknown login %q", login)
+			return nil
+		}
+		logrus.Error(err)
+		return customerrors.ErrAccessingDB
+	}
+	token, tokenHash, err := auth.GenerateToken()
+	if err != nil {
+		logrus.Error(err)
+		return err
 	}
-	if l <= maxLen {
-		hasMaxLen = true
+	now := time.Now()
+	resetToken := models.PasswordResetToken{
+		TokenHash: tokenHash,
+		UserID:    userID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.resetTokenExp),
 	}
+	if err = s.repository.WithTx(ctx, func(ctx context.Context) error {
+		return s.repository.StorePasswordResetToken(ctx, resetToken)
+	}); err != nil {
+		logrus.Error(err)
+		return customerrors.ErrAccessingDB
+	}
+	if err = s.notifier.NotifyPasswordReset(ctx, login, token, resetToken.ExpiresAt); err != nil {
+		logrus.Error("password reset notification is not sent: ", err)
+		return err
+	}
+	return nil
+}
 
-	// Checking for valid characters
-	isAlphanum := regexp.MustCompile(`^[A-Za-z0-9_\-]+$`).MatchString
-	if isAlphanum(login) {
-		hasValidChars = true
+// ConfirmPasswordReset устанавливает новый пароль по токену сброса. Токен используется однократно,
+// все сессии пользователя отзываются, а блокировка входа по его логину снимается
+func (s GmartServices) ConfirmPasswordReset(ctx context.Context, token, newPassword string) error {
+	tokenHash := auth.HashToken(token)
+	// пароль проверяется и хешируется до транзакции, чтобы не держать ее открытой на время вычисления bcrypt,
+	// а токен помечается использованным уже в транзакции вместе со сменой пароля
+	userID, err := s.repository.GetPasswordResetTokenUser(ctx, tokenHash, time.Now())
+	if err != nil {
+		if errors.Is(err, customerrors.ErrNotFound) {
+			logrus.Info(err)
+			return customerrors.ErrTokenIsNotValid
+		}
+		logrus.Error(err)
+		return customerrors.ErrAccessingDB
 	}
-	if !hasMinLen {
-		return errors.New("the login is too short")
+	user, err := s.repository.GetUserByID(ctx, userID)
+	if err != nil {
+		logrus.Error(err)
+		return customerrors.ErrAccessingDB
 	}
-	if !hasMaxLen {
-		return errors.New("the login is too long")
+	login := user.Login
+	if err = s.registrationPolicy.ValidatePassword(login, newPassword); err != nil {
+		logrus.Info(err)
+		return err
 	}
-	if !hasValidChars {
-		return errors.New("the login contains invalid characters")
+	hashedPassword, err := auth.CreateHashPassword(newPassword)
+	if err != nil {
+		logrus.Error(err)
+		return err
 	}
+	err = s.repository.WithTx(ctx, func(ctx context.Context) error {
+		usedUserID, err := s.repository.UsePasswordResetToken(ctx, tokenHash, time.Now())
+		if err != nil {
+			if errors.Is(err, customerrors.ErrNotFound) {
+				return customerrors.ErrTokenIsNotValid
+			}
+			return err
+		}
+		if usedUserID != userID {
+			return customerrors.ErrTokenIsNotValid
+		}
+		if err = s.repository.UpdateUserPassword(ctx, userID, hashedPassword); err != nil {
+			return err
+		}
+		return s.repository.RevokeUserSessions(ctx, userID, uuid.Nil)
+	})
+	if err != nil {
+		if errors.Is(err, customerrors.ErrTokenIsNotValid) {
+			logrus.Info(err)
+			return err
+		}
+		logrus.Error(err)
+		return customerrors.ErrAccessingDB
+	}
+	s.loginGuard.Reset(login)
+	logrus.Infof("password of user %q reset", login)
 	return nil
 }
 
-// checkPassword метод проверки пароля на соответствие критериям (длина не меньше 8 символов,
-// должен содержать хоть одну строчную букву, хоть одну цифру, хоть один символ)
-func (s GmartServices) checkPassword(password string) error {
-	var (
-		hasMinLen  = false
-		hasUpper   = false
-		hasLower   = false
-		hasNumber  = false
-		hasSpecial = false
-	)
+// EnrollTOTP генерирует новый секрет TOTP пользователя. Двухфакторная аутентификация включается только после
+// подтверждения первым кодом в VerifyTOTP, повторный вызов до подтверждения заменяет секрет
+func (s GmartServices) EnrollTOTP(ctx context.Context, userID uuid.UUID) (models.TOTPEnrollment, error) {
+	user, err := s.repository.GetUserByID(ctx, userID)
+	if err != nil {
+		logrus.Error(err)
+		return models.TOTPEnrollment{}, customerrors.ErrAccessingDB
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		logrus.Error(err)
+		return models.TOTPEnrollment{}, err
+	}
+	var stored bool
+	if err = s.repository.WithTx(ctx, func(ctx context.Context) error {
+		stored, err = s.repository.StoreUserTOTP(ctx, models.UserTOTP{UserID: userID, Secret: secret, CreatedAt: time.Now()})
+		return err
+	}); err != nil {
+		logrus.Error(err)
+		return models.TOTPEnrollment{}, customerrors.ErrAccessingDB
+	}
+	if !stored {
+		return models.TOTPEnrollment{}, customerrors.ErrTwoFactorEnabled
+	}
+	return models.TOTPEnrollment{
+		Secret:          secret,
+		ProvisioningURI: totp.ProvisioningURI(s.totpIssuer, user.Login, secret),
+	}, nil
+}
+
+// VerifyTOTP подтверждает секрет, полученный в EnrollTOTP, первым кодом из приложения-аутентификатора,
+// включает двухфакторную аутентификацию и возвращает резервные коды. Коды показываются пользователю
+// только один раз, в репозитории хранятся их хеши
+func (s GmartServices) VerifyTOTP(ctx context.Context, userID uuid.UUID, code string) ([]string, error) {
+	userTOTP, err := s.repository.GetUserTOTP(ctx, userID)
+	if err != nil {
+		if errors.Is(err, customerrors.ErrNotFound) {
+			return nil, customerrors.ErrTwoFactorNotEnrolled
+		}
+		logrus.Error(err)
+		return nil, customerrors.ErrAccessingDB
+	}
+	if userTOTP.Enabled() {
+		return nil, customerrors.ErrTwoFactorEnabled
+	}
+	step, ok := totp.Validate(userTOTP.Secret, code, time.Now())
+	if !ok {
+		return nil, customerrors.ErrWrongTwoFactorCode
+	}
+	recoveryCodes := make([]string, 0, recoveryCodesCount)
+	codeHashes := make([][]byte, 0, recoveryCodesCount)
+	for i := 0; i < recoveryCodesCount; i++ {
+		recoveryCode, err := totp.GenerateRecoveryCode()
+		if err != nil {
+			logrus.Error(err)
+			return nil, err
+		}
+		recoveryCodes = append(recoveryCodes, recoveryCode)
+		codeHashes = append(codeHashes, auth.HashToken(totp.NormalizeRecoveryCode(recoveryCode)))
+	}
+	err = s.repository.WithTx(ctx, func(ctx context.Context) error {
+		enabled, err := s.repository.EnableUserTOTP(ctx, userID, userTOTP.Secret, step)
+		if err != nil {
+			return err
+		}
+		// секрет заменен или подтвержден параллельным запросом
+		if !enabled {
+			return customerrors.ErrTwoFactorNotEnrolled
+		}
+		return s.repository.StoreRecoveryCodes(ctx, userID, codeHashes)
+	})
+	if err != nil {
+		if errors.Is(err, customerrors.ErrTwoFactorNotEnrolled) {
+			return nil, err
+		}
+		logrus.Error(err)
+		return nil, customerrors.ErrAccessingDB
+	}
+	logrus.Infof("two-factor authentication of user %s enabled", userID)
+	return recoveryCodes, nil
+}
 
-	const minLen = 8
+// DisableTOTP отключает двухфакторную аутентификацию после проверки кода TOTP или резервного кода
+func (s GmartServices) DisableTOTP(ctx context.Context, userID uuid.UUID, code string) error {
+	user, err := s.repository.GetUserByID(ctx, userID)
+	if err != nil {
+		logrus.Error(err)
+		return customerrors.ErrAccessingDB
+	}
+	return s.repository.WithTx(ctx, func(ctx context.Context) error {
+		if err := s.checkSecondFactor(ctx, user, code, "", true); err != nil {
+			return err
+		}
+		if err := s.repository.DeleteUserTOTP(ctx, userID); err != nil {
+			logrus.Error(err)
+			return customerrors.ErrAccessingDB
+		}
+		logrus.Infof("two-factor authentication of user %s disabled", userID)
+		return nil
+	})
+}
 
-	// Check password length
-	if len(password) >= minLen {
-		hasMinLen = true
+// twoFactorEnabled проверяет, включена ли у пользователя двухфакторная аутентификация
+func (s GmartServices) twoFactorEnabled(ctx context.Context, userID uuid.UUID) (bool, error) {
+	userTOTP, err := s.repository.GetUserTOTP(ctx, userID)
+	if err != nil {
+		if errors.Is(err, customerrors.ErrNotFound) {
+			return false, nil
+		}
+		logrus.Error(err)
+		return false, customerrors.ErrAccessingDB
 	}
+	return userTOTP.Enabled(), nil
+}
 
-	for _, char := range password {
-		switch {
-		case unicode.IsUpper(char):
-			hasUpper = true
-		case unicode.IsLower(char):
-			hasLower = true
-		case unicode.IsNumber(char):
-			hasNumber = true
-		case unicode.IsPunct(char) || unicode.IsSymbol(char):
-			hasSpecial = true
+// checkSecondFactor проверяет код TOTP или, если allowRecoveryCode, резервный код пользователя и отмечает его
+// использованным. Неверные коды учитываются защитой от подбора так же, как неверные пароли, ip пустой для запросов
+// уже аутентифицированного пользователя
+func (s GmartServices) checkSecondFactor(ctx context.Context, user models.User, code, ip string, allowRecoveryCode bool) error {
+	if retryAfter, ok := s.loginGuard.Allow(user.Login, ip); !ok {
+		logrus.Warnf("two-factor code for %q from %s is throttled for %s", user.Login, ip, retryAfter)
+		return &customerrors.LoginThrottledError{RetryAfter: retryAfter}
+	}
+	userTOTP, err := s.repository.GetUserTOTP(ctx, user.ID)
+	if err != nil {
+		if errors.Is(err, customerrors.ErrNotFound) {
+			return customerrors.ErrTwoFactorNotEnrolled
 		}
+		logrus.Error(err)
+		return customerrors.ErrAccessingDB
+	}
+	if !userTOTP.Enabled() {
+		return customerrors.ErrTwoFactorNotEnrolled
+	}
+	var used bool
+	if step, ok := totp.Validate(userTOTP.Secret, code, time.Now()); ok {
+		// код, уже принятый в этом интервале, повторно не принимается
+		used, err = s.repository.UseTOTPStep(ctx, user.ID, step)
+	} else if allowRecoveryCode {
+		used, err = s.repository.UseRecoveryCode(ctx, user.ID, auth.HashToken(totp.NormalizeRecoveryCode(code)))
 	}
+	if err != nil {
+		logrus.Error(err)
+		return customerrors.ErrAccessingDB
+	}
+	if !used {
+		s.loginGuard.Fail(user.Login, ip)
+		return customerrors.ErrWrongTwoFactorCode
+	}
+	return nil
+}
 
-	if !hasMinLen {
-		return errors.New("пароль слишком короткий")
+// openSession создает новую сессию пользователя и выпускает для нее токен доступа и токен обновления
+func (s GmartServices) openSession(ctx context.Context, userID uuid.UUID) (models.AuthTokens, error) {
+	refreshToken, refreshTokenHash, err := auth.GenerateToken()
+	if err != nil {
+		logrus.Error(err)
+		return models.AuthTokens{}, err
 	}
-	if !hasUpper {
-		return errors.New("пароль должен содержать хотя бы одну заглавную букву")
+	now := time.Now()
+	session := models.Session{
+		ID:               uuid.New(),
+		UserID:           userID,
+		RefreshTokenHash: refreshTokenHash,
+		CreatedAt:        now,
+		ExpiresAt:        now.Add(s.refreshTokenExp),
 	}
-	if !hasLower {
-		return errors.New("пароль должен содержать хотя бы одну строчную букву")
+	if err = s.repository.StoreSession(ctx, session); err != nil {
+		logrus.Error(err)
+		return models.AuthTokens{}, err
 	}
-	if !hasNumber {
-		return errors.New("пароль должен содержать хотя бы одну цифру")
+	return s.buildAuthTokens(ctx, userID, session.ID, refreshToken)
+}
+
+// buildAuthTokens выпускает токен доступа сессии с текущей ролью пользователя и объединяет его с токеном обновления
+func (s GmartServices) buildAuthTokens(ctx context.Context, userID, sessionID uuid.UUID, refreshToken string) (models.AuthTokens, error) {
+	user, err := s.repository.GetUserByID(ctx, userID)
+	if err != nil {
+		logrus.Error(err)
+		return models.AuthTokens{}, err
 	}
-	if !hasSpecial {
-		return errors.New("пароль должен содержать хотя бы один специальный символ")
+	accessToken, err := s.jwtManager.BuildJWTString(userID, sessionID, user.Role)
+	if err != nil {
+		return models.AuthTokens{}, err
+	}
+	return models.AuthTokens{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(s.jwtManager.TokenExp().Seconds()),
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// RefreshTokens обменивает действующий токен обновления на новую пару токенов той же сессии.
+// Предъявленный токен обновления после этого перестает действовать
+func (s GmartServices) RefreshTokens(ctx context.Context, refreshToken string) (models.AuthTokens, error) {
+	oldHash := auth.HashToken(refreshToken)
+	session, err := s.repository.GetSessionByRefreshToken(ctx, oldHash)
+	if err != nil {
+		if errors.Is(err, customerrors.ErrNotFound) {
+			return models.AuthTokens{}, customerrors.ErrTokenIsNotValid
+		}
+		logrus.Error(err)
+		return models.AuthTokens{}, customerrors.ErrAccessingDB
+	}
+	now := time.Now()
+	if !session.Active(now) {
+		return models.AuthTokens{}, customerrors.ErrTokenIsNotValid
+	}
+	newRefreshToken, newHash, err := auth.GenerateToken()
+	if err != nil {
+		logrus.Error(err)
+		return models.AuthTokens{}, err
+	}
+	rotated, err := s.repository.RotateSessionRefreshToken(ctx, session.ID, oldHash, newHash, now.Add(s.refreshTokenExp))
+	if err != nil {
+		logrus.Error(err)
+		return models.AuthTokens{}, customerrors.ErrAccessingDB
+	}
+	// токен уже обменян параллельным запросом или сессия отозвана
+	if !rotated {
+		return models.AuthTokens{}, customerrors.ErrTokenIsNotValid
+	}
+	return s.buildAuthTokens(ctx, session.UserID, session.ID, newRefreshToken)
+}
+
+// LogOut отзывает сессию, после чего ее токены доступа и обновления перестают приниматься
+func (s GmartServices) LogOut(ctx context.Context, sessionID uuid.UUID) error {
+	if err := s.repository.RevokeSession(ctx, sessionID); err != nil {
+		logrus.Error(err)
+		return customerrors.ErrAccessingDB
 	}
 	return nil
 }
 
+// ValidateToken проверяет токен доступа пользователя и то, что его сессия не отозвана, и возвращает claims токена
+func (s GmartServices) ValidateToken(ctx context.Context, tokenString string) (*auth.Claims, error) {
+	claims, err := s.jwtManager.ParseToken(tokenString)
+	if err != nil {
+		logrus.Error(err)
+		return nil, customerrors.ErrTokenIsNotValid
+	}
+	session, err := s.repository.GetSession(ctx, claims.SessionID)
+	if err != nil {
+		if errors.Is(err, customerrors.ErrNotFound) {
+			return nil, customerrors.ErrTokenIsNotValid
+		}
+		logrus.Error(err)
+		return nil, customerrors.ErrAccessingDB
+	}
+	if session.UserID != claims.UserID || !session.Active(time.Now()) {
+		return nil, customerrors.ErrTokenIsNotValid
+	}
+	return claims, nil
+}
+
 // InputUserOrder метод принимает номер заказа, проверяет его при помощи алгоритма Луна и если все ок,
-// то асинхронно отправляет запрос в accrualAPI сервис и записывает результат в базу
+// то сохраняет заказ со статусом NEW. Запросы в accrualAPI сервис выполняет фоновая задача RunUpdateOrdersStatusJob
 func (s GmartServices) InputUserOrder(ctx context.Context, userID uuid.UUID, orderNumber string) error {
 	if !isValidLuhn(orderNumber) {
 		return customerrors.ErrOrderNumber
 	}
 	// Check if order already exists and who it belongs to.
+	if err := s.checkOrderOwner(ctx, userID, orderNumber); err != nil {
+		return err
+	}
+	err := s.repository.WithTx(ctx, func(ctx context.Context) error {
+		return s.repository.StoreUserOrder(ctx, orderNumber, "NEW", userID)
+	})
+	if err != nil {
+		// заказ с таким номером мог быть сохранен параллельным запросом между проверкой и вставкой
+		if ownerErr := s.checkOrderOwner(ctx, userID, orderNumber); ownerErr != nil {
+			return ownerErr
+		}
+		logrus.Error(err)
+		return customerrors.ErrAccessingDB
+	}
+	return nil
+}
+
+// InputUserOrders загружает пакет номеров заказов в одной транзакции и возвращает результат для каждого номера
+// в порядке пакета. Номера проверяются так же, как в InputUserOrder, но неверный или уже загруженный номер
+// не прерывает загрузку остальных
+func (s GmartServices) InputUserOrders(ctx context.Context, userID uuid.UUID, orderNumbers []string) ([]models.OrderUploadResult, error) {
+	if len(orderNumbers) == 0 || len(orderNumbers) > maxOrdersBatch {
+		return nil, customerrors.ErrOrderBatchSize
+	}
+	var results []models.OrderUploadResult
+	err := s.repository.WithTx(ctx, func(ctx context.Context) error {
+		results = make([]models.OrderUploadResult, 0, len(orderNumbers))
+		for _, orderNumber := range orderNumbers {
+			result, err := s.storeBatchOrder(ctx, userID, orderNumber)
+			if err != nil {
+				return err
+			}
+			results = append(results, models.OrderUploadResult{Number: orderNumber, Result: result})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// storeBatchOrder сохраняет номер заказа из пакета и возвращает результат его загрузки
+func (s GmartServices) storeBatchOrder(ctx context.Context, userID uuid.UUID, orderNumber string) (string, error) {
+	if !isValidLuhn(orderNumber) {
+		return models.OrderUploadInvalid, nil
+	}
+	// номер, уже загруженный ранее или встречающийся в пакете повторно, не сохраняется, не прерывая транзакцию
+	stored, err := s.repository.StoreUserOrderIfNew(ctx, orderNumber, "NEW", userID)
+	if err != nil {
+		logrus.Error(err)
+		return "", customerrors.ErrAccessingDB
+	}
+	if stored {
+		return models.OrderUploadAccepted, nil
+	}
+	switch err = s.checkOrderOwner(ctx, userID, orderNumber); {
+	case errors.Is(err, customerrors.ErrUserOrderExists):
+		return models.OrderUploadDuplicate, nil
+	case errors.Is(err, customerrors.ErrAnotherUserOrderExists):
+		return models.OrderUploadOwnedByAnotherUser, nil
+	case err != nil:
+		return "", err
+	default:
+		logrus.Errorf("order %s was neither stored nor found", orderNumber)
+		return "", customerrors.ErrAccessingDB
+	}
+}
+
+// checkOrderOwner проверяет, загружался ли уже заказ и кем, возвращает nil если заказ еще не загружен
+func (s GmartServices) checkOrderOwner(ctx context.Context, userID uuid.UUID, orderNumber string) error {
 	savedUserID, err := s.repository.GetUUIDFromOrders(ctx, orderNumber)
 	if err == nil {
 		if savedUserID == userID {
@@ -258,315 +776,313 @@ func (s GmartServices) InputUserOrder(ctx context.Context, userID uuid.UUID, ord
 		}
 		return customerrors.ErrAnotherUserOrderExists
 	}
-	if !errors.Is(err, pgx.ErrNoRows) {
+	if !errors.Is(err, customerrors.ErrNotFound) {
 		logrus.Error(err)
 		return customerrors.ErrAccessingDB
 	}
-	resultCh := make(chan models.AccrualResponseData)
-	errCh := make(chan error)
-	var order models.UserOrder
-	order.Number = orderNumber
-	go func() {
-		defer close(resultCh)
-		defer close(errCh)
-		responseData, err := s.GetAccrualAPI(ctx, order)
-		if err != nil {
-			errCh <- err
-			return
-		} else {
-			resultCh <- responseData
-		}
-	}()
-	var accrualData models.AccrualResponseData
-	select {
-	case accrualData = <-resultCh:
-		if accrualData.Status == "REGISTERED" {
-			accrualData.Status = "NEW"
-		}
-		var userBalance = decimal.NewFromFloat(0.00)
-		userBalance, err = s.repository.GetUserBalance(ctx, userID)
-		if err != nil {
-			if !errors.Is(err, pgx.ErrNoRows) {
-				logrus.Error(err)
-				return customerrors.ErrAccessingDB
-			}
-		}
-		newUserBalance := userBalance.Add(*accrualData.Accrual)
-		return s.withTransaction(ctx, func(tx pgx.Tx) error {
-			if err = s.repository.StoreUserOrder(ctx, tx, orderNumber, accrualData.Status, userID, *accrualData.Accrual); err != nil {
-				logrus.Error(err)
-				return customerrors.ErrAccessingDB
-			}
-			if accrualData.Accrual != nil {
-				if err = s.repository.UpdateUserBalance(ctx, tx, userID, newUserBalance); err != nil {
-					logrus.Error(err)
-					return customerrors.ErrAccessingDB
-				}
-				return nil
-			}
-			return nil
-		})
-	case err = <-errCh:
-		if err != nil {
-			logrus.Error(err)
-			return err
-		}
-	}
 	return nil
 }
 
-// withTransaction создание и управление транзакцией
-func (s GmartServices) withTransaction(ctx context.Context, txFunc func(pgx.Tx) error) error {
-	tx, err := s.dbPool.Begin(ctx)
-	if err != nil {
-		logrus.Error("Error starting transaction: ", err)
-		return err
-	}
-	//управление транзакцией при помощи замыкания
-	defer func() {
-		if p := recover(); p != nil {
-			tx.Rollback(ctx)
-			panic(p)
-		} else if err != nil {
-			tx.Rollback(ctx)
-		} else {
-			err = tx.Commit(ctx)
-		}
-	}()
+// checkResult результат проверки заказа в accrual системе
+type checkResult struct {
+	order       models.UserOrder
+	accrualData models.AccrualResponseData
+	err         error
+}
 
-	err = txFunc(tx)
-	return err
+// isFinalStatus проверяет, является ли статус заказа окончательным
+func isFinalStatus(status string) bool {
+	return status == "PROCESSED" || status == "INVALID"
+}
+
+// nextCheckDelay вычисляет задержку до следующей проверки заказа: экспоненциальный рост от minCheckDelay
+// до maxCheckDelay в зависимости от числа проверок без изменения статуса, со случайным разбросом
+func nextCheckDelay(attempts int) time.Duration {
+	delay := maxCheckDelay
+	if attempts < 32 {
+		if d := minCheckDelay << attempts; d > 0 && d < maxCheckDelay {
+			delay = d
+		}
+	}
+	// equal jitter: половина задержки фиксирована, половина случайна, чтобы заказы не проверялись одновременно
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
 }
 
 // startWorkers создание worker пула
-func (s GmartServices) startWorkers(ctx context.Context, numOfWorkers int, tasks <-chan models.UserOrder, resultCh chan<- models.AccrualResponseData, errCh chan<- error, wg *sync.WaitGroup) {
+func (s GmartServices) startWorkers(ctx context.Context, numOfWorkers int, tasks <-chan models.UserOrder, resultCh chan<- checkResult, wg *sync.WaitGroup) {
 	for i := 0; i < numOfWorkers; i++ {
-		go s.worker(ctx, tasks, resultCh, errCh, wg)
+		go s.worker(ctx, tasks, resultCh, wg)
 	}
 }
 
 // startWorkers создание worker
-func (s GmartServices) worker(ctx context.Context, tasks <-chan models.UserOrder, resultCh chan<- models.AccrualResponseData, errCh chan<- error, wg *sync.WaitGroup) {
+func (s GmartServices) worker(ctx context.Context, tasks <-chan models.UserOrder, resultCh chan<- checkResult, wg *sync.WaitGroup) {
 	for task := range tasks {
 		responseData, err := s.GetAccrualAPI(ctx, task)
-		if err != nil {
-			errCh <- err
-		} else {
-			if task.Status != responseData.Status {
-				resultCh <- responseData
-			}
+		// после 429 limiter ставит на паузу всех воркеров, поэтому просто повторяем запрос по окончании окна
+		for errors.Is(err, customerrors.ErrAccrualTooManyRequests) {
+			responseData, err = s.GetAccrualAPI(ctx, task)
 		}
+		resultCh <- checkResult{order: task, accrualData: responseData, err: err}
 		wg.Done()
 	}
 }
 
-// RunUpdateOrdersStatusJob метод запускающий асинхронный сбор заказов с незавершенными статусами и обращение с ними к accrual сервису
-func (s GmartServices) RunUpdateOrdersStatusJob(ctx context.Context) error {
-	processingOrders, err := s.repository.GetProcessingOrders(ctx)
-	if err != nil {
-		return err
-	}
-
-	tasks := make(chan models.UserOrder, len(processingOrders))
-	resultCh := make(chan models.AccrualResponseData)
-	errCh := make(chan error)
+// checkOrders проверяет заказы в accrual системе при помощи пула воркеров и возвращает результаты по каждому заказу
+func (s GmartServices) checkOrders(ctx context.Context, orders []models.UserOrder) []checkResult {
+	tasks := make(chan models.UserOrder, len(orders))
+	resultCh := make(chan checkResult, len(orders))
 	var wg sync.WaitGroup
 
-	numOfWorkers := 10 // Устанавливаем количество воркеров
-	s.startWorkers(ctx, numOfWorkers, tasks, resultCh, errCh, &wg)
-	for _, order := range processingOrders {
+	s.startWorkers(ctx, numOfWorkers, tasks, resultCh, &wg)
+	for _, order := range orders {
 		wg.Add(1)
 		tasks <- order
 	}
 	close(tasks)
+	wg.Wait()
+	close(resultCh)
 
-	go func() {
-		wg.Wait()
-		close(resultCh)
-		close(errCh)
-	}()
-	done := false
-	var ordersToUpdate []models.AccrualResponseData
-	var usersBalanceToUpdate = make(map[uuid.UUID]decimal.Decimal)
-	for !done {
-		select {
-		case accrualData, ok := <-resultCh:
-			if !ok {
-				resultCh = nil
-			} else {
-				ordersToUpdate = append(ordersToUpdate, accrualData)
-				if accrualData.Accrual != nil {
-					userBalance, err := s.repository.GetUserBalance(ctx, accrualData.UserID)
-					if err != nil {
-						logrus.Error(err)
-						return customerrors.ErrAccessingDB
-					}
-					usersBalanceToUpdate[accrualData.UserID] = userBalance.Add(*accrualData.Accrual)
-				}
-			}
-		case err, ok := <-errCh:
-			if !ok {
-				errCh = nil
-			} else {
-				logrus.Error(err)
-				return err
-			}
-		}
-		if resultCh == nil && errCh == nil {
-			done = true
-		}
+	results := make([]checkResult, 0, len(orders))
+	for result := range resultCh {
+		results = append(results, result)
 	}
+	return results
+}
 
-	// запускаем транзакцию в которой обновляем баланс пользователя и состояние заказов
-	return s.withTransaction(ctx, func(tx pgx.Tx) error {
-		if err = s.repository.UsersBalanceUpdate(ctx, tx, usersBalanceToUpdate); err != nil {
-			logrus.Error(err)
-			return customerrors.ErrAccessingDB
+// RunUpdateOrdersStatusJob метод запускающий обработку заказов, у которых подошло время проверки в accrual сервисе.
+// Заказы выбираются ограниченными пачками, пока не будут обработаны все заказы, время проверки которых наступило
+func (s GmartServices) RunUpdateOrdersStatusJob(ctx context.Context) error {
+	for {
+		processed, err := s.updateOrdersStatusBatch(ctx)
+		if err != nil {
+			return err
 		}
-		// Обновление заказов в таблице processingOrders базы данных
-		if len(ordersToUpdate) > 0 {
-			if err = s.repository.UpdateOrders(ctx, tx, ordersToUpdate); err != nil {
-				return customerrors.ErrAccessingDB
-			}
+		if processed < pollBatchSize {
+			return nil
 		}
-		return nil
-	})
+	}
 }
 
-// CheckUpdateUserOrders метод запускающий сбор заказов с незавершенными статусами у конкретного пользователя
-// и обращение с ними к accrual сервису для проверки обновленного состояния
-func (s GmartServices) CheckUpdateUserOrders(ctx context.Context, userID uuid.UUID) error {
-	orders, err := s.repository.GetUserProcessingOrders(ctx, userID)
+// updateOrdersStatusBatch проверяет в accrual сервисе одну пачку заказов, у которых подошло время проверки,
+// сохраняет изменившиеся статусы и начисления, а незавершенным заказам назначает время следующей проверки
+func (s GmartServices) updateOrdersStatusBatch(ctx context.Context) (int, error) {
+	// заказы захватываются на время claimLease, чтобы параллельно работающие экземпляры сервиса не проверяли их повторно
+	dueOrders, err := s.repository.ClaimDueOrders(ctx, pollBatchSize, claimLease)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if len(dueOrders) == 0 {
+		return 0, nil
 	}
-	var ordersToUpdate []models.AccrualResponseData
-	tasks := make(chan models.UserOrder, len(orders))
-	resultCh := make(chan models.AccrualResponseData)
-	errCh := make(chan error)
-	var wg sync.WaitGroup
 
-	numOfWorkers := 10 // Устанавливаем количество воркеров
-	s.startWorkers(ctx, numOfWorkers, tasks, resultCh, errCh, &wg)
-	for _, order := range orders {
-		wg.Add(1)
-		tasks <- order
+	var ordersToUpdate []models.AccrualResponseData
+	var ordersToSchedule []models.UserOrder
+	now := time.Now()
+	for _, result := range s.checkOrders(ctx, dueOrders) {
+		order := result.order
+		switch {
+		case result.err != nil:
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			logrus.Errorf("order %s check failed: %v", order.Number, result.err)
+			order.CheckAttempts++
+		case result.accrualData.Status != order.Status:
+			accrualData := result.accrualData
+			ordersToUpdate = append(ordersToUpdate, accrualData)
+			// статус изменился, значит расчет продвигается - начинаем отсчет задержки заново
+			order.Status = accrualData.Status
+			order.CheckAttempts = 0
+		default:
+			order.CheckAttempts++
+		}
+		if !isFinalStatus(order.Status) {
+			order.NextCheckAt = now.Add(nextCheckDelay(order.CheckAttempts))
+			ordersToSchedule = append(ordersToSchedule, order)
+		}
 	}
-	close(tasks)
 
-	go func() {
-		wg.Wait()
-		close(resultCh)
-		close(errCh)
-	}()
-	done := false
-	var accrualToUpdate decimal.Decimal
-	for !done {
-		select {
-		case accrualData, ok := <-resultCh:
-			if !ok {
-				resultCh = nil
-			} else {
-				ordersToUpdate = append(ordersToUpdate, accrualData)
-				if accrualData.Accrual != nil {
-					accrualToUpdate = accrualToUpdate.Add(*accrualData.Accrual)
-				}
+	// запускаем транзакцию в которой обновляем баланс пользователя, состояние заказов и время их следующей проверки
+	var updatedOrders []models.AccrualResponseData
+	err = s.repository.WithTx(ctx, func(ctx context.Context) error {
+		// Обновление заказов в таблице orders базы данных, начисления зачисляются только по реально
+		// измененным заказам, поэтому заказ, уже обработанный другим экземпляром, не будет зачислен повторно
+		if len(ordersToUpdate) > 0 {
+			updatedOrders, err = s.repository.UpdateOrders(ctx, ordersToUpdate)
+			if err != nil {
+				return customerrors.ErrAccessingDB
 			}
-		case err, ok := <-errCh:
-			if !ok {
-				errCh = nil
-			} else {
-				logrus.Error(err)
+			if err = s.accrueOrders(ctx, updatedOrders); err != nil {
 				return err
 			}
 		}
-		if resultCh == nil && errCh == nil {
-			done = true
+		if len(ordersToSchedule) > 0 {
+			if err = s.repository.ScheduleOrdersCheck(ctx, ordersToSchedule); err != nil {
+				return customerrors.ErrAccessingDB
+			}
 		}
-	}
-	// получаем нынешний баланс бонусов пользователя
-	userBalance, err := s.repository.GetUserBalance(ctx, userID)
+		return nil
+	})
 	if err != nil {
-		logrus.Error(err)
-		return customerrors.ErrAccessingDB
+		return 0, err
 	}
-	// запускаем транзакцию в которой обновляем баланс пользователя и состояние заказов
-	newUserBalance := userBalance.Add(accrualToUpdate)
-	return s.withTransaction(ctx, func(tx pgx.Tx) error {
-		if err = s.repository.UpdateUserBalance(ctx, tx, userID, newUserBalance); err != nil {
+	s.publishOrderUpdates(ctx, updatedOrders)
+	return len(dueOrders), nil
+}
+
+// accrueOrders в рамках транзакции проводит по журналу начисления по обновленным заказам
+func (s GmartServices) accrueOrders(ctx context.Context, updatedOrders []models.AccrualResponseData) error {
+	for _, order := range updatedOrders {
+		if order.Accrual == nil || !order.Accrual.IsPositive() {
+			continue
+		}
+		entry := models.LedgerEntry{
+			UserID:        order.UserID,
+			Type:          models.LedgerEntryAccrual,
+			Amount:        *order.Accrual,
+			ContraAccount: models.AccountAccrual,
+			OrderNumber:   order.Order,
+		}
+		if err := s.repository.AppendLedgerEntry(ctx, &entry); err != nil {
 			logrus.Error(err)
 			return customerrors.ErrAccessingDB
 		}
-		// Обновление заказов в таблице orders базы данных
-		if len(ordersToUpdate) > 0 {
-			if err = s.repository.UpdateOrders(ctx, tx, ordersToUpdate); err != nil {
-				return customerrors.ErrAccessingDB
-			}
+	}
+	return nil
+}
+
+// SubscribeEvents подписывает на события об изменении заказов и баланса пользователя
+func (s GmartServices) SubscribeEvents(userID uuid.UUID) (<-chan models.UserEvent, func()) {
+	return s.events.Subscribe(userID)
+}
+
+// publishOrderUpdates отправляет владельцам обновленных заказов события о новом статусе заказа, а получившим
+// начисление - и о новом балансе. Вызывается после фиксации изменений, ошибки доставки только логируются
+func (s GmartServices) publishOrderUpdates(ctx context.Context, updatedOrders []models.AccrualResponseData) {
+	accrued := make(map[uuid.UUID]bool)
+	for _, updated := range updatedOrders {
+		order, err := s.repository.GetOrder(ctx, updated.Order)
+		if err != nil {
+			logrus.Error(err)
+			continue
 		}
-		return nil
-	})
+		s.publish(ctx, models.UserEvent{UserID: order.UserID, Type: models.EventOrder, Order: &order})
+		if updated.Accrual != nil && updated.Accrual.IsPositive() {
+			accrued[order.UserID] = true
+		}
+	}
+	for userID := range accrued {
+		s.publishBalance(ctx, userID)
+	}
+}
 
+// publishBalance отправляет пользователю событие с его текущим балансом
+func (s GmartServices) publishBalance(ctx context.Context, userID uuid.UUID) {
+	balance, err := s.GetUserBalance(ctx, userID)
+	if err != nil {
+		return
+	}
+	s.publish(ctx, models.UserEvent{UserID: userID, Type: models.EventBalance, Balance: &balance})
+}
+
+func (s GmartServices) publish(ctx context.Context, event models.UserEvent) {
+	if err := s.events.Publish(ctx, event); err != nil {
+		logrus.Errorf("publish %s event for user %s: %v", event.Type, event.UserID, err)
+	}
 }
 
 // GetAccrualAPI отправляет запрос в систему расчёта баллов лояльности
 // и возвращает models.AccrualResponseData.
 func (s GmartServices) GetAccrualAPI(ctx context.Context, order models.UserOrder) (models.AccrualResponseData, error) {
-	accrualSystemURL := s.accrualAddress + "/api/orders/" + order.Number
-	logrus.Info(accrualSystemURL)
-
-	// create HTTP request
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, accrualSystemURL, nil)
-	if err != nil {
-		logrus.Error("failed to create request to accrual system: ", err)
+	// ждем разрешения общего ограничителя запросов
+	if err := s.limiter.Wait(ctx); err != nil {
 		return models.AccrualResponseData{}, err
 	}
-	// sent request
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	accrualResponse, err := s.accrualClient.GetOrderAccrual(ctx, order.Number)
 	if err != nil {
-		logrus.Error("failed to send request to accrual system: ", err)
+		var rateLimitErr *customerrors.AccrualRateLimitError
+		if errors.As(err, &rateLimitErr) {
+			s.limiter.Block(rateLimitErr.RetryAfter, rateLimitErr.RequestsPerMinute)
+			logrus.Warn(err)
+			return models.AccrualResponseData{}, err
+		}
+		// заказ еще не зарегистрирован в accrual, оставляем его новым
+		if errors.Is(err, customerrors.ErrAccrualOrderNotRegistered) {
+			return models.AccrualResponseData{UserID: order.UserID, Order: order.Number, Status: "NEW"}, nil
+		}
+		logrus.Error(err)
 		return models.AccrualResponseData{}, err
 	}
-	defer resp.Body.Close()
-
-	// check request status
-	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusNoContent {
-		zeroAccrual := decimal.NewFromFloat(0.00)
-		return models.AccrualResponseData{UserID: order.UserID, Order: order.Number, Status: "NEW", Accrual: &zeroAccrual}, nil
-	}
-	if resp.StatusCode == http.StatusInternalServerError {
-		logrus.Error("internal server error: ", resp.Status)
-		return models.AccrualResponseData{}, fmt.Errorf("internal server error: %s", resp.Status)
+	// для пользователя заказ, зарегистрированный в accrual, но еще не попавший в обработку, остается новым
+	if accrualResponse.Status == "REGISTERED" {
+		accrualResponse.Status = "NEW"
 	}
+	accrualResponse.UserID = order.UserID
+	return accrualResponse, nil
+}
 
-	// read response body
-	body, err := io.ReadAll(resp.Body)
+// GetUserOrdersInfo метод возвращает заказы пользователя, подходящие под условия фильтра, или ошибку
+// models.ErrUserHasNoOrders если таких заказов нет. hasMore сообщает, что за последним заказом есть следующая страница
+func (s GmartServices) GetUserOrdersInfo(ctx context.Context, userID uuid.UUID, filter models.OrderFilter) (userOrders []models.UserOrder, hasMore bool, err error) {
+	limit := filter.Limit
+	if limit > 0 {
+		filter.Limit++
+	}
+	userOrders, err = s.repository.GetUserOrders(ctx, userID, filter)
 	if err != nil {
-		logrus.Error("failed to read response body: ", err)
-		return models.AccrualResponseData{}, err
+		return nil, false, err
 	}
-
-	// parse body
-	var accrualResponse models.AccrualResponseData
-	logrus.Info(string(body))
-	if err = json.Unmarshal(body, &accrualResponse); err != nil {
-		logrus.Error("failed to unmarshal response body: ", err)
-		return models.AccrualResponseData{}, err
+	if len(userOrders) == 0 {
+		return nil, false, customerrors.ErrUserHasNoOrders
 	}
-	accrualResponse.UserID = order.UserID
-	return accrualResponse, nil
+	userOrders, hasMore = trimPage(userOrders, limit)
+	return userOrders, hasMore, nil
 }
 
-// GetUserOrdersInfo метод возвращает все заказы пользователя или ошибку models.ErrUserHasNoOrders если у пользователя нет заказов
-func (s GmartServices) GetUserOrdersInfo(ctx context.Context, userID uuid.UUID) ([]models.UserOrder, error) {
-	userOrders, err := s.repository.GetUserOrders(ctx, userID)
+// GetUserOrderInfo возвращает заказ пользователя вместе с историей изменения его статуса. Заказ другого пользователя
+// не раскрывается: для него, как и для незагруженного номера, возвращается customerrors.ErrOrderNotFound
+func (s GmartServices) GetUserOrderInfo(ctx context.Context, userID uuid.UUID, orderNumber string) (models.UserOrderDetails, error) {
+	order, err := s.repository.GetOrder(ctx, orderNumber)
 	if err != nil {
-		return nil, err
+		if errors.Is(err, customerrors.ErrNotFound) {
+			return models.UserOrderDetails{}, customerrors.ErrOrderNotFound
+		}
+		logrus.Error(err)
+		return models.UserOrderDetails{}, customerrors.ErrAccessingDB
 	}
-	if len(userOrders) == 0 {
-		return nil, customerrors.ErrUserHasNoOrders
+	if order.UserID != userID {
+		return models.UserOrderDetails{}, customerrors.ErrOrderNotFound
+	}
+	history, err := s.repository.GetOrderStatusHistory(ctx, orderNumber)
+	if err != nil {
+		logrus.Error(err)
+		return models.UserOrderDetails{}, customerrors.ErrAccessingDB
+	}
+	if history == nil {
+		history = []models.OrderStatusChange{}
+	}
+	details := models.UserOrderDetails{
+		Number:        order.Number,
+		Status:        order.Status,
+		Accrual:       order.Accrual,
+		UploadedAt:    order.UploadedAt,
+		CheckAttempts: order.CheckAttempts,
+		History:       history,
+	}
+	if !isFinalStatus(order.Status) {
+		details.NextCheckAt = &order.NextCheckAt
+	}
+	return details, nil
+}
+
+// trimPage отбрасывает запись, запрошенную сверх limit, чтобы узнать, есть ли следующая страница
+func trimPage[T any](rows []T, limit int) ([]T, bool) {
+	if limit > 0 && len(rows) > limit {
+		return rows[:limit], true
 	}
-	return userOrders, nil
+	return rows, false
 }
 
 // GetUserBalance получаем из репозитория баланс пользователя и возвращаем в хендлер models.BalanceResponseData или ошибку
@@ -586,45 +1102,258 @@ func (s GmartServices) GetUserBalance(ctx context.Context, userID uuid.UUID) (us
 	return userBalance, nil
 }
 
-// TODO неужели номер заказа на списание не должен быть уникальным?
-
-// WithdrawalBonusForNewOrder сохранение запроса на списание бонусных средств на оплату заказа
-func (s GmartServices) WithdrawalBonusForNewOrder(ctx context.Context, userID uuid.UUID, orderNumber string, sum decimal.Decimal) error {
+// WithdrawalBonusForNewOrder сохранение запроса на списание бонусных средств на оплату заказа.
+// Запись о списании проводится по журналу в той же транзакции, что и сохраняется списание, только если на счету достаточно средств.
+// Номер заказа на списание уникален для пользователя: повтор уже выполненного запроса (с тем же ключом идемпотентности,
+// а без ключа - с тем же номером заказа и суммой) не списывает баллы повторно и возвращает replayed = true.
+// Списание суммы больше порога у пользователя с двухфакторной аутентификацией требует свежего кода TOTP totpCode
+func (s GmartServices) WithdrawalBonusForNewOrder(ctx context.Context, userID uuid.UUID, idempotencyKey, orderNumber string, sum decimal.Decimal, totpCode string) (replayed bool, err error) {
 	if !isValidLuhn(orderNumber) {
-		return customerrors.ErrOrderNumber
+		return false, customerrors.ErrOrderNumber
 	}
-	userBalance, err := s.repository.GetUserBalance(ctx, userID)
-	if err != nil {
-		logrus.Error(err)
-		return customerrors.ErrAccessingDB
+	if !sum.IsPositive() {
+		return false, customerrors.ErrWithdrawalSum
 	}
-	if userBalance.LessThan(sum) {
-		return customerrors.ErrNotEnoughFunds
+	var user *models.User
+	if s.totpWithdrawalThreshold != nil && sum.GreaterThan(*s.totpWithdrawalThreshold) {
+		twoFactor, err := s.twoFactorEnabled(ctx, userID)
+		if err != nil {
+			return false, err
+		}
+		if twoFactor {
+			if totpCode == "" {
+				return false, customerrors.ErrTwoFactorCodeRequired
+			}
+			savedUser, err := s.repository.GetUserByID(ctx, userID)
+			if err != nil {
+				logrus.Error(err)
+				return false, customerrors.ErrAccessingDB
+			}
+			user = &savedUser
+		}
 	}
-
-	newUserBalance := userBalance.Sub(sum)
-
-	return s.withTransaction(ctx, func(tx pgx.Tx) error {
-		if err = s.repository.StoreUserWithdrawal(ctx, tx, userID, orderNumber, sum); err != nil {
+	var stored bool
+	err = s.repository.WithTx(ctx, func(ctx context.Context) error {
+		stored, err = s.repository.StoreUserWithdrawal(ctx, userID, orderNumber, sum, idempotencyKey)
+		if err != nil {
 			logrus.Error(err)
-			return err
+			return customerrors.ErrAccessingDB
+		}
+		if !stored {
+			return nil
+		}
+		// код проверяется только для нового списания, чтобы повтор запроса с тем же кодом получил прежний ответ,
+		// а при отказе в списании код не считался использованным
+		if user != nil {
+			if err = s.checkSecondFactor(ctx, *user, totpCode, "", false); err != nil {
+				return err
+			}
 		}
-		if err = s.repository.UpdateUserBalance(ctx, tx, userID, newUserBalance); err != nil {
+		entry := models.LedgerEntry{
+			UserID:        userID,
+			Type:          models.LedgerEntryWithdrawal,
+			Amount:        sum.Neg(),
+			ContraAccount: models.AccountWithdrawals,
+			OrderNumber:   orderNumber,
+		}
+		if err = s.repository.AppendLedgerEntry(ctx, &entry); err != nil {
+			if errors.Is(err, customerrors.ErrNotEnoughFunds) {
+				return err
+			}
 			logrus.Error(err)
-			return err
+			return customerrors.ErrAccessingDB
 		}
 		return nil
 	})
+	if err != nil {
+		return false, err
+	}
+	if stored {
+		s.publishBalance(ctx, userID)
+		return false, nil
+	}
+	return s.checkWithdrawalReplay(ctx, userID, idempotencyKey, orderNumber, sum)
 }
 
-// GetUserWithdrawalsInfo отображение информации о списаниях пользователя
-func (s GmartServices) GetUserWithdrawalsInfo(ctx context.Context, userID uuid.UUID) ([]models.UserWithdrawal, error) {
-	userWithdrawals, err := s.repository.GetUserWithdrawals(ctx, userID)
+// checkWithdrawalReplay проверяет, является ли запрос на списание, конфликтующий с уже сохраненным списанием, повтором
+func (s GmartServices) checkWithdrawalReplay(ctx context.Context, userID uuid.UUID, idempotencyKey, orderNumber string, sum decimal.Decimal) (bool, error) {
+	existing, err := s.repository.GetUserWithdrawal(ctx, userID, orderNumber, idempotencyKey)
 	if err != nil {
-		return nil, err
+		logrus.Error(err)
+		return false, customerrors.ErrAccessingDB
+	}
+	samePayload := existing.Order == orderNumber && existing.Sum != nil && existing.Sum.Equal(sum)
+	if idempotencyKey != "" && existing.IdempotencyKey == idempotencyKey {
+		if samePayload {
+			return true, nil
+		}
+		return false, customerrors.ErrIdempotencyKeyReused
+	}
+	if idempotencyKey == "" && samePayload {
+		return true, nil
+	}
+	return false, customerrors.ErrWithdrawalExists
+}
+
+// GetUserWithdrawalsInfo отображение информации о списаниях пользователя, подходящих под условия фильтра.
+// hasMore сообщает, что за последним списанием есть следующая страница
+func (s GmartServices) GetUserWithdrawalsInfo(ctx context.Context, userID uuid.UUID, filter models.WithdrawalFilter) (userWithdrawals []models.UserWithdrawal, hasMore bool, err error) {
+	limit := filter.Limit
+	if limit > 0 {
+		filter.Limit++
+	}
+	userWithdrawals, err = s.repository.GetUserWithdrawals(ctx, userID, filter)
+	if err != nil {
+		return nil, false, err
 	}
 	if len(userWithdrawals) == 0 {
-		return nil, customerrors.ErrUserHasNoWithdrawals
+		return nil, false, customerrors.ErrUserHasNoWithdrawals
+	}
+	userWithdrawals, hasMore = trimPage(userWithdrawals, limit)
+	return userWithdrawals, hasMore, nil
+}
+
+// GetUserLedgerInfo отображение журнала движения баллов пользователя
+func (s GmartServices) GetUserLedgerInfo(ctx context.Context, userID uuid.UUID) ([]models.LedgerEntry, error) {
+	entries, err := s.repository.GetUserLedger(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, customerrors.ErrUserHasNoLedgerEntries
+	}
+	return entries, nil
+}
+
+// userIDByLogin возвращает UUID пользователя по логину или customerrors.ErrUserNotFound
+func (s GmartServices) userIDByLogin(ctx context.Context, login string) (uuid.UUID, error) {
+	userID, err := s.repository.GetUUIDFromUsers(ctx, login)
+	if err != nil {
+		if errors.Is(err, customerrors.ErrNotFound) {
+			return uuid.Nil, customerrors.ErrUserNotFound
+		}
+		logrus.Error(err)
+		return uuid.Nil, customerrors.ErrAccessingDB
+	}
+	return userID, nil
+}
+
+// GetUserInfo возвращает сотруднику поддержки сведения о пользователе с логином login и его баланс
+func (s GmartServices) GetUserInfo(ctx context.Context, login string) (models.AdminUserInfo, error) {
+	userID, err := s.userIDByLogin(ctx, login)
+	if err != nil {
+		return models.AdminUserInfo{}, err
+	}
+	user, err := s.repository.GetUserByID(ctx, userID)
+	if err != nil {
+		logrus.Error(err)
+		return models.AdminUserInfo{}, customerrors.ErrAccessingDB
+	}
+	twoFactor, err := s.twoFactorEnabled(ctx, userID)
+	if err != nil {
+		return models.AdminUserInfo{}, err
+	}
+	balance, err := s.GetUserBalance(ctx, userID)
+	if err != nil {
+		return models.AdminUserInfo{}, err
+	}
+	return models.AdminUserInfo{
+		ID:               user.ID,
+		Login:            user.Login,
+		Role:             user.Role,
+		CreatedAt:        user.CreatedAt,
+		TwoFactorEnabled: twoFactor,
+		Balance:          balance,
+	}, nil
+}
+
+// FindOrders возвращает заказы всех пользователей по условиям фильтра, login ограничивает выборку заказами
+// одного пользователя
+func (s GmartServices) FindOrders(ctx context.Context, login string, filter models.OrderFilter) ([]models.AdminOrder, error) {
+	if login != "" {
+		userID, err := s.userIDByLogin(ctx, login)
+		if err != nil {
+			return nil, err
+		}
+		filter.UserID = &userID
+	}
+	orders, err := s.repository.FindOrders(ctx, filter)
+	if err != nil {
+		logrus.Error(err)
+		return nil, customerrors.ErrAccessingDB
+	}
+	return orders, nil
+}
+
+// RecheckOrder назначает немедленную повторную проверку заказа в accrual, не дожидаясь очередной попытки
+// по расписанию. Заказ с окончательным статусом не перепроверяется
+func (s GmartServices) RecheckOrder(ctx context.Context, orderNumber string) error {
+	rescheduled, err := s.repository.RescheduleOrderCheck(ctx, orderNumber)
+	if err != nil {
+		if errors.Is(err, customerrors.ErrNotFound) {
+			return customerrors.ErrOrderNotFound
+		}
+		logrus.Error(err)
+		return customerrors.ErrAccessingDB
+	}
+	if !rescheduled {
+		return customerrors.ErrOrderIsFinal
+	}
+	logrus.Infof("order %s scheduled for recheck", orderNumber)
+	return nil
+}
+
+// GetUserWithdrawalsByLogin возвращает сотруднику поддержки все списания пользователя с логином login
+func (s GmartServices) GetUserWithdrawalsByLogin(ctx context.Context, login string) ([]models.UserWithdrawal, error) {
+	userID, err := s.userIDByLogin(ctx, login)
+	if err != nil {
+		return nil, err
+	}
+	withdrawals, err := s.repository.GetUserWithdrawals(ctx, userID, models.WithdrawalFilter{})
+	if err != nil {
+		logrus.Error(err)
+		return nil, customerrors.ErrAccessingDB
+	}
+	return withdrawals, nil
+}
+
+// AdjustUserBalance проводит по журналу ручную корректировку баланса пользователя с логином login на сумму amount.
+// В записи журнала сохраняются причина корректировки и логин сотрудника actorID, который ее провел.
+// Списание, после которого баланс стал бы отрицательным, отклоняется с customerrors.ErrNotEnoughFunds
+func (s GmartServices) AdjustUserBalance(ctx context.Context, actorID uuid.UUID, login string, amount decimal.Decimal, reason string) (models.LedgerEntry, error) {
+	reason = strings.TrimSpace(reason)
+	amount = amount.Round(2)
+	if amount.IsZero() || reason == "" {
+		return models.LedgerEntry{}, customerrors.ErrAdjustment
+	}
+	userID, err := s.userIDByLogin(ctx, login)
+	if err != nil {
+		return models.LedgerEntry{}, err
+	}
+	actor, err := s.repository.GetUserByID(ctx, actorID)
+	if err != nil {
+		logrus.Error(err)
+		return models.LedgerEntry{}, customerrors.ErrAccessingDB
+	}
+	entry := models.LedgerEntry{
+		UserID:        userID,
+		Type:          models.LedgerEntryAdjustment,
+		Amount:        amount,
+		ContraAccount: models.AccountAdjustments,
+		Reason:        reason,
+		Actor:         actor.Login,
+	}
+	err = s.repository.WithTx(ctx, func(ctx context.Context) error {
+		return s.repository.AppendLedgerEntry(ctx, &entry)
+	})
+	if err != nil {
+		if errors.Is(err, customerrors.ErrNotEnoughFunds) {
+			return models.LedgerEntry{}, err
+		}
+		logrus.Error(err)
+		return models.LedgerEntry{}, customerrors.ErrAccessingDB
 	}
-	return userWithdrawals, nil
+	logrus.Infof("balance of %q adjusted by %s by %q: %s", login, entry.Amount, actor.Login, reason)
+	s.publishBalance(ctx, userID)
+	return entry, nil
 }
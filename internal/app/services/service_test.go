@@ -0,0 +1,176 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"github.com/DenisKhanov/Gophermart/internal/app/customerrors"
+	"github.com/DenisKhanov/Gophermart/internal/app/events"
+	"github.com/DenisKhanov/Gophermart/internal/app/loginguard"
+	"github.com/DenisKhanov/Gophermart/internal/app/models"
+	"github.com/DenisKhanov/Gophermart/internal/app/repositories"
+	"github.com/DenisKhanov/Gophermart/internal/app/totp"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"testing"
+	"time"
+)
+
+// номера заказов, проходящие проверку алгоритмом Луна
+const (
+	orderNumber1 = "12345678903"
+	orderNumber2 = "9278923470"
+)
+
+// twoFactorFixture сервис на хранилище в памяти и пользователь с баллами и подтвержденной двухфакторной аутентификацией
+type twoFactorFixture struct {
+	service *GmartServices
+	repo    *repositories.InMemoryRepo
+	userID  uuid.UUID
+	secret  string
+}
+
+func newTwoFactorFixture(t *testing.T, threshold string) twoFactorFixture {
+	t.Helper()
+	ctx := context.Background()
+	repo := repositories.NewInMemoryRepo()
+	limit := decimal.RequireFromString(threshold)
+	service := NewGmartServices(repo, nil, events.NewBroker(), AuthConfig{
+		LoginGuard:              loginguard.NewGuard(loginguard.Config{}),
+		TOTPWithdrawalThreshold: &limit,
+	})
+	userID := uuid.New()
+	if err := repo.StoreNewUser(ctx, userID, "alice", []byte("hash")); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.StoreNewUserBalance(ctx, userID); err != nil {
+		t.Fatal(err)
+	}
+	entry := models.LedgerEntry{
+		UserID:        userID,
+		Type:          models.LedgerEntryAccrual,
+		Amount:        decimal.NewFromInt(1000),
+		ContraAccount: models.AccountAccrual,
+	}
+	if err := repo.AppendLedgerEntry(ctx, &entry); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = repo.StoreUserTOTP(ctx, models.UserTOTP{UserID: userID, Secret: secret, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	// секрет подтвержден кодом задолго до теста, поэтому коды текущего интервала еще не использованы
+	if _, err = repo.EnableUserTOTP(ctx, userID, secret, totp.Step(time.Now())-10); err != nil {
+		t.Fatal(err)
+	}
+	return twoFactorFixture{service: service, repo: repo, userID: userID, secret: secret}
+}
+
+// code возвращает код TOTP интервала, отстоящего на offset от текущего
+func (f twoFactorFixture) code(t *testing.T, offset int64) string {
+	t.Helper()
+	code, err := totp.Code(f.secret, totp.Step(time.Now())+offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func (f twoFactorFixture) withdraw(orderNumber, sum, code string) error {
+	_, err := f.service.WithdrawalBonusForNewOrder(context.Background(), f.userID, "", orderNumber,
+		decimal.RequireFromString(sum), code)
+	return err
+}
+
+func (f twoFactorFixture) balance(t *testing.T) decimal.Decimal {
+	t.Helper()
+	balance, err := f.repo.GetUserBalance(context.Background(), f.userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return balance
+}
+
+func TestWithdrawalTwoFactorThreshold(t *testing.T) {
+	f := newTwoFactorFixture(t, "100")
+	if err := f.withdraw(orderNumber1, "100", ""); err != nil {
+		t.Fatalf("withdrawal at the threshold without code: %v", err)
+	}
+	if err := f.withdraw(orderNumber2, "100.01", ""); !errors.Is(err, customerrors.ErrTwoFactorCodeRequired) {
+		t.Fatalf("withdrawal above the threshold without code = %v, want %v", err, customerrors.ErrTwoFactorCodeRequired)
+	}
+	if err := f.withdraw(orderNumber2, "100.01", f.code(t, 0)); err != nil {
+		t.Fatalf("withdrawal above the threshold with code: %v", err)
+	}
+	if got, want := f.balance(t), decimal.RequireFromString("799.99"); !got.Equal(want) {
+		t.Errorf("balance %s, want %s", got, want)
+	}
+}
+
+func TestWithdrawalTwoFactorWrongCode(t *testing.T) {
+	f := newTwoFactorFixture(t, "100")
+	if err := f.withdraw(orderNumber1, "500", f.code(t, 5)); !errors.Is(err, customerrors.ErrWrongTwoFactorCode) {
+		t.Fatalf("withdrawal with code outside the window = %v, want %v", err, customerrors.ErrWrongTwoFactorCode)
+	}
+	// отклоненное списание не сохраняется и не меняет баланс
+	if got, want := f.balance(t), decimal.NewFromInt(1000); !got.Equal(want) {
+		t.Errorf("balance %s, want %s", got, want)
+	}
+	withdrawals, _, err := f.service.GetUserWithdrawalsInfo(context.Background(), f.userID, models.WithdrawalFilter{})
+	if err != nil && !errors.Is(err, customerrors.ErrUserHasNoWithdrawals) {
+		t.Fatal(err)
+	}
+	if len(withdrawals) != 0 {
+		t.Errorf("rejected withdrawal is stored: %v", withdrawals)
+	}
+}
+
+func TestWithdrawalTwoFactorCodeReuse(t *testing.T) {
+	f := newTwoFactorFixture(t, "100")
+	code := f.code(t, 0)
+	if err := f.withdraw(orderNumber1, "200", code); err != nil {
+		t.Fatalf("first withdrawal with code: %v", err)
+	}
+	if err := f.withdraw(orderNumber2, "200", code); !errors.Is(err, customerrors.ErrWrongTwoFactorCode) {
+		t.Fatalf("withdrawal with reused code = %v, want %v", err, customerrors.ErrWrongTwoFactorCode)
+	}
+	if got, want := f.balance(t), decimal.NewFromInt(800); !got.Equal(want) {
+		t.Errorf("balance %s, want %s", got, want)
+	}
+}
+
+func TestWithdrawalTwoFactorOlderStep(t *testing.T) {
+	f := newTwoFactorFixture(t, "100")
+	if err := f.withdraw(orderNumber1, "200", f.code(t, 0)); err != nil {
+		t.Fatalf("first withdrawal with code: %v", err)
+	}
+	// код предыдущего интервала еще в пределах допуска, но старше использованного
+	if err := f.withdraw(orderNumber2, "200", f.code(t, -1)); !errors.Is(err, customerrors.ErrWrongTwoFactorCode) {
+		t.Fatalf("withdrawal with code of an older step = %v, want %v", err, customerrors.ErrWrongTwoFactorCode)
+	}
+}
+
+func TestTrimPage(t *testing.T) {
+	rows := []int{1, 2, 3, 4}
+	tests := []struct {
+		name        string
+		limit       int
+		wantLen     int
+		wantHasMore bool
+	}{
+		{name: "no limit", limit: 0, wantLen: 4},
+		{name: "limit above rows", limit: 5, wantLen: 4},
+		{name: "limit equals rows", limit: 4, wantLen: 4},
+		{name: "one row over limit", limit: 3, wantLen: 3, wantHasMore: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, hasMore := trimPage(rows, tt.limit)
+			if len(got) != tt.wantLen || hasMore != tt.wantHasMore {
+				t.Errorf("trimPage(%v, %d) = %v, %v, want %d rows, %v", rows, tt.limit, got, hasMore, tt.wantLen, tt.wantHasMore)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Параметры одноразовых паролей по RFC 6238, которые поддерживаются всеми распространенными приложениями-аутентификаторами
+const (
+	Digits    = 6
+	Period    = 30 * time.Second
+	secretLen = 20 // длина секрета в байтах, рекомендованная RFC 4226 для HMAC-SHA1
+	skew      = 1  // сколько соседних интервалов принимается для компенсации расхождения часов
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret генерирует случайный секрет и возвращает его в кодировке base32, в которой он вводится в приложение
+func GenerateSecret() (string, error) {
+	secret := make([]byte, secretLen)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(secret), nil
+}
+
+// ProvisioningURI возвращает ссылку otpauth://, из которой приложение-аутентификатор (например, по QR-коду)
+// получает секрет и параметры генерации кодов
+func ProvisioningURI(issuer, account, secret string) string {
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", issuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprint(Digits))
+	values.Set("period", fmt.Sprint(int(Period.Seconds())))
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+// Step возвращает номер интервала, которому принадлежит момент t
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period.Seconds())
+}
+
+// Code вычисляет код для интервала step по алгоритму HOTP (RFC 4226)
+func Code(secret string, step int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("decode TOTP secret: %w", err)
+	}
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", Digits, value%1_000_000), nil
+}
+
+// Validate проверяет код на момент now с допуском в один интервал в обе стороны и возвращает интервал,
+// которому соответствует код. Чтобы код нельзя было использовать повторно, вызывающий должен
+// принимать только интервалы новее последнего использованного
+func Validate(secret, code string, now time.Time) (step int64, ok bool) {
+	if len(code) != Digits {
+		return 0, false
+	}
+	current := Step(now)
+	for s := current - skew; s <= current+skew; s++ {
+		expected, err := Code(secret, s)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// recoveryCodeLen длина резервного кода в символах base32 без разделителя
+const recoveryCodeLen = 10
+
+// GenerateRecoveryCode генерирует резервный код вида xxxxx-xxxxx, который принимается вместо кода TOTP
+// при потере доступа к приложению-аутентификатору
+func GenerateRecoveryCode() (string, error) {
+	raw := make([]byte, recoveryCodeLen*5/8)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(encoding.EncodeToString(raw))
+	return code[:recoveryCodeLen/2] + "-" + code[recoveryCodeLen/2:], nil
+}
+
+// NormalizeRecoveryCode приводит введенный пользователем резервный код к каноническому виду,
+// в котором вычисляется его хеш: без разделителей, пробелов и без учета регистра
+func NormalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
@@ -0,0 +1,135 @@
+package totp
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+// rfcSecret секрет "12345678901234567890" тестовых векторов RFC 6238 для SHA1 в кодировке base32
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeRFC6238(t *testing.T) {
+	// восьмизначные коды из приложения B RFC 6238, шестизначный код - их последние шесть цифр
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "287082"},
+		{unix: 1111111109, want: "081804"},
+		{unix: 1111111111, want: "050471"},
+		{unix: 1234567890, want: "005924"},
+		{unix: 2000000000, want: "279037"},
+		{unix: 20000000000, want: "353130"},
+	}
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestCodeSecret(t *testing.T) {
+	lower, err := Code("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upper, err := Code(rfcSecret, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lower != upper {
+		t.Errorf("lower case secret gives %s, upper case %s", lower, upper)
+	}
+	if _, err = Code("not base32!", 1); err == nil {
+		t.Error("Code with invalid secret returned no error")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+	code := func(step int64) string {
+		c, err := Code(rfcSecret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		wantStep int64
+		wantOK   bool
+	}{
+		{name: "current step", secret: rfcSecret, code: code(current), wantStep: current, wantOK: true},
+		{name: "previous step", secret: rfcSecret, code: code(current - 1), wantStep: current - 1, wantOK: true},
+		{name: "next step", secret: rfcSecret, code: code(current + 1), wantStep: current + 1, wantOK: true},
+		{name: "two steps ago", secret: rfcSecret, code: code(current - 2)},
+		{name: "two steps ahead", secret: rfcSecret, code: code(current + 2)},
+		{name: "short code", secret: rfcSecret, code: code(current)[:Digits-1]},
+		{name: "long code", secret: rfcSecret, code: code(current) + "0"},
+		{name: "eight digit code", secret: rfcSecret, code: "07081804"},
+		{name: "empty code", secret: rfcSecret, code: ""},
+		{name: "invalid secret", secret: "not base32!", code: "123456"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := Validate(tt.secret, tt.code, now)
+			if ok != tt.wantOK || step != tt.wantStep {
+				t.Errorf("Validate(%q) = %d, %v, want %d, %v", tt.code, step, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := encoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != secretLen {
+		t.Errorf("secret has %d bytes, want %d", len(key), secretLen)
+	}
+}
+
+func TestRecoveryCode(t *testing.T) {
+	code, err := GenerateRecoveryCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^[a-z2-7]{5}-[a-z2-7]{5}$`).MatchString(code) {
+		t.Errorf("recovery code %q has unexpected format", code)
+	}
+	if got := NormalizeRecoveryCode(code); len(got) != recoveryCodeLen {
+		t.Errorf("normalized recovery code %q has %d characters, want %d", got, len(got), recoveryCodeLen)
+	}
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{code: "abcde-fghij", want: "abcdefghij"},
+		{code: "ABCDE-FGHIJ", want: "abcdefghij"},
+		{code: " abcde fghij ", want: "abcdefghij"},
+		{code: "abcdefghij", want: "abcdefghij"},
+		{code: "ab-cd-ef gh ij", want: "abcdefghij"},
+		{code: "", want: ""},
+	}
+	for _, tt := range tests {
+		if got := NormalizeRecoveryCode(tt.code); got != tt.want {
+			t.Errorf("NormalizeRecoveryCode(%q) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}